@@ -0,0 +1,126 @@
+package ethnonce
+
+import (
+	"context"
+	"errors"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/qjpcpu/log"
+	"time"
+)
+
+var ErrAuditNotSupported = errors.New("audit not supported")
+
+const (
+	AuditGive   = "give"
+	AuditCommit = "commit"
+	AuditSync   = "sync"
+)
+
+// AuditEntry is one line of the append-only audit trail kept by backends
+type AuditEntry struct {
+	Action  string         `json:"action"`
+	Address common.Address `json:"address"`
+	Nonce   uint64         `json:"nonce"`
+	Caller  string         `json:"caller"`
+	TxHash  common.Hash    `json:"tx_hash"`
+	Success bool           `json:"success"`
+	// unix nano
+	Timestamp int64 `json:"timestamp"`
+}
+
+// Auditor is implemented by backends which keep audit trail
+type Auditor interface {
+	AppendAudit(ctx context.Context, entry AuditEntry) error
+	// entries of addr since timestamp(unix nano), in append order
+	AuditEntries(ctx context.Context, addr common.Address, since int64) ([]AuditEntry, error)
+}
+
+// AuditRecord is the life of a given nonce, or a sync when Synced
+type AuditRecord struct {
+	Address  common.Address
+	Nonce    uint64
+	Caller   string
+	GiveAt   time.Time
+	CommitAt time.Time
+	Success  bool
+	TxHash   common.Hash
+	Synced   bool
+}
+
+type callerKey struct{}
+
+// WithCaller tags nonce operations under ctx with caller in audit trail
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+func CallerOf(ctx context.Context) string {
+	caller, _ := ctx.Value(callerKey{}).(string)
+	return caller
+}
+
+// NonceHistory tells who got which nonce of addr since then
+func (n *NonceManager) NonceHistory(ctx context.Context, addr common.Address, since time.Time) ([]AuditRecord, error) {
+	auditor, ok := n.Impl.(Auditor)
+	if !ok {
+		return nil, ErrAuditNotSupported
+	}
+	entries, err := auditor.AuditEntries(ctx, addr, since.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	return MergeAudit(entries), nil
+}
+
+// MergeAudit pairs commit entries with the give entries before them
+func MergeAudit(entries []AuditEntry) []AuditRecord {
+	var records []AuditRecord
+	// nonce => index of record not committed yet
+	open := make(map[uint64]int)
+	for _, e := range entries {
+		switch e.Action {
+		case AuditGive:
+			open[e.Nonce] = len(records)
+			records = append(records, AuditRecord{
+				Address: e.Address,
+				Nonce:   e.Nonce,
+				Caller:  e.Caller,
+				GiveAt:  time.Unix(0, e.Timestamp),
+			})
+		case AuditCommit:
+			idx, ok := open[e.Nonce]
+			if !ok {
+				// given before the queried range
+				idx = len(records)
+				records = append(records, AuditRecord{Address: e.Address, Nonce: e.Nonce, Caller: e.Caller})
+			}
+			delete(open, e.Nonce)
+			records[idx].CommitAt = time.Unix(0, e.Timestamp)
+			records[idx].Success = e.Success
+			records[idx].TxHash = e.TxHash
+		case AuditSync:
+			records = append(records, AuditRecord{
+				Address:  e.Address,
+				Nonce:    e.Nonce,
+				Caller:   e.Caller,
+				CommitAt: time.Unix(0, e.Timestamp),
+				Success:  true,
+				Synced:   true,
+			})
+		}
+	}
+	return records
+}
+
+func (n *NonceManager) audit(ctx context.Context, entry AuditEntry) {
+	auditor, ok := n.Impl.(Auditor)
+	if !ok {
+		return
+	}
+	entry.Caller = CallerOf(ctx)
+	entry.Timestamp = time.Now().UnixNano()
+	// losing an audit line should not fail nonce operations
+	if err := auditor.AppendAudit(context.Background(), entry); err != nil {
+		log.Errorf("audit %s nonce:%d of %s fail:%v", entry.Action, entry.Nonce, entry.Address.Hex(), err)
+	}
+}
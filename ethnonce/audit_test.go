@@ -0,0 +1,40 @@
+package ethnonce
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"testing"
+)
+
+func TestMergeAudit(t *testing.T) {
+	addr := common.HexToAddress("0x01")
+	hash := common.HexToHash("0x02")
+	records := MergeAudit([]AuditEntry{
+		// given before queried range
+		{Action: AuditCommit, Address: addr, Nonce: 4, Success: true, Timestamp: 1},
+		{Action: AuditGive, Address: addr, Nonce: 5, Caller: "a", Timestamp: 2},
+		{Action: AuditGive, Address: addr, Nonce: 6, Caller: "b", Timestamp: 3},
+		{Action: AuditCommit, Address: addr, Nonce: 5, Timestamp: 4},
+		// failed nonce given again
+		{Action: AuditGive, Address: addr, Nonce: 5, Caller: "c", Timestamp: 5},
+		{Action: AuditCommit, Address: addr, Nonce: 5, Success: true, TxHash: hash, Timestamp: 6},
+		{Action: AuditSync, Address: addr, Nonce: 7, Timestamp: 7},
+	})
+	if len(records) != 5 {
+		t.Fatal("should merge into 5 records, got", len(records))
+	}
+	if r := records[0]; r.Nonce != 4 || !r.GiveAt.IsZero() || !r.Success {
+		t.Fatal("bad record", r)
+	}
+	if r := records[1]; r.Caller != "a" || r.Success || r.CommitAt.UnixNano() != 4 {
+		t.Fatal("bad record", r)
+	}
+	if r := records[2]; r.Caller != "b" || !r.CommitAt.IsZero() {
+		t.Fatal("nonce 6 should not committed", r)
+	}
+	if r := records[3]; r.Caller != "c" || !r.Success || r.TxHash != hash || r.GiveAt.UnixNano() != 5 {
+		t.Fatal("bad record", r)
+	}
+	if r := records[4]; !r.Synced || r.Nonce != 7 {
+		t.Fatal("bad sync record", r)
+	}
+}
@@ -0,0 +1,110 @@
+package ethnonce
+
+import (
+	"context"
+	"errors"
+	"github.com/ethereum/go-ethereum/common"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrMigrateNotSupported = errors.New("legacy migration not supported")
+	ErrNoChainID           = errors.New("client tells no chain id")
+)
+
+// ChainIDReader tells which chain a client serves, *ethclient.Client of newer
+// go-ethereum does
+type ChainIDReader interface {
+	ChainID(ctx context.Context) (*big.Int, error)
+}
+
+// NetworkIDReader is the fallback for clients without ChainID
+type NetworkIDReader interface {
+	NetworkID(ctx context.Context) (*big.Int, error)
+}
+
+// LegacyMigrator is implemented by backends which can move nonces kept
+// before chain id keying to their chain
+type LegacyMigrator interface {
+	MigrateLegacy(ctx context.Context) (int, error)
+}
+
+// chainKeying keeps chain id shared by copies of Options
+type chainKeying struct {
+	id uint64
+	*sync.Mutex
+}
+
+// zero Options keep keys by address only
+func (o *Options) keying() *chainKeying {
+	if o.chain == nil {
+		o.chain = &chainKeying{Mutex: new(sync.Mutex)}
+	}
+	return o.chain
+}
+
+// SetChainID keys nonces by id, nonces kept by address only before are not
+// seen until MigrateLegacyNonces
+func (o *Options) SetChainID(id *big.Int) {
+	o.keying().Lock()
+	defer o.chain.Unlock()
+	o.chain.id = id.Uint64()
+}
+
+// ChainID of keys, 0 means keyed by address only
+func (o *Options) ChainID(ctx context.Context) (uint64, error) {
+	if o.chain == nil {
+		return 0, nil
+	}
+	o.chain.Lock()
+	defer o.chain.Unlock()
+	return o.chain.id, nil
+}
+
+// DiscoverChainID asks conn which chain it serves, pass the id to SetChainID
+// to key nonces by chain
+func DiscoverChainID(ctx context.Context, conn interface{}) (*big.Int, error) {
+	switch src := conn.(type) {
+	case ChainIDReader:
+		return src.ChainID(ctx)
+	case NetworkIDReader:
+		return src.NetworkID(ctx)
+	default:
+		return nil, ErrNoChainID
+	}
+}
+
+// AddressKey is how backends key addr: chainid:address, or lowercased
+// address only without chain id
+func (o *Options) AddressKey(ctx context.Context, addr common.Address) (string, error) {
+	id, err := o.ChainID(ctx)
+	if err != nil {
+		return "", err
+	}
+	return ChainAddressKey(id, addr), nil
+}
+
+func ChainAddressKey(chainID uint64, addr common.Address) string {
+	if chainID == 0 {
+		return strings.ToLower(addr.Hex())
+	}
+	return strconv.FormatUint(chainID, 10) + ":" + strings.ToLower(addr.Hex())
+}
+
+// IsLegacyKey tells key made without chain id
+func IsLegacyKey(key string) bool {
+	return strings.HasPrefix(key, "0x")
+}
+
+// MigrateLegacyNonces moves nonces kept by address only to chain of manager,
+// addresses already kept under the chain are left alone
+func (n *NonceManager) MigrateLegacyNonces(ctx context.Context) (int, error) {
+	migrator, ok := n.Impl.(LegacyMigrator)
+	if !ok {
+		return 0, ErrMigrateNotSupported
+	}
+	return migrator.MigrateLegacy(ctx)
+}
@@ -0,0 +1,53 @@
+package conformance
+
+import (
+	"context"
+	"github.com/ethereum/go-ethereum/common"
+	"math/big"
+	"sync"
+)
+
+// FakeChain is a ethnonce.ChainNonceSource, tests set nonces as they like
+type FakeChain struct {
+	nonces  map[common.Address]uint64
+	err     error
+	chainID uint64
+	*sync.Mutex
+}
+
+// NewFakeChain serves chain id 1
+func NewFakeChain() *FakeChain {
+	return &FakeChain{
+		nonces:  make(map[common.Address]uint64),
+		chainID: 1,
+		Mutex:   new(sync.Mutex),
+	}
+}
+
+func (c *FakeChain) SetNonce(addr common.Address, nonce uint64) {
+	c.Lock()
+	defer c.Unlock()
+	c.nonces[addr] = nonce
+}
+
+// Fail makes every query return err until Fail(nil)
+func (c *FakeChain) Fail(err error) {
+	c.Lock()
+	defer c.Unlock()
+	c.err = err
+}
+
+func (c *FakeChain) ChainID(ctx context.Context) (*big.Int, error) {
+	c.Lock()
+	defer c.Unlock()
+	return new(big.Int).SetUint64(c.chainID), nil
+}
+
+func (c *FakeChain) PendingNonceAt(ctx context.Context, addr common.Address) (uint64, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.nonces[addr], nil
+}
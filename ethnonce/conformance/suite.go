@@ -0,0 +1,437 @@
+// Package conformance checks a NonceManagerLowlevel implementation behaves
+// the same as others, backends call Run from their tests
+package conformance
+
+import (
+	"context"
+	"errors"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/qjpcpu/ethereum/ethnonce"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Factory prepares a creator on clean storage, cleanup is called after the
+// manager closed
+type Factory func() (creator ethnonce.ManagerCreator, cleanup func())
+
+type testCase struct {
+	name string
+	fn   func(*testing.T, ethnonce.ManagerCreator, *FakeChain)
+}
+
+var testAddr = common.HexToAddress(`0xe35f3e2a93322b61e5d8931f806ff38f4a4f4d88`)
+
+var cases = []testCase{
+	{"NotInit", testNotInit},
+	{"GiveCommit", testGiveCommit},
+	{"CommitNotHeld", testCommitNotHeld},
+	{"CommitLeaseLost", testCommitLeaseLost},
+	{"Pipeline", testPipeline},
+	{"FailureCommit", testFailureCommit},
+	{"Concurrency", testConcurrency},
+	{"Expiry", testExpiry},
+	{"Renew", testRenew},
+	{"StaleHolder", testStaleHolder},
+	{"Resync", testResync},
+	{"Cancel", testCancel},
+	{"NoChainSource", testNoChainSource},
+	{"Audit", testAudit},
+	{"ChainKeying", testChainKeying},
+}
+
+func Run(t *testing.T, factory Factory) {
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			creator, cleanup := factory()
+			if cleanup != nil {
+				defer cleanup()
+			}
+			chain := NewFakeChain()
+			creator.SetEthClient(chain)
+			c.fn(t, creator, chain)
+		})
+	}
+}
+
+func syncAt(t *testing.T, mgr *ethnonce.NonceManager, chain *FakeChain, nonce uint64) {
+	chain.SetNonce(testAddr, nonce)
+	n, err := mgr.SyncNonce(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != nonce {
+		t.Fatalf("sync to %d, got %d", nonce, n)
+	}
+}
+
+func mustGive(t *testing.T, mgr *ethnonce.NonceManager, expect uint64) {
+	nonce, err := mgr.GiveNonce(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nonce != expect {
+		t.Fatalf("should give %d, got %d", expect, nonce)
+	}
+}
+
+func mustWait(t *testing.T, mgr *ethnonce.NonceManager) {
+	if _, err := mgr.GiveNonce(testAddr); err != ethnonce.ErrOtherHoldNonce {
+		t.Fatal("should wait for others, got", err)
+	}
+}
+
+func mustPeek(t *testing.T, mgr *ethnonce.NonceManager, expect uint64) {
+	if nonce := mgr.PeekNonce(testAddr); nonce != expect {
+		t.Fatalf("should peek %d, got %d", expect, nonce)
+	}
+}
+
+func testNotInit(t *testing.T, creator ethnonce.ManagerCreator, chain *FakeChain) {
+	mgr := creator.Build()
+	defer mgr.Close()
+	if _, err := mgr.GiveNonce(testAddr); err != ethnonce.ErrNotInitAddress {
+		t.Fatal("give should need init, got", err)
+	}
+	if err := mgr.CommitNonce(testAddr, 0, true); err != ethnonce.ErrNotInitAddress {
+		t.Fatal("commit should need init, got", err)
+	}
+	if err := mgr.RenewNonce(testAddr, ethnonce.Reservation{}); err != ethnonce.ErrNotInitAddress {
+		t.Fatal("renew should need init, got", err)
+	}
+	mustPeek(t, mgr, 0)
+}
+
+func testGiveCommit(t *testing.T, creator ethnonce.ManagerCreator, chain *FakeChain) {
+	mgr := creator.Build()
+	defer mgr.Close()
+	syncAt(t, mgr, chain, 5)
+	mustGive(t, mgr, 5)
+	mustWait(t, mgr)
+	if err := mgr.CommitNonce(testAddr, 5, true); err != nil {
+		t.Fatal(err)
+	}
+	mustPeek(t, mgr, 6)
+	mustGive(t, mgr, 6)
+	if err := mgr.CommitNonce(testAddr, 6, false); err != nil {
+		t.Fatal(err)
+	}
+	mustPeek(t, mgr, 6)
+	mustGive(t, mgr, 6)
+}
+
+func testCommitNotHeld(t *testing.T, creator ethnonce.ManagerCreator, chain *FakeChain) {
+	mgr := creator.Build()
+	defer mgr.Close()
+	syncAt(t, mgr, chain, 5)
+	if err := mgr.CommitNonce(testAddr, 100, true); err != ethnonce.ErrLeaseLost {
+		t.Fatal("commit not held nonce should fail, got", err)
+	}
+	if err := mgr.CommitNonce(testAddr, 5, false); err != ethnonce.ErrLeaseLost {
+		t.Fatal("commit not held nonce should fail, got", err)
+	}
+	mustPeek(t, mgr, 5)
+	mustGive(t, mgr, 5)
+	mgr.CommitNonce(testAddr, 5, true)
+	// commit twice
+	if err := mgr.CommitNonce(testAddr, 5, false); err != ethnonce.ErrLeaseLost {
+		t.Fatal("commit twice should fail, got", err)
+	}
+	mustPeek(t, mgr, 6)
+}
+
+func testCommitLeaseLost(t *testing.T, creator ethnonce.ManagerCreator, chain *FakeChain) {
+	mgr := creator.SetLease(time.Second).Build()
+	defer mgr.Close()
+	syncAt(t, mgr, chain, 5)
+	mustGive(t, mgr, 5)
+	time.Sleep(2100 * time.Millisecond)
+	// lease expired, nonce handed to another one who commits first
+	mustGive(t, mgr, 5)
+	if err := mgr.CommitNonce(testAddr, 5, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.CommitNonce(testAddr, 5, false); err != ethnonce.ErrLeaseLost {
+		t.Fatal("late commit should lose lease, got", err)
+	}
+	mustPeek(t, mgr, 6)
+}
+
+func testPipeline(t *testing.T, creator ethnonce.ManagerCreator, chain *FakeChain) {
+	mgr := creator.SetPipeline(3).Build()
+	defer mgr.Close()
+	syncAt(t, mgr, chain, 5)
+	mustGive(t, mgr, 5)
+	mustGive(t, mgr, 6)
+	mustGive(t, mgr, 7)
+	mustWait(t, mgr)
+	if err := mgr.CommitNonce(testAddr, 6, false); err != nil {
+		t.Fatal(err)
+	}
+	mustPeek(t, mgr, 6)
+	mustGive(t, mgr, 6)
+	mgr.CommitNonce(testAddr, 5, true)
+	mgr.CommitNonce(testAddr, 6, true)
+	// released nonce on top goes back to next
+	mgr.CommitNonce(testAddr, 7, false)
+	mustPeek(t, mgr, 7)
+	mustGive(t, mgr, 7)
+}
+
+func testFailureCommit(t *testing.T, creator ethnonce.ManagerCreator, chain *FakeChain) {
+	mgr := creator.SetPipeline(3).Build()
+	defer mgr.Close()
+	syncAt(t, mgr, chain, 5)
+	mustGive(t, mgr, 5)
+	mustGive(t, mgr, 6)
+	mustGive(t, mgr, 7)
+	mustWait(t, mgr)
+	mgr.CommitNonce(testAddr, 6, false)
+	mustPeek(t, mgr, 6)
+	mustGive(t, mgr, 6)
+	mgr.CommitNonce(testAddr, 7, false)
+	mgr.CommitNonce(testAddr, 6, false)
+	mustPeek(t, mgr, 6)
+	mgr.CommitNonce(testAddr, 5, true)
+	mustPeek(t, mgr, 6)
+	mustGive(t, mgr, 6)
+	mustGive(t, mgr, 7)
+}
+
+func testConcurrency(t *testing.T, creator ethnonce.ManagerCreator, chain *FakeChain) {
+	mgr := creator.SetPipeline(4).Build()
+	defer mgr.Close()
+	syncAt(t, mgr, chain, 0)
+	var lock sync.Mutex
+	given := make(map[uint64]bool)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := mgr.GiveNonceForTx(testAddr, func(nonce uint64) (*types.Transaction, error) {
+				lock.Lock()
+				defer lock.Unlock()
+				if given[nonce] {
+					t.Error("nonce given twice", nonce)
+				}
+				// every 5th job fails, nonce is given again
+				if i%5 == 0 {
+					return nil, errors.New("sign fail")
+				}
+				given[nonce] = true
+				return new(types.Transaction), nil
+			})
+			if err != nil && i%5 != 0 {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(given) != 40 {
+		t.Fatal("should give 40 nonces, got", len(given))
+	}
+	// a failed nonce given last stays a gap
+	var lowest uint64
+	for given[lowest] {
+		lowest++
+	}
+	mustPeek(t, mgr, lowest)
+}
+
+func testExpiry(t *testing.T, creator ethnonce.ManagerCreator, chain *FakeChain) {
+	mgr := creator.SetLease(time.Second).Build()
+	defer mgr.Close()
+	syncAt(t, mgr, chain, 5)
+	mustGive(t, mgr, 5)
+	mustWait(t, mgr)
+	if _, err := mgr.SyncNonce(testAddr); err != ethnonce.ErrOtherHoldNonce {
+		t.Fatal("should not sync while held, got", err)
+	}
+	time.Sleep(2100 * time.Millisecond)
+	mustGive(t, mgr, 5)
+	mgr.CommitNonce(testAddr, 5, true)
+	mustPeek(t, mgr, 6)
+}
+
+func mustReserve(t *testing.T, mgr *ethnonce.NonceManager, expect uint64) ethnonce.Reservation {
+	res, err := mgr.GiveNonceContext(context.Background(), testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Nonce != expect {
+		t.Fatalf("should give %d, got %d", expect, res.Nonce)
+	}
+	return res
+}
+
+func testRenew(t *testing.T, creator ethnonce.ManagerCreator, chain *FakeChain) {
+	mgr := creator.SetLease(3 * time.Second).Build()
+	defer mgr.Close()
+	syncAt(t, mgr, chain, 5)
+	res := mustReserve(t, mgr, 5)
+	time.Sleep(2 * time.Second)
+	if err := mgr.RenewNonce(testAddr, res); err != nil {
+		t.Fatal(err)
+	}
+	// lease would expire without renew
+	time.Sleep(2500 * time.Millisecond)
+	mustWait(t, mgr)
+	if err := mgr.CommitNonceContext(context.Background(), testAddr, res, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.RenewNonce(testAddr, res); err != ethnonce.ErrLeaseLost {
+		t.Fatal("renew committed nonce should fail, got", err)
+	}
+}
+
+func testStaleHolder(t *testing.T, creator ethnonce.ManagerCreator, chain *FakeChain) {
+	mgr := creator.SetLease(time.Second).Build()
+	defer mgr.Close()
+	syncAt(t, mgr, chain, 5)
+	stale := mustReserve(t, mgr, 5)
+	time.Sleep(2100 * time.Millisecond)
+	// lease expired, nonce handed to another one
+	res := mustReserve(t, mgr, 5)
+	ctx := context.Background()
+	if err := mgr.RenewNonce(testAddr, stale); err != ethnonce.ErrLeaseLost {
+		t.Fatal("stale renew should lose lease, got", err)
+	}
+	if err := mgr.CommitNonceContext(ctx, testAddr, stale, false); err != ethnonce.ErrLeaseLost {
+		t.Fatal("stale commit should lose lease, got", err)
+	}
+	// new holder keeps it
+	mustWait(t, mgr)
+	if err := mgr.RenewNonce(testAddr, res); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.CommitNonceContext(ctx, testAddr, res, true); err != nil {
+		t.Fatal(err)
+	}
+	mustPeek(t, mgr, 6)
+}
+
+func testResync(t *testing.T, creator ethnonce.ManagerCreator, chain *FakeChain) {
+	mgr := creator.Build()
+	defer mgr.Close()
+	syncAt(t, mgr, chain, 5)
+	mustGive(t, mgr, 5)
+	mgr.CommitNonce(testAddr, 5, true)
+	// tx dropped, chain goes back
+	syncAt(t, mgr, chain, 3)
+	mustPeek(t, mgr, 3)
+	mustGive(t, mgr, 3)
+	chain.SetNonce(testAddr, 10)
+	if _, err := mgr.SyncNonce(testAddr); err != ethnonce.ErrOtherHoldNonce {
+		t.Fatal("should not sync while held, got", err)
+	}
+	mgr.CommitNonce(testAddr, 3, false)
+	chain.Fail(errors.New("node down"))
+	if _, err := mgr.SyncNonce(testAddr); err == nil {
+		t.Fatal("should fail with chain")
+	}
+	mustPeek(t, mgr, 3)
+	chain.Fail(nil)
+	syncAt(t, mgr, chain, 10)
+	mustGive(t, mgr, 10)
+}
+
+func testCancel(t *testing.T, creator ethnonce.ManagerCreator, chain *FakeChain) {
+	mgr := creator.Build()
+	defer mgr.Close()
+	syncAt(t, mgr, chain, 5)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := mgr.GiveNonceContext(ctx, testAddr); err == nil {
+		t.Fatal("should fail with canceled context")
+	}
+	res := mustReserve(t, mgr, 5)
+	if err := mgr.CommitNonceContext(ctx, testAddr, res, true); err == nil {
+		t.Fatal("commit should fail with canceled context")
+	}
+	if err := mgr.RenewNonceContext(ctx, testAddr, res); err == nil {
+		t.Fatal("renew should fail with canceled context")
+	}
+	// still held
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := mgr.WaitNonce(ctx, testAddr); err != context.DeadlineExceeded {
+		t.Fatal("should exceed deadline, got", err)
+	}
+}
+
+func testNoChainSource(t *testing.T, creator ethnonce.ManagerCreator, chain *FakeChain) {
+	mgr := creator.SetEthClient(nil).Build()
+	defer mgr.Close()
+	if _, err := mgr.SyncNonce(testAddr); err != ethnonce.ErrNoChainSource {
+		t.Fatal("should need chain source, got", err)
+	}
+}
+
+func testAudit(t *testing.T, creator ethnonce.ManagerCreator, chain *FakeChain) {
+	mgr := creator.SetPipeline(2).Build()
+	defer mgr.Close()
+	since := time.Now()
+	syncAt(t, mgr, chain, 5)
+	ctx := ethnonce.WithCaller(context.Background(), "worker-1")
+	res, err := mgr.GiveNonceContext(ctx, testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txHash := common.HexToHash("0x01")
+	if err := mgr.CommitNonceTx(ctx, testAddr, res, txHash, true); err != nil {
+		t.Fatal(err)
+	}
+	mustGive(t, mgr, 6)
+	mgr.CommitNonce(testAddr, 6, false)
+	records, err := mgr.NonceHistory(context.Background(), testAddr, since)
+	if err == ethnonce.ErrAuditNotSupported {
+		t.Skip("backend keeps no audit trail")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatal("should have sync and 2 gives, got", records)
+	}
+	if !records[0].Synced || records[0].Nonce != 5 {
+		t.Fatal("first should be sync, got", records[0])
+	}
+	r := records[1]
+	if r.Nonce != 5 || r.Caller != "worker-1" || !r.Success || r.TxHash != txHash || r.GiveAt.IsZero() || r.CommitAt.Before(r.GiveAt) {
+		t.Fatal("bad record of nonce 5", r)
+	}
+	if r = records[2]; r.Nonce != 6 || r.Success || r.CommitAt.IsZero() {
+		t.Fatal("bad record of nonce 6", r)
+	}
+	if records, _ = mgr.NonceHistory(context.Background(), common.HexToAddress("0x02"), since); len(records) != 0 {
+		t.Fatal("other address should have no history, got", records)
+	}
+}
+
+func testChainKeying(t *testing.T, creator ethnonce.ManagerCreator, chain *FakeChain) {
+	// client alone keeps keys by address only
+	mgr := creator.Build()
+	syncAt(t, mgr, chain, 5)
+	mustGive(t, mgr, 5)
+	if err := mgr.CommitNonce(testAddr, 5, true); err != nil {
+		t.Fatal(err)
+	}
+	id, err := ethnonce.DiscoverChainID(context.Background(), chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mgr = creator.SetChainID(id).Build()
+	defer mgr.Close()
+	if _, err := mgr.GiveNonce(testAddr); err != ethnonce.ErrNotInitAddress {
+		t.Fatal("legacy nonce should not be seen before migration, got", err)
+	}
+	if moved, err := mgr.MigrateLegacyNonces(context.Background()); err != nil || moved != 1 {
+		t.Fatal("bad migration", moved, err)
+	}
+	mustPeek(t, mgr, 6)
+	mustGive(t, mgr, 6)
+}
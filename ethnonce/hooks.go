@@ -0,0 +1,142 @@
+package ethnonce
+
+import (
+	"context"
+	"github.com/ethereum/go-ethereum/common"
+	"sync"
+	"time"
+)
+
+// Hooks observes nonce management of any backend, called synchronously on
+// the caller's goroutine so keep them fast. ctx is the caller's, tracing
+// spans can be taken from it.
+type Hooks interface {
+	// a give finished, wait counts retries while others held the nonce
+	OnGive(ctx context.Context, addr common.Address, nonce uint64, wait time.Duration, err error)
+	// others held the nonce when addr asked for one
+	OnContention(ctx context.Context, addr common.Address)
+	// holder of nonce came back to commit or renew after its lease ran out
+	OnLeaseExpired(ctx context.Context, addr common.Address, nonce uint64, held time.Duration)
+	// stored is the nonce would be given before sync, chain the pending nonce synced to
+	OnSync(ctx context.Context, addr common.Address, stored, chain uint64, err error)
+}
+
+// NopHooks does nothing, embed it to implement part of Hooks
+type NopHooks struct{}
+
+func (NopHooks) OnGive(context.Context, common.Address, uint64, time.Duration, error)  {}
+func (NopHooks) OnContention(context.Context, common.Address)                          {}
+func (NopHooks) OnLeaseExpired(context.Context, common.Address, uint64, time.Duration) {}
+func (NopHooks) OnSync(context.Context, common.Address, uint64, uint64, error)         {}
+
+// LeaseReader tells lease of addr, backends implement it so lease expiry
+// can be reported, DefaultLease assumed otherwise
+type LeaseReader interface {
+	LeaseOf(addr common.Address) time.Duration
+}
+
+type holdKey struct {
+	addr  common.Address
+	nonce uint64
+}
+
+// instrument keeps what hooks need to know, nil when no hooks set
+type instrument struct {
+	hooks Hooks
+	// nonces given by this manager => give or renew time
+	holds map[holdKey]time.Time
+	*sync.Mutex
+}
+
+// SetHooks observes the manager with hooks, nil stops observing
+func (n *NonceManager) SetHooks(hooks Hooks) *NonceManager {
+	if hooks == nil {
+		n.instr = nil
+		return n
+	}
+	n.instr = &instrument{
+		hooks: hooks,
+		holds: make(map[holdKey]time.Time),
+		Mutex: new(sync.Mutex),
+	}
+	return n
+}
+
+func (n *NonceManager) leaseOf(addr common.Address) time.Duration {
+	if r, ok := n.Impl.(LeaseReader); ok {
+		return r.LeaseOf(addr)
+	}
+	return DefaultLease
+}
+
+func (n *NonceManager) observeGive(ctx context.Context, addr common.Address, nonce uint64, start time.Time, err error) {
+	if n.instr == nil {
+		return
+	}
+	if err == nil {
+		now := time.Now()
+		lease := n.leaseOf(addr)
+		n.instr.Lock()
+		// nonces of addr out of lease went back to the store, never committed
+		for key, since := range n.instr.holds {
+			if key.addr == addr && now.Sub(since) > lease {
+				delete(n.instr.holds, key)
+			}
+		}
+		n.instr.holds[holdKey{addr, nonce}] = now
+		n.instr.Unlock()
+	}
+	n.instr.hooks.OnGive(ctx, addr, nonce, time.Since(start), err)
+}
+
+func (n *NonceManager) observeContention(ctx context.Context, addr common.Address) {
+	if n.instr != nil {
+		n.instr.hooks.OnContention(ctx, addr)
+	}
+}
+
+// observeRelease reports nonce held longer than lease, the hold is dropped
+// on commit and kept on renew
+func (n *NonceManager) observeRelease(ctx context.Context, addr common.Address, nonce uint64, renew bool, err error) {
+	if n.instr == nil {
+		return
+	}
+	key := holdKey{addr, nonce}
+	now := time.Now()
+	n.instr.Lock()
+	since, ok := n.instr.holds[key]
+	if renew && err == nil {
+		n.instr.holds[key] = now
+	} else {
+		delete(n.instr.holds, key)
+	}
+	n.instr.Unlock()
+	if err == ErrLeaseLost || (ok && now.Sub(since) > n.leaseOf(addr)) {
+		var held time.Duration
+		if ok {
+			held = now.Sub(since)
+		}
+		n.instr.hooks.OnLeaseExpired(ctx, addr, nonce, held)
+	}
+}
+
+// observeSync peeks before sync, so the store is asked only when observed.
+// Sync drops every hold of addr, so do the holds kept here
+func (n *NonceManager) observeSync(ctx context.Context, addr common.Address) func(uint64, error) {
+	if n.instr == nil {
+		return func(uint64, error) {}
+	}
+	stored := WithContext(n.Impl).PeekNonceContext(ctx, addr)
+	return func(chain uint64, err error) {
+		if err == nil {
+			n.instr.Lock()
+			for key := range n.instr.holds {
+				if key.addr == addr {
+					delete(n.instr.holds, key)
+				}
+			}
+			n.instr.Unlock()
+		}
+		n.instr.hooks.OnSync(ctx, addr, stored, chain, err)
+	}
+}
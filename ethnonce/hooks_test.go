@@ -0,0 +1,107 @@
+package ethnonce
+
+import (
+	"context"
+	"github.com/ethereum/go-ethereum/common"
+	"testing"
+	"time"
+)
+
+type recordHooks struct {
+	NopHooks
+	gives, contentions, expired int
+	wait                        time.Duration
+	stored, chain               uint64
+}
+
+func (h *recordHooks) OnGive(ctx context.Context, addr common.Address, nonce uint64, wait time.Duration, err error) {
+	h.gives++
+	h.wait = wait
+}
+
+func (h *recordHooks) OnContention(context.Context, common.Address) { h.contentions++ }
+
+func (h *recordHooks) OnLeaseExpired(context.Context, common.Address, uint64, time.Duration) {
+	h.expired++
+}
+
+func (h *recordHooks) OnSync(ctx context.Context, addr common.Address, stored, chain uint64, err error) {
+	h.stored, h.chain = stored, chain
+}
+
+// shortLease makes every hold expired at once
+type shortLease struct{ *stateManager }
+
+func (shortLease) LeaseOf(common.Address) time.Duration { return 0 }
+
+func TestHooksWait(t *testing.T) {
+	hooks := new(recordHooks)
+	mgr := (&NonceManager{Impl: &busyManager{free: 3}}).SetHooks(hooks)
+	if _, err := mgr.WaitNonce(context.Background(), common.Address{}); err != nil {
+		t.Fatal(err)
+	}
+	if hooks.gives != 1 || hooks.contentions != 2 || hooks.wait < minWaitBackoff {
+		t.Fatal("should report one give after 2 contentions", hooks)
+	}
+}
+
+func TestHooksLeaseAndSync(t *testing.T) {
+	hooks := new(recordHooks)
+	impl := &stateManager{state: NewAddressState(5), chain: &fakeChainState{pending: 8}}
+	mgr := (&NonceManager{Impl: shortLease{impl}}).SetHooks(hooks)
+	nonce, _ := mgr.GiveNonce(common.Address{})
+	time.Sleep(time.Millisecond)
+	mgr.CommitNonce(common.Address{}, nonce, true)
+	if hooks.expired != 1 {
+		t.Fatal("commit after lease should be reported")
+	}
+	if _, err := mgr.SyncNonce(common.Address{}); err != nil {
+		t.Fatal(err)
+	}
+	if hooks.stored != 6 || hooks.chain != 8 {
+		t.Fatal("should report sync drift", hooks.stored, hooks.chain)
+	}
+	mgr.SetHooks(nil).GiveNonce(common.Address{})
+	if hooks.gives != 1 {
+		t.Fatal("should stop observing")
+	}
+}
+
+func TestHooksCommitLeaseLost(t *testing.T) {
+	hooks := new(recordHooks)
+	impl := &stateManager{state: NewAddressState(5), chain: &fakeChainState{pending: 5}}
+	mgr := (&NonceManager{Impl: impl}).SetHooks(hooks)
+	res, _ := mgr.GiveNonceContext(context.Background(), common.Address{})
+	// others took the nonce over
+	impl.state.Commit(Reservation{Nonce: res.Nonce}, false)
+	if err := mgr.CommitNonceContext(context.Background(), common.Address{}, res, true); err != ErrLeaseLost {
+		t.Fatal("should lose lease, got", err)
+	}
+	if hooks.expired != 1 || len(mgr.instr.holds) != 0 {
+		t.Fatal("lost commit should be reported and dropped", hooks.expired, len(mgr.instr.holds))
+	}
+}
+
+func TestHooksPruneHolds(t *testing.T) {
+	hooks := new(recordHooks)
+	impl := &stateManager{state: NewAddressState(5), chain: &fakeChainState{pending: 8}}
+	mgr := (&NonceManager{Impl: impl}).SetHooks(hooks)
+	// given and never committed, lease ran out
+	mgr.GiveNonce(common.Address{})
+	impl.state.Holds[5] = 0
+	if _, err := mgr.SyncNonce(common.Address{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(mgr.instr.holds) != 0 {
+		t.Fatal("sync should drop holds", len(mgr.instr.holds))
+	}
+	mgr = (&NonceManager{Impl: shortLease{impl}}).SetHooks(hooks)
+	mgr.GiveNonce(common.Address{})
+	// committed by another manager sharing the store
+	impl.state.Commit(Reservation{Nonce: 8}, true)
+	time.Sleep(time.Millisecond)
+	mgr.GiveNonce(common.Address{})
+	if _, ok := mgr.instr.holds[holdKey{common.Address{}, 8}]; ok || len(mgr.instr.holds) != 1 {
+		t.Fatal("holds out of lease should be dropped", mgr.instr.holds)
+	}
+}
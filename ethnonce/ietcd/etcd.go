@@ -0,0 +1,461 @@
+package ietcd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/qjpcpu/ethereum/ethnonce"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// state of an address lives in key prefix/addr/nonce, every reserved nonce
+// has key prefix/addr/hold/nonce bound to an etcd lease, so holds of crashed
+// processes disappear by themselves
+type etcdManager struct {
+	Prefix  string
+	ethConn ethnonce.ChainNonceSource
+	cli     *clientv3.Client
+	opts    ethnonce.Options
+	// tell apart audit entries in the same nanosecond
+	auditSeq uint64
+	*sync.Mutex
+}
+
+type EtcdManagerCreator struct {
+	mgr *etcdManager
+}
+
+// hold is a reserved nonce and its etcd key
+type hold struct {
+	lease       clientv3.LeaseID
+	modRevision int64
+	stamp       int64
+}
+
+type addressSnapshot struct {
+	state *ethnonce.AddressState
+	// 0 means state key not exist
+	modRevision int64
+	holds       map[uint64]hold
+}
+
+func (rc *EtcdManagerCreator) SetEthClient(conn ethnonce.ChainNonceSource) ethnonce.ManagerCreator {
+	rc.mgr.ethConn = conn
+	return rc
+}
+
+func (rc *EtcdManagerCreator) SetChainID(id *big.Int) ethnonce.ManagerCreator {
+	rc.mgr.opts.SetChainID(id)
+	return rc
+}
+
+func (rc *EtcdManagerCreator) SetPipeline(depth int) ethnonce.ManagerCreator {
+	rc.mgr.opts.SetDepth(depth)
+	return rc
+}
+
+func (rc *EtcdManagerCreator) SetLease(lease time.Duration, addrs ...common.Address) ethnonce.ManagerCreator {
+	rc.mgr.opts.SetLease(lease, addrs...)
+	return rc
+}
+
+func (rc *EtcdManagerCreator) Build() *ethnonce.NonceManager {
+	return &ethnonce.NonceManager{
+		Impl: rc.mgr,
+	}
+}
+
+func PrepareEtcdManager(endpoints []string, prefix string) (ethnonce.ManagerCreator, error) {
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: 2 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return PrepareEtcdClientManager(prefix, cli), nil
+}
+
+func PrepareEtcdClientManager(prefix string, cli *clientv3.Client) ethnonce.ManagerCreator {
+	return &EtcdManagerCreator{
+		mgr: &etcdManager{
+			Prefix: strings.TrimSuffix(prefix, "/"),
+			cli:    cli,
+			opts:   ethnonce.NewOptions(),
+			Mutex:  new(sync.Mutex),
+		},
+	}
+}
+
+// address is the key made by Options.AddressKey
+func (n *etcdManager) addressKey(address string) string {
+	return n.Prefix + "/" + address
+}
+
+func (n *etcdManager) stateKey(address string) string {
+	return n.addressKey(address) + "/nonce"
+}
+
+func (n *etcdManager) holdPrefix(address string) string {
+	return n.addressKey(address) + "/hold/"
+}
+
+func (n *etcdManager) holdKey(address string, nonce uint64) string {
+	return n.holdPrefix(address) + strconv.FormatUint(nonce, 10)
+}
+
+func (n *etcdManager) auditPrefix(address string) string {
+	return n.addressKey(address) + "/audit/"
+}
+
+// keys sort by time, so entries since a moment are found by range
+func (n *etcdManager) auditKey(address string, timestamp int64, seq uint64) string {
+	return fmt.Sprintf("%s%020d_%020d", n.auditPrefix(address), timestamp, seq)
+}
+
+func (n *etcdManager) load(ctx context.Context, address string) (*addressSnapshot, error) {
+	resp, err := n.cli.Txn(ctx).Then(
+		clientv3.OpGet(n.stateKey(address)),
+		clientv3.OpGet(n.holdPrefix(address), clientv3.WithPrefix()),
+	).Commit()
+	if err != nil {
+		return nil, err
+	}
+	snap := &addressSnapshot{holds: make(map[uint64]hold)}
+	if kvs := resp.Responses[0].GetResponseRange().Kvs; len(kvs) > 0 {
+		snap.state = ethnonce.NewAddressState(0)
+		if err = json.Unmarshal(kvs[0].Value, snap.state); err != nil {
+			return nil, err
+		}
+		snap.modRevision = kvs[0].ModRevision
+	}
+	for _, kv := range resp.Responses[1].GetResponseRange().Kvs {
+		nonce, err := strconv.ParseUint(strings.TrimPrefix(string(kv.Key), n.holdPrefix(address)), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		stamp, _ := strconv.ParseInt(string(kv.Value), 10, 64)
+		snap.holds[nonce] = hold{lease: clientv3.LeaseID(kv.Lease), modRevision: kv.ModRevision, stamp: stamp}
+	}
+	if snap.state == nil {
+		return snap, nil
+	}
+	if snap.state.Holds == nil {
+		snap.state.Holds = make(map[uint64]int64)
+	}
+	// hold keys tell the truth, a hold without key is taken as expired
+	for nonce := range snap.state.Holds {
+		snap.state.Holds[nonce] = snap.holds[nonce].stamp
+	}
+	return snap, nil
+}
+
+// update applies fn on address state and saves it with ops, retries when
+// others changed the state meanwhile
+func (n *etcdManager) update(ctx context.Context, address string, fn func(*addressSnapshot) ([]clientv3.Op, error)) error {
+	for {
+		snap, err := n.load(ctx, address)
+		if err != nil {
+			return err
+		}
+		if snap.state == nil {
+			return ethnonce.ErrNotInitAddress
+		}
+		ops, err := fn(snap)
+		if err != nil {
+			return err
+		}
+		ok, err := n.save(ctx, address, snap, ops...)
+		if err != nil || ok {
+			return err
+		}
+	}
+}
+
+func (n *etcdManager) save(ctx context.Context, address string, snap *addressSnapshot, ops ...clientv3.Op) (bool, error) {
+	data, err := json.Marshal(snap.state)
+	if err != nil {
+		return false, err
+	}
+	ops = append(ops, clientv3.OpPut(n.stateKey(address), string(data)))
+	resp, err := n.cli.Txn(ctx).If(
+		clientv3.Compare(clientv3.ModRevision(n.stateKey(address)), "=", snap.modRevision),
+	).Then(ops...).Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+func (n *etcdManager) PeekNonce(addr common.Address) uint64 {
+	return n.PeekNonceContext(context.Background(), addr)
+}
+
+func (n *etcdManager) PeekNonceContext(ctx context.Context, addr common.Address) uint64 {
+	address, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return 0
+	}
+	snap, err := n.load(ctx, address)
+	if err != nil || snap.state == nil {
+		return 0
+	}
+	return snap.state.Peek()
+}
+
+// StoredNonce is the next nonce never given out
+func (n *etcdManager) StoredNonce(ctx context.Context, addr common.Address) (uint64, error) {
+	address, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+	snap, err := n.load(ctx, address)
+	if err != nil {
+		return 0, err
+	}
+	if snap.state == nil {
+		return 0, ethnonce.ErrNotInitAddress
+	}
+	return snap.state.Nonce, nil
+}
+
+func (n *etcdManager) GiveNonce(addr common.Address) (uint64, error) {
+	res, err := n.GiveNonceContext(context.Background(), addr)
+	return res.Nonce, err
+}
+
+func (n *etcdManager) GiveNonceContext(ctx context.Context, addr common.Address) (ethnonce.Reservation, error) {
+	address, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return ethnonce.Reservation{}, err
+	}
+	var res ethnonce.Reservation
+	var granted clientv3.LeaseID
+	err = n.update(ctx, address, func(snap *addressSnapshot) ([]clientv3.Op, error) {
+		now := time.Now().Unix()
+		var err error
+		if res, err = snap.state.Give(now, n.opts.Depth, n.opts.LeaseOf(addr)); err != nil {
+			return nil, err
+		}
+		if granted == 0 {
+			resp, err := n.cli.Grant(ctx, n.opts.LeaseSeconds(addr))
+			if err != nil {
+				return nil, err
+			}
+			granted = resp.ID
+		}
+		return []clientv3.Op{
+			clientv3.OpPut(n.holdKey(address, res.Nonce), strconv.FormatInt(now, 10), clientv3.WithLease(granted)),
+		}, nil
+	})
+	if err != nil && granted != 0 {
+		n.cli.Revoke(context.Background(), granted)
+	}
+	return res, err
+}
+
+func (n *etcdManager) SyncNonce(addr common.Address) (uint64, error) {
+	return n.SyncNonceContext(context.Background(), addr)
+}
+
+func (n *etcdManager) SyncNonceContext(ctx context.Context, addr common.Address) (uint64, error) {
+	address, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		snap, err := n.load(ctx, address)
+		if err != nil {
+			return 0, err
+		}
+		if snap.state == nil {
+			snap.state = ethnonce.NewAddressState(0)
+		}
+		if snap.state.LiveHolds(time.Now().Unix(), n.opts.LeaseOf(addr)) > 0 {
+			return 0, ethnonce.ErrOtherHoldNonce
+		}
+		if n.ethConn == nil {
+			return 0, ethnonce.ErrNoChainSource
+		}
+		nonce, err := n.ethConn.PendingNonceAt(ctx, addr)
+		if err != nil {
+			return 0, err
+		}
+		if err = snap.state.Sync(nonce, time.Now().Unix(), n.opts.LeaseOf(addr)); err != nil {
+			return 0, err
+		}
+		ok, err := n.save(ctx, address, snap, clientv3.OpDelete(n.holdPrefix(address), clientv3.WithPrefix()))
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return nonce, nil
+		}
+	}
+}
+
+func (n *etcdManager) CommitNonce(addr common.Address, nonce_number uint64, success bool) error {
+	return n.CommitNonceContext(context.Background(), addr, ethnonce.Reservation{Nonce: nonce_number}, success)
+}
+
+func (n *etcdManager) CommitNonceContext(ctx context.Context, addr common.Address, res ethnonce.Reservation, success bool) error {
+	address, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return err
+	}
+	var lease clientv3.LeaseID
+	err = n.update(ctx, address, func(snap *addressSnapshot) ([]clientv3.Op, error) {
+		lease = snap.holds[res.Nonce].lease
+		if err := snap.state.Commit(res, success); err != nil {
+			return nil, err
+		}
+		return []clientv3.Op{clientv3.OpDelete(n.holdKey(address, res.Nonce))}, nil
+	})
+	if err == nil && lease != 0 {
+		n.cli.Revoke(ctx, lease)
+	}
+	return err
+}
+
+func (n *etcdManager) RenewNonce(addr common.Address, nonce_number uint64) error {
+	return n.RenewNonceContext(context.Background(), addr, ethnonce.Reservation{Nonce: nonce_number})
+}
+
+func (n *etcdManager) RenewNonceContext(ctx context.Context, addr common.Address, res ethnonce.Reservation) error {
+	address, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return err
+	}
+	snap, err := n.load(ctx, address)
+	if err != nil {
+		return err
+	}
+	if snap.state == nil {
+		return ethnonce.ErrNotInitAddress
+	}
+	h, ok := snap.holds[res.Nonce]
+	if !ok || !snap.state.Held(res) {
+		return ethnonce.ErrLeaseLost
+	}
+	if _, err = n.cli.KeepAliveOnce(ctx, h.lease); err != nil {
+		if err == rpctypes.ErrLeaseNotFound {
+			return ethnonce.ErrLeaseLost
+		}
+		return err
+	}
+	key := n.holdKey(address, res.Nonce)
+	resp, err := n.cli.Txn(ctx).If(
+		clientv3.Compare(clientv3.ModRevision(key), "=", h.modRevision),
+	).Then(
+		clientv3.OpPut(key, strconv.FormatInt(time.Now().Unix(), 10), clientv3.WithLease(h.lease)),
+	).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		// committed or given to others meanwhile
+		return ethnonce.ErrLeaseLost
+	}
+	return nil
+}
+
+func (n *etcdManager) AppendAudit(ctx context.Context, entry ethnonce.AuditEntry) error {
+	address, err := n.opts.AddressKey(ctx, entry.Address)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	n.Lock()
+	n.auditSeq++
+	key := n.auditKey(address, entry.Timestamp, n.auditSeq)
+	n.Unlock()
+	_, err = n.cli.Put(ctx, key, string(data))
+	return err
+}
+
+func (n *etcdManager) AuditEntries(ctx context.Context, addr common.Address, since int64) ([]ethnonce.AuditEntry, error) {
+	address, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if since < 0 {
+		since = 0
+	}
+	resp, err := n.cli.Get(ctx, n.auditKey(address, since, 0), clientv3.WithRange(clientv3.GetPrefixRangeEnd(n.auditPrefix(address))))
+	if err != nil {
+		return nil, err
+	}
+	var entries []ethnonce.AuditEntry
+	for _, kv := range resp.Kvs {
+		var entry ethnonce.AuditEntry
+		if err = json.Unmarshal(kv.Value, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// MigrateLegacy moves keys of address only to chain of manager, holds keep
+// their leases
+func (n *etcdManager) MigrateLegacy(ctx context.Context) (int, error) {
+	id, err := n.opts.ChainID(ctx)
+	if err != nil || id == 0 {
+		return 0, err
+	}
+	resp, err := n.cli.Get(ctx, n.Prefix+"/0x", clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+	// legacy address => its keys
+	legacy := make(map[string][]*mvccpb.KeyValue)
+	for _, kv := range resp.Kvs {
+		rest := strings.TrimPrefix(string(kv.Key), n.Prefix+"/")
+		if i := strings.Index(rest, "/"); i > 0 {
+			legacy[rest[:i]] = append(legacy[rest[:i]], kv)
+		}
+	}
+	var moved int
+	for address, kvs := range legacy {
+		target := ethnonce.ChainAddressKey(id, common.HexToAddress(address))
+		ops := []clientv3.Op{clientv3.OpDelete(n.addressKey(address)+"/", clientv3.WithPrefix())}
+		for _, kv := range kvs {
+			key := n.addressKey(target) + strings.TrimPrefix(string(kv.Key), n.addressKey(address))
+			if kv.Lease != 0 {
+				ops = append(ops, clientv3.OpPut(key, string(kv.Value), clientv3.WithLease(clientv3.LeaseID(kv.Lease))))
+			} else {
+				ops = append(ops, clientv3.OpPut(key, string(kv.Value)))
+			}
+		}
+		// leave it alone when target kept already
+		txn, err := n.cli.Txn(ctx).If(
+			clientv3.Compare(clientv3.CreateRevision(n.stateKey(target)), "=", 0),
+		).Then(ops...).Commit()
+		if err != nil {
+			return moved, err
+		}
+		if txn.Succeeded {
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+func (n *etcdManager) LeaseOf(addr common.Address) time.Duration {
+	return n.opts.LeaseOf(addr)
+}
+
+func (n *etcdManager) Close() error {
+	return n.cli.Close()
+}
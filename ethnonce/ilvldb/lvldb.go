@@ -2,21 +2,25 @@ package ilvldb
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/qjpcpu/ethereum/ethnonce"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"math/big"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 )
 
 type lvldbManager struct {
 	filePath string
-	ethConn  *ethclient.Client
+	ethConn  ethnonce.ChainNonceSource
 	db       *leveldb.DB
+	opts     ethnonce.Options
+	// tell apart audit entries in the same nanosecond
+	auditSeq uint64
 	*sync.Mutex
 }
 
@@ -24,11 +28,26 @@ type LvldbManagerCreator struct {
 	mgr *lvldbManager
 }
 
-func (rc *LvldbManagerCreator) SetEthClient(conn *ethclient.Client) ethnonce.ManagerCreator {
+func (rc *LvldbManagerCreator) SetEthClient(conn ethnonce.ChainNonceSource) ethnonce.ManagerCreator {
 	rc.mgr.ethConn = conn
 	return rc
 }
 
+func (rc *LvldbManagerCreator) SetChainID(id *big.Int) ethnonce.ManagerCreator {
+	rc.mgr.opts.SetChainID(id)
+	return rc
+}
+
+func (rc *LvldbManagerCreator) SetPipeline(depth int) ethnonce.ManagerCreator {
+	rc.mgr.opts.SetDepth(depth)
+	return rc
+}
+
+func (rc *LvldbManagerCreator) SetLease(lease time.Duration, addrs ...common.Address) ethnonce.ManagerCreator {
+	rc.mgr.opts.SetLease(lease, addrs...)
+	return rc
+}
+
 func (rc *LvldbManagerCreator) Build() *ethnonce.NonceManager {
 	return &ethnonce.NonceManager{
 		Impl: rc.mgr,
@@ -44,90 +63,269 @@ func PrepareLvldbManager(file_path string) ethnonce.ManagerCreator {
 		mgr: &lvldbManager{
 			filePath: file_path,
 			db:       db,
+			opts:     ethnonce.NewOptions(),
 			Mutex:    new(sync.Mutex),
 		},
 	}
 }
 
 func (n *lvldbManager) PeekNonce(addr common.Address) uint64 {
-	num, _ := resToNumber(n.db.Get([]byte(addressField(addr)), nil))
-	return num
+	return n.PeekNonceContext(context.Background(), addr)
 }
 
-func (n *lvldbManager) GiveNonce(addr common.Address) (uint64, error) {
+func (n *lvldbManager) PeekNonceContext(ctx context.Context, addr common.Address) uint64 {
+	key, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return 0
+	}
 	n.Lock()
 	defer n.Unlock()
-	nonce, err := resToNumber(n.db.Get([]byte(addressField(addr)), nil))
+	state, _ := n.loadState(key)
+	if state == nil {
+		return 0
+	}
+	return state.Peek()
+}
+
+// StoredNonce is the next nonce never given out
+func (n *lvldbManager) StoredNonce(ctx context.Context, addr common.Address) (uint64, error) {
+	key, err := n.opts.AddressKey(ctx, addr)
 	if err != nil {
-		if err == leveldb.ErrNotFound {
-			return 0, ethnonce.ErrNotInitAddress
-		}
-		return 0, ethnonce.ErrOtherHoldNonce
+		return 0, err
 	}
-	cmt, _ := resToNumber(n.db.Get([]byte(addressCommitField(addr)), nil))
-	if cmt == 0 {
-		batch := new(leveldb.Batch)
-		batch.Put([]byte(addressCommitField(addr)), numberToString(1))
-		batch.Put([]byte(addressTimestampField(addr)), numberToString(uint64(time.Now().Unix())))
-		n.db.Write(batch, nil)
-		return nonce, nil
+	nonce, err := resToNumber(n.db.Get([]byte(key), nil))
+	if err == leveldb.ErrNotFound {
+		return 0, ethnonce.ErrNotInitAddress
 	}
-	last, _ := resToNumber(n.db.Get([]byte(addressTimestampField(addr)), nil))
-	if time.Unix(int64(last), 0).Add(time.Second * 60).After(time.Now()) {
-		return 0, ethnonce.ErrOtherHoldNonce
+	return nonce, err
+}
+
+func (n *lvldbManager) GiveNonce(addr common.Address) (uint64, error) {
+	res, err := n.GiveNonceContext(context.Background(), addr)
+	return res.Nonce, err
+}
+
+func (n *lvldbManager) GiveNonceContext(ctx context.Context, addr common.Address) (ethnonce.Reservation, error) {
+	if err := ctx.Err(); err != nil {
+		return ethnonce.Reservation{}, err
 	}
-	n.db.Put([]byte(addressTimestampField(addr)), numberToString(uint64(time.Now().Unix())), nil)
-	return nonce, nil
+	key, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return ethnonce.Reservation{}, err
+	}
+	n.Lock()
+	defer n.Unlock()
+	state, err := n.loadState(key)
+	if err != nil {
+		return ethnonce.Reservation{}, err
+	}
+	res, err := state.Give(time.Now().Unix(), n.opts.Depth, n.opts.LeaseOf(addr))
+	if err != nil {
+		return ethnonce.Reservation{}, err
+	}
+	return res, n.saveState(key, state)
 }
 
 func (n *lvldbManager) SyncNonce(addr common.Address) (uint64, error) {
+	return n.SyncNonceContext(context.Background(), addr)
+}
+
+func (n *lvldbManager) SyncNonceContext(ctx context.Context, addr common.Address) (uint64, error) {
+	key, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
 	n.Lock()
 	defer n.Unlock()
-	cmt, err1 := resToNumber(n.db.Get([]byte(addressCommitField(addr)), nil))
-	last, err2 := resToNumber(n.db.Get([]byte(addressTimestampField(addr)), nil))
-	if err1 == nil && err2 == nil && cmt != 0 && time.Unix(int64(last), 0).Add(time.Second*60).After(time.Now()) {
+	state, err := n.loadState(key)
+	if err == ethnonce.ErrNotInitAddress {
+		state = ethnonce.NewAddressState(0)
+	} else if err != nil {
+		return 0, err
+	}
+	if state.LiveHolds(time.Now().Unix(), n.opts.LeaseOf(addr)) > 0 {
 		return 0, ethnonce.ErrOtherHoldNonce
 	}
-	nonce, err := n.ethConn.PendingNonceAt(context.Background(), addr)
+	if n.ethConn == nil {
+		return 0, ethnonce.ErrNoChainSource
+	}
+	nonce, err := n.ethConn.PendingNonceAt(ctx, addr)
 	if err != nil {
 		return 0, err
 	}
+	if err = state.Sync(nonce, time.Now().Unix(), n.opts.LeaseOf(addr)); err != nil {
+		return 0, err
+	}
+	return nonce, n.saveState(key, state)
+}
 
-	batch := new(leveldb.Batch)
-	batch.Put([]byte(addressField(addr)), numberToString(nonce))
-	batch.Put([]byte(addressCommitField(addr)), numberToString(0))
-	batch.Put([]byte(addressTimestampField(addr)), numberToString(0))
-	n.db.Write(batch, nil)
+func (n *lvldbManager) CommitNonce(addr common.Address, nonce_number uint64, success bool) error {
+	return n.CommitNonceContext(context.Background(), addr, ethnonce.Reservation{Nonce: nonce_number}, success)
+}
 
-	return nonce, err
+func (n *lvldbManager) CommitNonceContext(ctx context.Context, addr common.Address, res ethnonce.Reservation, success bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	key, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return err
+	}
+	n.Lock()
+	defer n.Unlock()
+	state, err := n.loadState(key)
+	if err != nil {
+		return err
+	}
+	if err = state.Commit(res, success); err != nil {
+		return err
+	}
+	return n.saveState(key, state)
 }
 
-func (n *lvldbManager) CommitNonce(addr common.Address, nonce_number uint64, success bool) error {
+func (n *lvldbManager) RenewNonce(addr common.Address, nonce_number uint64) error {
+	return n.RenewNonceContext(context.Background(), addr, ethnonce.Reservation{Nonce: nonce_number})
+}
+
+func (n *lvldbManager) RenewNonceContext(ctx context.Context, addr common.Address, res ethnonce.Reservation) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	key, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return err
+	}
 	n.Lock()
 	defer n.Unlock()
-	dbnonce, err := resToNumber(n.db.Get([]byte(addressField(addr)), nil))
+	state, err := n.loadState(key)
+	if err != nil {
+		return err
+	}
+	if err = state.Renew(res, time.Now().Unix()); err != nil {
+		return err
+	}
+	return n.saveState(key, state)
+}
+
+func (n *lvldbManager) loadState(key string) (*ethnonce.AddressState, error) {
+	nonce, err := resToNumber(n.db.Get([]byte(key), nil))
 	if err != nil {
 		if err == leveldb.ErrNotFound {
-			return ethnonce.ErrNotInitAddress
+			return nil, ethnonce.ErrNotInitAddress
 		}
-		return err
+		return nil, err
 	}
-	cmt, _ := resToNumber(n.db.Get([]byte(addressCommitField(addr)), nil))
-	if cmt == 0 {
-		return nil
+	state := ethnonce.NewAddressState(nonce)
+	data, err := n.db.Get([]byte(reserveField(key)), nil)
+	if err == leveldb.ErrNotFound {
+		return state, nil
+	} else if err != nil {
+		return nil, err
 	}
-	if dbnonce != nonce_number {
-		return ethnonce.ErrOtherHoldNonce
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, err
 	}
-	batch := new(leveldb.Batch)
-	if success {
-		batch.Put([]byte(addressField(addr)), numberToString(nonce_number+1))
+	state.Nonce = nonce
+	return state, nil
+}
+
+func (n *lvldbManager) saveState(key string, state *ethnonce.AddressState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
 	}
-	batch.Put([]byte(addressCommitField(addr)), numberToString(0))
-	batch.Put([]byte(addressTimestampField(addr)), numberToString(uint64(time.Now().Unix())))
+	batch := new(leveldb.Batch)
+	batch.Put([]byte(key), numberToString(state.Nonce))
+	batch.Put([]byte(reserveField(key)), data)
 	return n.db.Write(batch, nil)
 }
 
+func (n *lvldbManager) AppendAudit(ctx context.Context, entry ethnonce.AuditEntry) error {
+	key, err := n.opts.AddressKey(ctx, entry.Address)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	n.Lock()
+	n.auditSeq++
+	seq := n.auditSeq
+	n.Unlock()
+	return n.db.Put([]byte(auditKey(key, entry.Timestamp, seq)), data, nil)
+}
+
+func (n *lvldbManager) AuditEntries(ctx context.Context, addr common.Address, since int64) ([]ethnonce.AuditEntry, error) {
+	key, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	var entries []ethnonce.AuditEntry
+	iter := n.db.NewIterator(util.BytesPrefix([]byte(auditPrefix(key))), nil)
+	defer iter.Release()
+	if since < 0 {
+		since = 0
+	}
+	for ok := iter.Seek([]byte(auditKey(key, since, 0))); ok; ok = iter.Next() {
+		var entry ethnonce.AuditEntry
+		if err := json.Unmarshal(iter.Value(), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, iter.Error()
+}
+
+// MigrateLegacy moves keys of address only to chain of manager
+func (n *lvldbManager) MigrateLegacy(ctx context.Context) (int, error) {
+	id, err := n.opts.ChainID(ctx)
+	if err != nil || id == 0 {
+		return 0, err
+	}
+	n.Lock()
+	defer n.Unlock()
+	var legacy []string
+	iter := n.db.NewIterator(util.BytesPrefix([]byte("0x")), nil)
+	for iter.Next() {
+		if key := string(iter.Key()); len(key) == len(common.Address{}.Hex()) {
+			legacy = append(legacy, key)
+		}
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		return 0, err
+	}
+	var moved int
+	for _, key := range legacy {
+		target := ethnonce.ChainAddressKey(id, common.HexToAddress(key))
+		if ok, err := n.db.Has([]byte(target), nil); err != nil {
+			return moved, err
+		} else if ok {
+			continue
+		}
+		batch := new(leveldb.Batch)
+		iter := n.db.NewIterator(util.BytesPrefix([]byte(key)), nil)
+		for iter.Next() {
+			batch.Put([]byte(target+string(iter.Key()[len(key):])), append([]byte(nil), iter.Value()...))
+			batch.Delete(append([]byte(nil), iter.Key()...))
+		}
+		iter.Release()
+		if err = iter.Error(); err != nil {
+			return moved, err
+		}
+		if err = n.db.Write(batch, nil); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+func (n *lvldbManager) LeaseOf(addr common.Address) time.Duration {
+	return n.opts.LeaseOf(addr)
+}
+
 func (n *lvldbManager) Close() error {
 	return n.db.Close()
 }
@@ -143,14 +341,17 @@ func numberToString(num uint64) []byte {
 	return []byte(fmt.Sprint(num))
 }
 
-func addressField(addr common.Address) string {
-	return strings.ToLower(addr.Hex())
+// keys of an address: key for next nonce, key_rsv for reservations,
+// key_audit_* for audit trail
+func reserveField(key string) string {
+	return key + "_rsv"
 }
 
-func addressCommitField(addr common.Address) string {
-	return addressField(addr) + "_cmt"
+func auditPrefix(key string) string {
+	return key + "_audit_"
 }
 
-func addressTimestampField(addr common.Address) string {
-	return addressField(addr) + "_stp"
+// keys sort by time, so entries since a moment are found by seek
+func auditKey(key string, timestamp int64, seq uint64) string {
+	return fmt.Sprintf("%s%020d_%020d", auditPrefix(key), timestamp, seq)
 }
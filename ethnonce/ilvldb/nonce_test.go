@@ -6,6 +6,7 @@ import (
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/qjpcpu/ethereum/ethnonce"
+	"github.com/qjpcpu/ethereum/ethnonce/conformance"
 	"os"
 	"testing"
 )
@@ -78,3 +79,9 @@ func TestWrap(t *testing.T) {
 		t.Fatal("nonce should increased")
 	}
 }
+
+func TestConformance(t *testing.T) {
+	conformance.Run(t, func() (ethnonce.ManagerCreator, func()) {
+		return PrepareLvldbManager("./conformance"), func() { os.RemoveAll("./conformance") }
+	})
+}
@@ -0,0 +1,306 @@
+package imem
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/qjpcpu/ethereum/ethnonce"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+type memManager struct {
+	snapshotPath string
+	ethConn      ethnonce.ChainNonceSource
+	states       map[string]*ethnonce.AddressState
+	// audit trail is append only, not in snapshot
+	audits map[string][]ethnonce.AuditEntry
+	opts   ethnonce.Options
+	*sync.Mutex
+}
+
+type MemManagerCreator struct {
+	mgr *memManager
+}
+
+func (rc *MemManagerCreator) SetEthClient(conn ethnonce.ChainNonceSource) ethnonce.ManagerCreator {
+	rc.mgr.ethConn = conn
+	return rc
+}
+
+func (rc *MemManagerCreator) SetChainID(id *big.Int) ethnonce.ManagerCreator {
+	rc.mgr.opts.SetChainID(id)
+	return rc
+}
+
+func (rc *MemManagerCreator) SetPipeline(depth int) ethnonce.ManagerCreator {
+	rc.mgr.opts.SetDepth(depth)
+	return rc
+}
+
+func (rc *MemManagerCreator) SetLease(lease time.Duration, addrs ...common.Address) ethnonce.ManagerCreator {
+	rc.mgr.opts.SetLease(lease, addrs...)
+	return rc
+}
+
+// SetNonce initialize address without asking chain, handy for tests,
+// set chain id before it
+func (rc *MemManagerCreator) SetNonce(addr common.Address, nonce uint64) *MemManagerCreator {
+	id, _ := rc.mgr.opts.ChainID(context.Background())
+	rc.mgr.states[ethnonce.ChainAddressKey(id, addr)] = ethnonce.NewAddressState(nonce)
+	return rc
+}
+
+func (rc *MemManagerCreator) Build() *ethnonce.NonceManager {
+	return &ethnonce.NonceManager{
+		Impl: rc.mgr,
+	}
+}
+
+// PrepareMemManager keeps nonces in process memory only
+func PrepareMemManager() ethnonce.ManagerCreator {
+	return &MemManagerCreator{
+		mgr: &memManager{
+			states: make(map[string]*ethnonce.AddressState),
+			audits: make(map[string][]ethnonce.AuditEntry),
+			opts:   ethnonce.NewOptions(),
+			Mutex:  new(sync.Mutex),
+		},
+	}
+}
+
+// PrepareMemManagerWithSnapshot resumes nonces from file_path if exists,
+// and save them back on Close
+func PrepareMemManagerWithSnapshot(file_path string) (ethnonce.ManagerCreator, error) {
+	creator := PrepareMemManager().(*MemManagerCreator)
+	creator.mgr.snapshotPath = file_path
+	data, err := ioutil.ReadFile(file_path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return creator, nil
+		}
+		return nil, fmt.Errorf("read snapshot fail:%v", err)
+	}
+	if err = json.Unmarshal(data, &creator.mgr.states); err != nil {
+		return nil, fmt.Errorf("load snapshot %s fail:%v", file_path, err)
+	}
+	for _, state := range creator.mgr.states {
+		if state.Holds == nil {
+			state.Holds = make(map[uint64]int64)
+		}
+	}
+	return creator, nil
+}
+
+func (n *memManager) PeekNonce(addr common.Address) uint64 {
+	return n.PeekNonceContext(context.Background(), addr)
+}
+
+func (n *memManager) PeekNonceContext(ctx context.Context, addr common.Address) uint64 {
+	key, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return 0
+	}
+	n.Lock()
+	defer n.Unlock()
+	state, ok := n.states[key]
+	if !ok {
+		return 0
+	}
+	return state.Peek()
+}
+
+// StoredNonce is the next nonce never given out
+func (n *memManager) StoredNonce(ctx context.Context, addr common.Address) (uint64, error) {
+	key, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+	n.Lock()
+	defer n.Unlock()
+	state, ok := n.states[key]
+	if !ok {
+		return 0, ethnonce.ErrNotInitAddress
+	}
+	return state.Nonce, nil
+}
+
+func (n *memManager) GiveNonce(addr common.Address) (uint64, error) {
+	res, err := n.GiveNonceContext(context.Background(), addr)
+	return res.Nonce, err
+}
+
+func (n *memManager) GiveNonceContext(ctx context.Context, addr common.Address) (ethnonce.Reservation, error) {
+	if err := ctx.Err(); err != nil {
+		return ethnonce.Reservation{}, err
+	}
+	key, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return ethnonce.Reservation{}, err
+	}
+	n.Lock()
+	defer n.Unlock()
+	state, ok := n.states[key]
+	if !ok {
+		return ethnonce.Reservation{}, ethnonce.ErrNotInitAddress
+	}
+	return state.Give(time.Now().Unix(), n.opts.Depth, n.opts.LeaseOf(addr))
+}
+
+func (n *memManager) SyncNonce(addr common.Address) (uint64, error) {
+	return n.SyncNonceContext(context.Background(), addr)
+}
+
+func (n *memManager) SyncNonceContext(ctx context.Context, addr common.Address) (uint64, error) {
+	key, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+	n.Lock()
+	state, ok := n.states[key]
+	if ok && state.LiveHolds(time.Now().Unix(), n.opts.LeaseOf(addr)) > 0 {
+		n.Unlock()
+		return 0, ethnonce.ErrOtherHoldNonce
+	}
+	n.Unlock()
+	if n.ethConn == nil {
+		return 0, ethnonce.ErrNoChainSource
+	}
+	// don't block others while asking chain
+	nonce, err := n.ethConn.PendingNonceAt(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+	n.Lock()
+	defer n.Unlock()
+	state, ok = n.states[key]
+	if !ok {
+		state = ethnonce.NewAddressState(0)
+	}
+	if err = state.Sync(nonce, time.Now().Unix(), n.opts.LeaseOf(addr)); err != nil {
+		return 0, err
+	}
+	n.states[key] = state
+	return nonce, nil
+}
+
+func (n *memManager) CommitNonce(addr common.Address, nonce_number uint64, success bool) error {
+	return n.CommitNonceContext(context.Background(), addr, ethnonce.Reservation{Nonce: nonce_number}, success)
+}
+
+func (n *memManager) CommitNonceContext(ctx context.Context, addr common.Address, res ethnonce.Reservation, success bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	key, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return err
+	}
+	n.Lock()
+	defer n.Unlock()
+	state, ok := n.states[key]
+	if !ok {
+		return ethnonce.ErrNotInitAddress
+	}
+	return state.Commit(res, success)
+}
+
+func (n *memManager) RenewNonce(addr common.Address, nonce_number uint64) error {
+	return n.RenewNonceContext(context.Background(), addr, ethnonce.Reservation{Nonce: nonce_number})
+}
+
+func (n *memManager) RenewNonceContext(ctx context.Context, addr common.Address, res ethnonce.Reservation) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	key, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return err
+	}
+	n.Lock()
+	defer n.Unlock()
+	state, ok := n.states[key]
+	if !ok {
+		return ethnonce.ErrNotInitAddress
+	}
+	return state.Renew(res, time.Now().Unix())
+}
+
+func (n *memManager) AppendAudit(ctx context.Context, entry ethnonce.AuditEntry) error {
+	key, err := n.opts.AddressKey(ctx, entry.Address)
+	if err != nil {
+		return err
+	}
+	n.Lock()
+	defer n.Unlock()
+	n.audits[key] = append(n.audits[key], entry)
+	return nil
+}
+
+func (n *memManager) AuditEntries(ctx context.Context, addr common.Address, since int64) ([]ethnonce.AuditEntry, error) {
+	key, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	n.Lock()
+	defer n.Unlock()
+	var entries []ethnonce.AuditEntry
+	for _, entry := range n.audits[key] {
+		if entry.Timestamp >= since {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// MigrateLegacy moves states keyed by address only to chain of manager
+func (n *memManager) MigrateLegacy(ctx context.Context) (int, error) {
+	id, err := n.opts.ChainID(ctx)
+	if err != nil || id == 0 {
+		return 0, err
+	}
+	n.Lock()
+	defer n.Unlock()
+	var moved int
+	for key, state := range n.states {
+		if !ethnonce.IsLegacyKey(key) {
+			continue
+		}
+		target := ethnonce.ChainAddressKey(id, common.HexToAddress(key))
+		if _, ok := n.states[target]; ok {
+			continue
+		}
+		n.states[target] = state
+		n.audits[target] = append(n.audits[key], n.audits[target]...)
+		delete(n.states, key)
+		delete(n.audits, key)
+		moved++
+	}
+	return moved, nil
+}
+
+func (n *memManager) LeaseOf(addr common.Address) time.Duration {
+	return n.opts.LeaseOf(addr)
+}
+
+func (n *memManager) Close() error {
+	if n.snapshotPath == "" {
+		return nil
+	}
+	n.Lock()
+	data, err := json.Marshal(n.states)
+	n.Unlock()
+	if err != nil {
+		return err
+	}
+	// write whole file aside then rename, never leave a half snapshot
+	tmp := n.snapshotPath + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, n.snapshotPath)
+}
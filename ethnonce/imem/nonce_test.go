@@ -0,0 +1,193 @@
+package imem
+
+import (
+	"context"
+	"errors"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/qjpcpu/ethereum/ethnonce"
+	"github.com/qjpcpu/ethereum/ethnonce/conformance"
+	"github.com/qjpcpu/ethereum/mabi/mbind/backends"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sync"
+	"testing"
+)
+
+var testAddr = common.HexToAddress(`0xe35f3e2a93322b61e5d8931f806ff38f4a4f4d88`)
+
+func _testinit() *ethnonce.NonceManager {
+	return PrepareMemManager().(*MemManagerCreator).SetNonce(testAddr, 10).Build()
+}
+
+func _testteardown(mgr *ethnonce.NonceManager) {
+	mgr.Close()
+}
+
+func TestGiveCommit(t *testing.T) {
+	mgr := _testinit()
+	defer _testteardown(mgr)
+	nonce, err := mgr.MustGiveNonce(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mgr.CommitNonce(testAddr, nonce, true); err != nil {
+		t.Fatal(err)
+	}
+	nonce1, err := mgr.MustGiveNonce(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nonce1 != nonce+1 {
+		t.Fatal("bad ", nonce1)
+	}
+	_, err = mgr.GiveNonce(testAddr)
+	if err == nil {
+		t.Fatal("should err")
+	}
+	if err = mgr.CommitNonce(testAddr, nonce1, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mgr.GiveNonce(common.Address{}); err != ethnonce.ErrNotInitAddress {
+		t.Fatal("should initial first")
+	}
+}
+
+func TestWrap(t *testing.T) {
+	mgr := _testinit()
+	defer _testteardown(mgr)
+	nonce1 := mgr.PeekNonce(testAddr)
+	_, err := mgr.GiveNonceForTx(testAddr, func(nonce uint64) (*types.Transaction, error) {
+		return nil, errors.New("err")
+	})
+	if err == nil {
+		t.Fatal("should error")
+	}
+	if nonce2 := mgr.PeekNonce(testAddr); nonce1 != nonce2 {
+		t.Fatal("nonce should keep unchanged")
+	}
+	mgr.GiveNonceForTx(testAddr, func(nonce uint64) (*types.Transaction, error) {
+		return new(types.Transaction), nil
+	})
+	if nonce2 := mgr.PeekNonce(testAddr); nonce1+1 != nonce2 {
+		t.Fatal("nonce should increased")
+	}
+}
+
+func TestConcurrentPipeline(t *testing.T) {
+	mgr := PrepareMemManager().SetPipeline(4).(*MemManagerCreator).SetNonce(testAddr, 0).Build()
+	defer _testteardown(mgr)
+	var lock sync.Mutex
+	given := make(map[uint64]bool)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mgr.GiveNonceForTx(testAddr, func(nonce uint64) (*types.Transaction, error) {
+				lock.Lock()
+				defer lock.Unlock()
+				if given[nonce] {
+					t.Error("nonce given twice", nonce)
+				}
+				given[nonce] = true
+				return new(types.Transaction), nil
+			})
+		}()
+	}
+	wg.Wait()
+	if len(given) != 40 || mgr.PeekNonce(testAddr) != 40 {
+		t.Fatal("bad nonce", len(given), mgr.PeekNonce(testAddr))
+	}
+}
+
+func snapshotCreator(t *testing.T, file string) *MemManagerCreator {
+	creator, err := PrepareMemManagerWithSnapshot(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return creator.(*MemManagerCreator)
+}
+
+func TestSnapshot(t *testing.T) {
+	file := "./nonce.snapshot"
+	defer os.Remove(file)
+	mgr := snapshotCreator(t, file).SetNonce(testAddr, 10).Build()
+	nonce, _ := mgr.GiveNonce(testAddr)
+	mgr.CommitNonce(testAddr, nonce, true)
+	held, _ := mgr.GiveNonce(testAddr)
+	if err := mgr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	mgr = snapshotCreator(t, file).Build()
+	if _, err := mgr.GiveNonce(testAddr); err != ethnonce.ErrOtherHoldNonce {
+		t.Fatal("hold should be resumed", err)
+	}
+	mgr.CommitNonce(testAddr, held, true)
+	if mgr.PeekNonce(testAddr) != 12 {
+		t.Fatal("nonce should be resumed", mgr.PeekNonce(testAddr))
+	}
+	mgr.Close()
+	ioutil.WriteFile(file, []byte("{broken"), 0644)
+	if _, err := PrepareMemManagerWithSnapshot(file); err == nil {
+		t.Fatal("corrupt snapshot should fail")
+	}
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	file := "./nonce_legacy.snapshot"
+	defer os.Remove(file)
+	// snapshot of a manager keying by address only
+	if err := snapshotCreator(t, file).SetNonce(testAddr, 10).Build().Close(); err != nil {
+		t.Fatal(err)
+	}
+	mgr := snapshotCreator(t, file).SetChainID(big.NewInt(1)).Build()
+	defer mgr.Close()
+	if nonce := mgr.PeekNonce(testAddr); nonce != 0 {
+		t.Fatal("legacy nonce should not be seen before migration", nonce)
+	}
+	if moved, err := mgr.MigrateLegacyNonces(context.Background()); err != nil || moved != 1 {
+		t.Fatal("bad migration", moved, err)
+	}
+	if nonce := mgr.PeekNonce(testAddr); nonce != 10 {
+		t.Fatal("nonce should be migrated", nonce)
+	}
+	if moved, _ := mgr.MigrateLegacyNonces(context.Background()); moved != 0 {
+		t.Fatal("nothing left to migrate", moved)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	conformance.Run(t, func() (ethnonce.ManagerCreator, func()) {
+		return PrepareMemManager(), nil
+	})
+}
+
+func TestSimulatedBackend(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	sim := backends.NewSimulatedBackend(core.GenesisAlloc{from: {Balance: big.NewInt(1e18)}})
+	mgr := PrepareMemManager().SetEthClient(sim).Build()
+	defer mgr.Close()
+	if nonce, err := mgr.SyncNonce(from); err != nil || nonce != 0 {
+		t.Fatal("bad sync", nonce, err)
+	}
+	_, err := mgr.GiveNonceForTx(from, func(nonce uint64) (*types.Transaction, error) {
+		tx := types.NewTransaction(nonce, testAddr, big.NewInt(1), 21000, big.NewInt(1), nil)
+		signed, err := types.SignTx(tx, types.HomesteadSigner{}, key)
+		if err != nil {
+			return nil, err
+		}
+		return signed, sim.SendTransaction(context.Background(), signed)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim.Commit()
+	if nonce, err := mgr.SyncNonce(from); err != nil || nonce != 1 {
+		t.Fatal("bad sync", nonce, err)
+	}
+}
@@ -3,19 +3,24 @@ package imysql
 import (
 	"context"
 	"database/sql"
-	"fmt"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/ethclient"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/qjpcpu/ethereum/ethnonce"
+	"math/big"
 	"strings"
 	"time"
 )
 
+const (
+	stateGap  = 0
+	stateHold = 1
+)
+
 type mysqlManager struct {
 	Table   string
-	ethConn *ethclient.Client
+	ethConn ethnonce.ChainNonceSource
 	db      *sql.DB
+	opts    ethnonce.Options
 }
 
 type MysqlManagerCreator struct {
@@ -30,149 +35,378 @@ type nonceRecord struct {
 	LastGive int64
 }
 
-func (rc *MysqlManagerCreator) SetEthClient(conn *ethclient.Client) ethnonce.ManagerCreator {
+func (rc *MysqlManagerCreator) SetEthClient(conn ethnonce.ChainNonceSource) ethnonce.ManagerCreator {
 	rc.mgr.ethConn = conn
 	return rc
 }
 
+func (rc *MysqlManagerCreator) SetChainID(id *big.Int) ethnonce.ManagerCreator {
+	rc.mgr.opts.SetChainID(id)
+	return rc
+}
+
+func (rc *MysqlManagerCreator) SetPipeline(depth int) ethnonce.ManagerCreator {
+	rc.mgr.opts.SetDepth(depth)
+	return rc
+}
+
+func (rc *MysqlManagerCreator) SetLease(lease time.Duration, addrs ...common.Address) ethnonce.ManagerCreator {
+	rc.mgr.opts.SetLease(lease, addrs...)
+	return rc
+}
+
 func (rc *MysqlManagerCreator) Build() *ethnonce.NonceManager {
 	return &ethnonce.NonceManager{
 		Impl: rc.mgr,
 	}
 }
 
-func PrepareMysqlManager(connection_str string, tablename string) ethnonce.ManagerCreator {
+func PrepareMysqlManager(connection_str string, tablename string) (ethnonce.ManagerCreator, error) {
+	return PrepareMysqlManagerWithSchema(connection_str, tablename, SchemaOptions{})
+}
+
+// PrepareMysqlManagerWithSchema checks tables before use, and creates or
+// migrates them unless opts forbid
+func PrepareMysqlManagerWithSchema(connection_str string, tablename string, opts SchemaOptions) (ethnonce.ManagerCreator, error) {
 	db, err := sql.Open("mysql", connection_str)
 	if err != nil {
-		panic(err)
-	}
-	stmt, _ := db.Prepare("desc " + "`" + tablename + "`")
-	if _, err := stmt.Exec(); err != nil && strings.Contains(err.Error(), "doesn't exist") {
-		fmt.Printf("auto create tabel `%s`\n", tablename)
-		stmt, err = db.Prepare(fmt.Sprintf(`CREATE TABLE %s (
-  id bigint(11) unsigned NOT NULL AUTO_INCREMENT,
-  address varchar(42) DEFAULT '' COMMENT 'eth address',
-  nonce bigint(20) DEFAULT '0' COMMENT 'nonce',
-  commit tinyint(4) DEFAULT '0' COMMENT 'is commited',
-  last_give bigint(20) DEFAULT '0' COMMENT 'request give at',
-  updated_at datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT 'modify time',
-  PRIMARY KEY (id),
-  UNIQUE KEY address (address)
-) ENGINE=InnoDB DEFAULT CHARSET=utf8;`, "`"+tablename+"`"))
-		stmt.Exec()
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err = prepareSchema(db, tablename, opts); err != nil {
+		db.Close()
+		return nil, err
 	}
 	return &MysqlManagerCreator{
 		mgr: &mysqlManager{
 			db:    db,
 			Table: tablename,
+			opts:  ethnonce.NewOptions(),
 		},
-	}
+	}, nil
+}
+
+func reservationTable(tablename string) string {
+	return tablename + "_reservation"
+}
+
+func auditTable(tablename string) string {
+	return tablename + "_audit"
 }
 
 func (n *mysqlManager) escapedTable() string {
 	return "`" + n.Table + "`"
 }
 
-func (n *mysqlManager) getRecord(addr common.Address) (nonceRecord, error) {
-	row := n.db.QueryRow("SELECT id,address,nonce,commit,last_give FROM "+n.escapedTable()+" WHERE address=?", strings.ToLower(addr.Hex()))
+func (n *mysqlManager) escapedReservationTable() string {
+	return "`" + reservationTable(n.Table) + "`"
+}
+
+func (n *mysqlManager) escapedAuditTable() string {
+	return "`" + auditTable(n.Table) + "`"
+}
+
+// rowKey locates rows of an address, chain 0 are rows kept before chain id keying
+type rowKey struct {
+	chain   uint64
+	address string
+}
+
+func (n *mysqlManager) rowKey(ctx context.Context, addr common.Address) (rowKey, error) {
+	chain, err := n.opts.ChainID(ctx)
+	return rowKey{chain: chain, address: strings.ToLower(addr.Hex())}, err
+}
+
+func (n *mysqlManager) getRecord(ctx context.Context, key rowKey) (nonceRecord, error) {
+	row := n.db.QueryRowContext(ctx, "SELECT id,address,nonce,commit,last_give FROM "+n.escapedTable()+" WHERE chain_id=? AND address=?", key.chain, key.address)
 	record := nonceRecord{}
 	err := row.Scan(&record.Id, &record.Address, &record.Nonce, &record.Commit, &record.LastGive)
 	return record, err
 }
 
-func (n *mysqlManager) PeekNonce(addr common.Address) uint64 {
-	r, _ := n.getRecord(addr)
-	return r.Nonce
-}
-
-func (n *mysqlManager) GiveNonce(addr common.Address) (uint64, error) {
-	rec, err := n.getRecord(addr)
-	if err != nil {
+// load address state and lock the row until tx finish
+func (n *mysqlManager) loadState(ctx context.Context, tx *sql.Tx, key rowKey) (*ethnonce.AddressState, error) {
+	var nonce uint64
+	if err := tx.QueryRowContext(ctx, "SELECT nonce FROM "+n.escapedTable()+" WHERE chain_id=? AND address=? FOR UPDATE", key.chain, key.address).Scan(&nonce); err != nil {
 		if err == sql.ErrNoRows {
-			return 0, ethnonce.ErrNotInitAddress
+			return nil, ethnonce.ErrNotInitAddress
 		}
-		return 0, err
+		return nil, err
 	}
-	if rec.Commit == 0 {
-		stmt, err := n.db.Prepare("UPDATE " + n.escapedTable() + " SET commit=?,last_give=? WHERE address=? AND nonce=?")
-		if err != nil {
-			return 0, err
-		}
-		res, err := stmt.Exec(1, time.Now().Unix(), strings.ToLower(addr.Hex()), rec.Nonce)
-		if err != nil {
-			return 0, err
+	state := ethnonce.NewAddressState(nonce)
+	rows, err := tx.QueryContext(ctx, "SELECT nonce,state,last_give,token FROM "+n.escapedReservationTable()+" WHERE chain_id=? AND address=? ORDER BY nonce", key.chain, key.address)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var num uint64
+		var st int
+		var lastGive int64
+		var token uint64
+		if err = rows.Scan(&num, &st, &lastGive, &token); err != nil {
+			return nil, err
 		}
-		if af, _ := res.RowsAffected(); af != 1 {
-			return 0, ethnonce.ErrOtherHoldNonce
+		if st == stateHold {
+			state.Holds[num] = lastGive
+			state.Tokens[num] = token
+		} else {
+			state.Gaps = append(state.Gaps, num)
 		}
-		return rec.Nonce, nil
 	}
-	if time.Unix(rec.LastGive, 0).Add(time.Second * 60).Before(time.Now()) {
-		stmt, err := n.db.Prepare("UPDATE " + n.escapedTable() + " SET commit=?,last_give=? WHERE address=? AND nonce=? AND last_give=?")
-		if err != nil {
-			return 0, err
+	return state, rows.Err()
+}
+
+func (n *mysqlManager) saveState(ctx context.Context, tx *sql.Tx, key rowKey, state *ethnonce.AddressState) error {
+	// commit/last_give keep describing the address for people reading the table
+	var commit int
+	var lastGive int64
+	for _, stp := range state.Holds {
+		commit = 1
+		if stp > lastGive {
+			lastGive = stp
 		}
-		res, err := stmt.Exec(1, time.Now().Unix(), strings.ToLower(addr.Hex()), rec.Nonce, rec.LastGive)
-		if err != nil {
-			return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE "+n.escapedTable()+" SET nonce=?,commit=?,last_give=? WHERE chain_id=? AND address=?", state.Nonce, commit, lastGive, key.chain, key.address); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM "+n.escapedReservationTable()+" WHERE chain_id=? AND address=?", key.chain, key.address); err != nil {
+		return err
+	}
+	for num, stp := range state.Holds {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO "+n.escapedReservationTable()+" (chain_id,address,nonce,state,last_give,token) VALUES(?,?,?,?,?,?)", key.chain, key.address, num, stateHold, stp, state.Tokens[num]); err != nil {
+			return err
 		}
-		if af, _ := res.RowsAffected(); af != 1 {
-			return 0, ethnonce.ErrOtherHoldNonce
+	}
+	for _, num := range state.Gaps {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO "+n.escapedReservationTable()+" (chain_id,address,nonce,state,last_give,token) VALUES(?,?,?,?,?,?)", key.chain, key.address, num, stateGap, 0, 0); err != nil {
+			return err
 		}
-		return rec.Nonce, nil
 	}
+	return nil
+}
 
-	return 0, ethnonce.ErrOtherHoldNonce
+func (n *mysqlManager) updateState(ctx context.Context, key rowKey, fn func(*sql.Tx, *ethnonce.AddressState) error) error {
+	tx, err := n.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	state, err := n.loadState(ctx, tx, key)
+	if err == nil {
+		err = fn(tx, state)
+	}
+	if err == nil {
+		err = n.saveState(ctx, tx, key, state)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 
-func (n *mysqlManager) SyncNonce(addr common.Address) (uint64, error) {
-	nonce, err := n.ethConn.PendingNonceAt(context.Background(), addr)
+func (n *mysqlManager) PeekNonce(addr common.Address) uint64 {
+	return n.PeekNonceContext(context.Background(), addr)
+}
+
+func (n *mysqlManager) PeekNonceContext(ctx context.Context, addr common.Address) uint64 {
+	key, err := n.rowKey(ctx, addr)
+	if err != nil {
+		return 0
+	}
+	r, _ := n.getRecord(ctx, key)
+	var gap uint64
+	err = n.db.QueryRowContext(ctx, "SELECT MIN(nonce) FROM "+n.escapedReservationTable()+" WHERE chain_id=? AND address=? AND state=?", key.chain, key.address, stateGap).Scan(&gap)
+	if err == nil && gap < r.Nonce {
+		return gap
+	}
+	return r.Nonce
+}
+
+// StoredNonce is the next nonce never given out
+func (n *mysqlManager) StoredNonce(ctx context.Context, addr common.Address) (uint64, error) {
+	key, err := n.rowKey(ctx, addr)
 	if err != nil {
 		return 0, err
 	}
-	rec, err := n.getRecord(addr)
+	var nonce uint64
+	err = n.db.QueryRowContext(ctx, "SELECT nonce FROM "+n.escapedTable()+" WHERE chain_id=? AND address=?", key.chain, key.address).Scan(&nonce)
+	if err == sql.ErrNoRows {
+		return 0, ethnonce.ErrNotInitAddress
+	}
+	return nonce, err
+}
+
+func (n *mysqlManager) GiveNonce(addr common.Address) (uint64, error) {
+	res, err := n.GiveNonceContext(context.Background(), addr)
+	return res.Nonce, err
+}
+
+func (n *mysqlManager) GiveNonceContext(ctx context.Context, addr common.Address) (ethnonce.Reservation, error) {
+	key, err := n.rowKey(ctx, addr)
 	if err != nil {
-		stmt, err := n.db.Prepare("INSERT INTO " + n.escapedTable() + " (address,nonce,commit,last_give) VALUES(?,?,?,?)")
-		if err != nil {
-			return 0, err
-		}
-		stmt.Exec(strings.ToLower(addr.Hex()), nonce, 0, time.Now().Unix())
-	} else {
-		if rec.Commit == 1 && time.Unix(rec.LastGive, 0).Add(60*time.Second).After(time.Now()) {
-			return 0, ethnonce.ErrOtherHoldNonce
-		}
-		stmt, err := n.db.Prepare("UPDATE " + n.escapedTable() + " SET commit=0,last_give=? WHERE address=? AND nonce=?")
-		if err != nil {
-			return 0, err
+		return ethnonce.Reservation{}, err
+	}
+	var res ethnonce.Reservation
+	err = n.updateState(ctx, key, func(tx *sql.Tx, state *ethnonce.AddressState) (err error) {
+		if res, err = state.Give(time.Now().Unix(), n.opts.Depth, n.opts.LeaseOf(addr)); err != nil {
+			return
 		}
-		stmt.Exec(0, strings.ToLower(addr.Hex()), nonce)
+		_, err = tx.ExecContext(ctx, "UPDATE "+n.escapedTable()+" SET lease_owner=? WHERE chain_id=? AND address=?", ethnonce.CallerOf(ctx), key.chain, key.address)
+		return
+	})
+	return res, err
+}
+
+func (n *mysqlManager) SyncNonce(addr common.Address) (uint64, error) {
+	return n.SyncNonceContext(context.Background(), addr)
+}
+
+func (n *mysqlManager) SyncNonceContext(ctx context.Context, addr common.Address) (uint64, error) {
+	key, err := n.rowKey(ctx, addr)
+	if err != nil {
+		return 0, err
 	}
-	return nonce, err
+	if n.ethConn == nil {
+		return 0, ethnonce.ErrNoChainSource
+	}
+	nonce, err := n.ethConn.PendingNonceAt(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+	err = n.updateState(ctx, key, func(tx *sql.Tx, state *ethnonce.AddressState) error {
+		return state.Sync(nonce, time.Now().Unix(), n.opts.LeaseOf(addr))
+	})
+	if err == ethnonce.ErrNotInitAddress {
+		// a concurrent sync may insert first, it set the same chain nonce
+		_, err = n.db.ExecContext(ctx, "INSERT INTO "+n.escapedTable()+" (chain_id,address,nonce,commit,last_give) VALUES(?,?,?,?,?) ON DUPLICATE KEY UPDATE chain_id=chain_id", key.chain, key.address, nonce, 0, 0)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return nonce, nil
 }
 
 func (n *mysqlManager) CommitNonce(addr common.Address, nonce_number uint64, success bool) error {
-	rec, err := n.getRecord(addr)
+	return n.CommitNonceContext(context.Background(), addr, ethnonce.Reservation{Nonce: nonce_number}, success)
+}
+
+func (n *mysqlManager) CommitNonceContext(ctx context.Context, addr common.Address, res ethnonce.Reservation, success bool) error {
+	key, err := n.rowKey(ctx, addr)
+	if err != nil {
+		return err
+	}
+	return n.updateState(ctx, key, func(tx *sql.Tx, state *ethnonce.AddressState) error {
+		return state.Commit(res, success)
+	})
+}
+
+func (n *mysqlManager) RenewNonce(addr common.Address, nonce_number uint64) error {
+	return n.RenewNonceContext(context.Background(), addr, ethnonce.Reservation{Nonce: nonce_number})
+}
+
+func (n *mysqlManager) RenewNonceContext(ctx context.Context, addr common.Address, res ethnonce.Reservation) error {
+	key, err := n.rowKey(ctx, addr)
+	if err != nil {
+		return err
+	}
+	return n.updateState(ctx, key, func(tx *sql.Tx, state *ethnonce.AddressState) error {
+		return state.Renew(res, time.Now().Unix())
+	})
+}
+
+func (n *mysqlManager) AppendAudit(ctx context.Context, entry ethnonce.AuditEntry) error {
+	key, err := n.rowKey(ctx, entry.Address)
+	if err != nil {
+		return err
+	}
+	var success int
+	if entry.Success {
+		success = 1
+	}
+	_, err = n.db.ExecContext(ctx, "INSERT INTO "+n.escapedAuditTable()+" (chain_id,address,nonce,action,caller,tx_hash,success,created_at) VALUES(?,?,?,?,?,?,?,?)",
+		key.chain, key.address, entry.Nonce, entry.Action, entry.Caller, entry.TxHash.Hex(), success, entry.Timestamp)
+	return err
+}
+
+func (n *mysqlManager) AuditEntries(ctx context.Context, addr common.Address, since int64) ([]ethnonce.AuditEntry, error) {
+	key, err := n.rowKey(ctx, addr)
 	if err != nil {
-		return ethnonce.ErrNotInitAddress
+		return nil, err
 	}
-	if rec.Commit == 0 {
-		return nil
+	rows, err := n.db.QueryContext(ctx, "SELECT nonce,action,caller,tx_hash,success,created_at FROM "+n.escapedAuditTable()+" WHERE chain_id=? AND address=? AND created_at>=? ORDER BY id", key.chain, key.address, since)
+	if err != nil {
+		return nil, err
 	}
-	if rec.Nonce != nonce_number {
-		return ethnonce.ErrOtherHoldNonce
+	defer rows.Close()
+	var entries []ethnonce.AuditEntry
+	for rows.Next() {
+		entry := ethnonce.AuditEntry{Address: addr}
+		var txHash string
+		var success int
+		if err = rows.Scan(&entry.Nonce, &entry.Action, &entry.Caller, &txHash, &success, &entry.Timestamp); err != nil {
+			return nil, err
+		}
+		entry.TxHash = common.HexToHash(txHash)
+		entry.Success = success == 1
+		entries = append(entries, entry)
 	}
-	var delta int64
-	if success {
-		delta = 1
-	} else {
-		delta = 0
+	return entries, rows.Err()
+}
+
+// MigrateLegacy moves rows kept before chain id keying to chain of manager,
+// addresses kept under the chain already stay as they are
+func (n *mysqlManager) MigrateLegacy(ctx context.Context) (int, error) {
+	chain, err := n.opts.ChainID(ctx)
+	if err != nil || chain == 0 {
+		return 0, err
 	}
-	stmt, err := n.db.Prepare("UPDATE " + n.escapedTable() + " SET commit=0,last_give=0,nonce=nonce+? WHERE address=? AND nonce=?")
+	rows, err := n.db.QueryContext(ctx, "SELECT address FROM "+n.escapedTable()+" WHERE chain_id=0 AND address NOT IN (SELECT address FROM "+n.escapedTable()+" WHERE chain_id=?)", chain)
+	if err != nil {
+		return 0, err
+	}
+	var addresses []string
+	for rows.Next() {
+		var address string
+		if err = rows.Scan(&address); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		addresses = append(addresses, address)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	var moved int
+	for _, address := range addresses {
+		if err = n.migrateAddress(ctx, address, chain); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+func (n *mysqlManager) migrateAddress(ctx context.Context, address string, chain uint64) error {
+	tx, err := n.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	_, err = stmt.Exec(delta, strings.ToLower(addr.Hex()), rec.Nonce)
-	return err
+	for _, table := range []string{n.escapedTable(), n.escapedReservationTable(), n.escapedAuditTable()} {
+		if _, err = tx.ExecContext(ctx, "UPDATE "+table+" SET chain_id=? WHERE chain_id=0 AND address=?", chain, address); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (n *mysqlManager) LeaseOf(addr common.Address) time.Duration {
+	return n.opts.LeaseOf(addr)
 }
 
 func (n *mysqlManager) Close() error {
@@ -1,25 +1,37 @@
 package imysql
 
 import (
+	"database/sql"
 	"errors"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/qjpcpu/ethereum/ethnonce"
+	"github.com/qjpcpu/ethereum/ethnonce/conformance"
 	"testing"
 )
 
+const testDSN = "root:root@tcp(10.0.2.2:3306)/funny?charset=utf8"
+
 func _testinit() *ethnonce.NonceManager {
 	conn, _ := ethclient.Dial("http://localhost:18545")
 
-	creator := PrepareMysqlManager("root:root@tcp(10.0.2.2:3306)/funny?charset=utf8", "mmtk")
+	creator, err := PrepareMysqlManager(testDSN, "mmtk")
+	if err != nil {
+		panic(err)
+	}
 	return creator.SetEthClient(conn).Build()
 }
 
+func _testtruncate(m *mysqlManager) {
+	for _, table := range []string{"mmtk", "mmtk_reservation", "mmtk_audit"} {
+		st, _ := m.db.Prepare("truncate " + table)
+		st.Exec()
+	}
+}
+
 func _testteardown(mgr *ethnonce.NonceManager) {
-	m := mgr.Impl.(*mysqlManager)
-	st, _ := m.db.Prepare("truncate mmtk")
-	st.Exec()
+	_testtruncate(mgr.Impl.(*mysqlManager))
 	mgr.Close()
 }
 
@@ -80,3 +92,61 @@ func TestWrap(t *testing.T) {
 		t.Fatal("nonce should increased")
 	}
 }
+
+func TestConformance(t *testing.T) {
+	conformance.Run(t, func() (ethnonce.ManagerCreator, func()) {
+		creator, err := PrepareMysqlManager(testDSN, "mmtk")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_testtruncate(creator.(*MysqlManagerCreator).mgr)
+		return creator, nil
+	})
+}
+
+func TestSchema(t *testing.T) {
+	if _, err := PrepareMysqlManager("root:root@tcp(127.0.0.1:1)/funny", "mmtk"); err == nil {
+		t.Fatal("should fail to connect")
+	}
+	if _, err := PrepareMysqlManagerWithSchema(testDSN, "mmtk_absent", SchemaOptions{NoAutoCreate: true}); err == nil {
+		t.Fatal("should not create table")
+	}
+	db, err := sql.Open("mysql", testDSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer db.Exec("DROP TABLE IF EXISTS mmtk_legacy, mmtk_legacy_reservation, mmtk_legacy_audit, mmtk_other")
+	// table before chain_id and lease_owner added
+	if _, err = db.Exec(`CREATE TABLE mmtk_legacy (
+  id bigint(11) unsigned NOT NULL AUTO_INCREMENT,
+  address varchar(42) DEFAULT '',
+  nonce bigint(20) DEFAULT '0',
+  commit tinyint(4) DEFAULT '0',
+  last_give bigint(20) DEFAULT '0',
+  updated_at datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (id),
+  UNIQUE KEY address (address)
+)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = PrepareMysqlManagerWithSchema(testDSN, "mmtk_legacy", SchemaOptions{NoMigrate: true}); err == nil {
+		t.Fatal("should need migration")
+	}
+	creator, err := PrepareMysqlManager(testDSN, "mmtk_legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	creator.Build().Close()
+	columns, err := tableColumns(db, "mmtk_legacy")
+	if err != nil || !columns["chain_id"] || !columns["lease_owner"] {
+		t.Fatal("should add new columns", columns, err)
+	}
+	if indexes, err := tableIndexes(db, "mmtk_legacy"); err != nil || !indexes["chain_address"] || indexes["address"] {
+		t.Fatal("should key by chain and address", indexes, err)
+	}
+	db.Exec("CREATE TABLE mmtk_other (id int)")
+	if _, err = PrepareMysqlManager(testDSN, "mmtk_other"); err == nil {
+		t.Fatal("should refuse table of wrong schema")
+	}
+}
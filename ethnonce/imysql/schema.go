@@ -0,0 +1,180 @@
+package imysql
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/qjpcpu/log"
+	"strings"
+)
+
+// SchemaOptions controls how PrepareMysqlManagerWithSchema treats tables,
+// zero value creates and migrates tables as needed
+type SchemaOptions struct {
+	// fail when a table not exist instead of creating it
+	NoAutoCreate bool
+	// fail when a table lacks new columns or indexes instead of altering it
+	NoMigrate bool
+}
+
+// migration adds a column or an index to tables created by older versions
+type migration struct {
+	column string
+	index  string
+	// ALTER TABLE %s ...
+	alter string
+}
+
+type tableSchema struct {
+	suffix string
+	create string
+	// columns since the table first released, a table without them is not ours
+	columns []string
+	// applied in order
+	migrations []migration
+}
+
+var schemas = []tableSchema{
+	{
+		create: `CREATE TABLE %s (
+  id bigint(11) unsigned NOT NULL AUTO_INCREMENT,
+  address varchar(42) DEFAULT '' COMMENT 'eth address',
+  nonce bigint(20) DEFAULT '0' COMMENT 'nonce',
+  commit tinyint(4) DEFAULT '0' COMMENT 'is commited',
+  last_give bigint(20) DEFAULT '0' COMMENT 'request give at',
+  updated_at datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT 'modify time',
+  chain_id bigint(20) DEFAULT '0' COMMENT 'chain id, 0 for rows before chain id keying',
+  lease_owner varchar(128) DEFAULT '' COMMENT 'caller of last give',
+  PRIMARY KEY (id),
+  UNIQUE KEY chain_address (chain_id,address)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;`,
+		columns: []string{"id", "address", "nonce", "commit", "last_give", "updated_at"},
+		migrations: []migration{
+			{column: "chain_id", alter: "ALTER TABLE %s ADD COLUMN chain_id bigint(20) DEFAULT '0' COMMENT 'chain id, 0 for rows before chain id keying'"},
+			{column: "lease_owner", alter: "ALTER TABLE %s ADD COLUMN lease_owner varchar(128) DEFAULT '' COMMENT 'caller of last give'"},
+			{index: "chain_address", alter: "ALTER TABLE %s DROP INDEX address, ADD UNIQUE KEY chain_address (chain_id,address)"},
+		},
+	},
+	{
+		suffix: "_reservation",
+		create: `CREATE TABLE %s (
+  id bigint(11) unsigned NOT NULL AUTO_INCREMENT,
+  address varchar(42) DEFAULT '' COMMENT 'eth address',
+  nonce bigint(20) DEFAULT '0' COMMENT 'nonce',
+  state tinyint(4) DEFAULT '0' COMMENT '1:hold 0:released',
+  last_give bigint(20) DEFAULT '0' COMMENT 'request give at',
+  chain_id bigint(20) DEFAULT '0' COMMENT 'chain id',
+  token bigint(20) DEFAULT '0' COMMENT 'token of holder',
+  PRIMARY KEY (id),
+  UNIQUE KEY chain_address_nonce (chain_id,address,nonce)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;`,
+		columns: []string{"id", "address", "nonce", "state", "last_give"},
+		migrations: []migration{
+			{column: "chain_id", alter: "ALTER TABLE %s ADD COLUMN chain_id bigint(20) DEFAULT '0' COMMENT 'chain id'"},
+			{index: "chain_address_nonce", alter: "ALTER TABLE %s DROP INDEX address_nonce, ADD UNIQUE KEY chain_address_nonce (chain_id,address,nonce)"},
+			{column: "token", alter: "ALTER TABLE %s ADD COLUMN token bigint(20) DEFAULT '0' COMMENT 'token of holder'"},
+		},
+	},
+	{
+		suffix: "_audit",
+		create: `CREATE TABLE %s (
+  id bigint(11) unsigned NOT NULL AUTO_INCREMENT,
+  address varchar(42) DEFAULT '' COMMENT 'eth address',
+  nonce bigint(20) DEFAULT '0' COMMENT 'nonce',
+  action varchar(16) DEFAULT '' COMMENT 'give/commit/sync',
+  caller varchar(128) DEFAULT '' COMMENT 'caller tag',
+  tx_hash varchar(66) DEFAULT '' COMMENT 'tx sent with nonce',
+  success tinyint(4) DEFAULT '0' COMMENT 'commit success',
+  created_at bigint(20) DEFAULT '0' COMMENT 'unix nano',
+  chain_id bigint(20) DEFAULT '0' COMMENT 'chain id',
+  PRIMARY KEY (id),
+  KEY chain_address_created (chain_id,address,created_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;`,
+		columns: []string{"id", "address", "nonce", "action", "caller", "tx_hash", "success", "created_at"},
+		migrations: []migration{
+			{column: "chain_id", alter: "ALTER TABLE %s ADD COLUMN chain_id bigint(20) DEFAULT '0' COMMENT 'chain id'"},
+			{index: "chain_address_created", alter: "ALTER TABLE %s DROP INDEX address_created, ADD KEY chain_address_created (chain_id,address,created_at)"},
+		},
+	},
+}
+
+// prepareSchema makes tables of tablename ready, or tells why they are not
+func prepareSchema(db *sql.DB, tablename string, opts SchemaOptions) error {
+	for _, schema := range schemas {
+		name := tablename + schema.suffix
+		columns, err := tableColumns(db, name)
+		if err != nil {
+			return err
+		}
+		if len(columns) == 0 {
+			if opts.NoAutoCreate {
+				return fmt.Errorf("table `%s` not exist", name)
+			}
+			log.Infof("auto create table `%s`", name)
+			if _, err = db.Exec(fmt.Sprintf(schema.create, "`"+name+"`")); err != nil {
+				return fmt.Errorf("create table `%s` fail:%v", name, err)
+			}
+			continue
+		}
+		for _, col := range schema.columns {
+			if !columns[col] {
+				return fmt.Errorf("table `%s` has no column %s, not a nonce table", name, col)
+			}
+		}
+		indexes, err := tableIndexes(db, name)
+		if err != nil {
+			return err
+		}
+		for _, m := range schema.migrations {
+			if columns[m.column] || indexes[m.index] {
+				continue
+			}
+			what := "column " + m.column
+			if m.index != "" {
+				what = "index " + m.index
+			}
+			if opts.NoMigrate {
+				return fmt.Errorf("table `%s` needs %s, migrate it first", name, what)
+			}
+			log.Infof("add %s to table `%s`", what, name)
+			if _, err = db.Exec(fmt.Sprintf(m.alter, "`"+name+"`")); err != nil {
+				return fmt.Errorf("add %s to table `%s` fail:%v", what, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// tableColumns returns nothing when table not exist
+func tableColumns(db *sql.DB, name string) (map[string]bool, error) {
+	rows, err := db.Query("SELECT column_name FROM information_schema.columns WHERE table_schema=DATABASE() AND table_name=?", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var col string
+		if err = rows.Scan(&col); err != nil {
+			return nil, err
+		}
+		columns[strings.ToLower(col)] = true
+	}
+	return columns, rows.Err()
+}
+
+func tableIndexes(db *sql.DB, name string) (map[string]bool, error) {
+	rows, err := db.Query("SELECT DISTINCT index_name FROM information_schema.statistics WHERE table_schema=DATABASE() AND table_name=?", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	indexes := make(map[string]bool)
+	for rows.Next() {
+		var index string
+		if err = rows.Scan(&index); err != nil {
+			return nil, err
+		}
+		indexes[strings.ToLower(index)] = true
+	}
+	return indexes, rows.Err()
+}
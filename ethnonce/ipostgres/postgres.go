@@ -0,0 +1,403 @@
+package ipostgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	_ "github.com/lib/pq"
+	"github.com/qjpcpu/ethereum/ethnonce"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	stateGap  = 0
+	stateHold = 1
+)
+
+type postgresManager struct {
+	Table   string
+	ethConn ethnonce.ChainNonceSource
+	db      *sql.DB
+	opts    ethnonce.Options
+}
+
+type PostgresManagerCreator struct {
+	mgr *postgresManager
+}
+
+func (rc *PostgresManagerCreator) SetEthClient(conn ethnonce.ChainNonceSource) ethnonce.ManagerCreator {
+	rc.mgr.ethConn = conn
+	return rc
+}
+
+func (rc *PostgresManagerCreator) SetChainID(id *big.Int) ethnonce.ManagerCreator {
+	rc.mgr.opts.SetChainID(id)
+	return rc
+}
+
+func (rc *PostgresManagerCreator) SetPipeline(depth int) ethnonce.ManagerCreator {
+	rc.mgr.opts.SetDepth(depth)
+	return rc
+}
+
+func (rc *PostgresManagerCreator) SetLease(lease time.Duration, addrs ...common.Address) ethnonce.ManagerCreator {
+	rc.mgr.opts.SetLease(lease, addrs...)
+	return rc
+}
+
+func (rc *PostgresManagerCreator) Build() *ethnonce.NonceManager {
+	return &ethnonce.NonceManager{
+		Impl: rc.mgr,
+	}
+}
+
+// PreparePostgresManager keeps nonces in tablename, with tablename_reservation
+// and tablename_audit beside it, tables are created if not exist
+func PreparePostgresManager(connection_str string, tablename string) (ethnonce.ManagerCreator, error) {
+	db, err := sql.Open("postgres", connection_str)
+	if err != nil {
+		return nil, err
+	}
+	for _, ddl := range []string{
+		`CREATE TABLE IF NOT EXISTS "%s" (
+  id bigserial PRIMARY KEY,
+  address varchar(42) NOT NULL DEFAULT '',
+  nonce bigint NOT NULL DEFAULT 0,
+  commit smallint NOT NULL DEFAULT 0,
+  last_give bigint NOT NULL DEFAULT 0,
+  updated_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`,
+		`CREATE TABLE IF NOT EXISTS "%s_reservation" (
+  id bigserial PRIMARY KEY,
+  address varchar(42) NOT NULL DEFAULT '',
+  nonce bigint NOT NULL DEFAULT 0,
+  state smallint NOT NULL DEFAULT 0,
+  last_give bigint NOT NULL DEFAULT 0
+)`,
+		`CREATE TABLE IF NOT EXISTS "%s_audit" (
+  id bigserial PRIMARY KEY,
+  address varchar(42) NOT NULL DEFAULT '',
+  nonce bigint NOT NULL DEFAULT 0,
+  action varchar(16) NOT NULL DEFAULT '',
+  caller varchar(128) NOT NULL DEFAULT '',
+  tx_hash varchar(66) NOT NULL DEFAULT '',
+  success smallint NOT NULL DEFAULT 0,
+  created_at bigint NOT NULL DEFAULT 0
+)`,
+		// chain id keying, rows before it have chain id 0
+		`ALTER TABLE "%s" ADD COLUMN IF NOT EXISTS chain_id bigint NOT NULL DEFAULT 0`,
+		`ALTER TABLE "%s_reservation" ADD COLUMN IF NOT EXISTS chain_id bigint NOT NULL DEFAULT 0`,
+		`ALTER TABLE "%s_audit" ADD COLUMN IF NOT EXISTS chain_id bigint NOT NULL DEFAULT 0`,
+		// token of holder, 0 for holds given before tokens
+		`ALTER TABLE "%s_reservation" ADD COLUMN IF NOT EXISTS token bigint NOT NULL DEFAULT 0`,
+		`ALTER TABLE "%s" DROP CONSTRAINT IF EXISTS "%[1]s_address_key"`,
+		`ALTER TABLE "%s_reservation" DROP CONSTRAINT IF EXISTS "%[1]s_reservation_address_nonce_key"`,
+		`DROP INDEX IF EXISTS "%s_audit_address_created"`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS "%s_chain_address" ON "%[1]s" (chain_id,address)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS "%s_reservation_chain_address_nonce" ON "%[1]s_reservation" (chain_id,address,nonce)`,
+		`CREATE INDEX IF NOT EXISTS "%s_audit_chain_address_created" ON "%[1]s_audit" (chain_id,address,created_at)`,
+	} {
+		if _, err = db.Exec(fmt.Sprintf(ddl, tablename)); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &PostgresManagerCreator{
+		mgr: &postgresManager{
+			db:    db,
+			Table: tablename,
+			opts:  ethnonce.NewOptions(),
+		},
+	}, nil
+}
+
+func (n *postgresManager) escapedTable() string {
+	return `"` + n.Table + `"`
+}
+
+func (n *postgresManager) escapedReservationTable() string {
+	return `"` + n.Table + `_reservation"`
+}
+
+func (n *postgresManager) escapedAuditTable() string {
+	return `"` + n.Table + `_audit"`
+}
+
+// rowKey locates rows of an address, chain 0 are rows kept before chain id keying
+type rowKey struct {
+	chain   uint64
+	address string
+}
+
+func (n *postgresManager) rowKey(ctx context.Context, addr common.Address) (rowKey, error) {
+	chain, err := n.opts.ChainID(ctx)
+	return rowKey{chain: chain, address: strings.ToLower(addr.Hex())}, err
+}
+
+// load address state and lock the row until tx finish
+func (n *postgresManager) loadState(ctx context.Context, tx *sql.Tx, key rowKey) (*ethnonce.AddressState, error) {
+	var nonce uint64
+	if err := tx.QueryRowContext(ctx, "SELECT nonce FROM "+n.escapedTable()+" WHERE chain_id=$1 AND address=$2 FOR UPDATE", key.chain, key.address).Scan(&nonce); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ethnonce.ErrNotInitAddress
+		}
+		return nil, err
+	}
+	state := ethnonce.NewAddressState(nonce)
+	rows, err := tx.QueryContext(ctx, "SELECT nonce,state,last_give,token FROM "+n.escapedReservationTable()+" WHERE chain_id=$1 AND address=$2 ORDER BY nonce", key.chain, key.address)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var num uint64
+		var st int
+		var lastGive int64
+		var token uint64
+		if err = rows.Scan(&num, &st, &lastGive, &token); err != nil {
+			return nil, err
+		}
+		if st == stateHold {
+			state.Holds[num] = lastGive
+			state.Tokens[num] = token
+		} else {
+			state.Gaps = append(state.Gaps, num)
+		}
+	}
+	return state, rows.Err()
+}
+
+func (n *postgresManager) saveState(ctx context.Context, tx *sql.Tx, key rowKey, state *ethnonce.AddressState) error {
+	// commit/last_give keep describing the address for people reading the table
+	var commit int
+	var lastGive int64
+	for _, stp := range state.Holds {
+		commit = 1
+		if stp > lastGive {
+			lastGive = stp
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE "+n.escapedTable()+" SET nonce=$1,commit=$2,last_give=$3,updated_at=CURRENT_TIMESTAMP WHERE chain_id=$4 AND address=$5", state.Nonce, commit, lastGive, key.chain, key.address); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM "+n.escapedReservationTable()+" WHERE chain_id=$1 AND address=$2", key.chain, key.address); err != nil {
+		return err
+	}
+	for num, stp := range state.Holds {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO "+n.escapedReservationTable()+" (chain_id,address,nonce,state,last_give,token) VALUES($1,$2,$3,$4,$5,$6)", key.chain, key.address, num, stateHold, stp, state.Tokens[num]); err != nil {
+			return err
+		}
+	}
+	for _, num := range state.Gaps {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO "+n.escapedReservationTable()+" (chain_id,address,nonce,state,last_give,token) VALUES($1,$2,$3,$4,$5,$6)", key.chain, key.address, num, stateGap, 0, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *postgresManager) updateState(ctx context.Context, key rowKey, fn func(*ethnonce.AddressState) error) error {
+	tx, err := n.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	state, err := n.loadState(ctx, tx, key)
+	if err == nil {
+		err = fn(state)
+	}
+	if err == nil {
+		err = n.saveState(ctx, tx, key, state)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (n *postgresManager) PeekNonce(addr common.Address) uint64 {
+	return n.PeekNonceContext(context.Background(), addr)
+}
+
+func (n *postgresManager) PeekNonceContext(ctx context.Context, addr common.Address) uint64 {
+	key, err := n.rowKey(ctx, addr)
+	if err != nil {
+		return 0
+	}
+	var nonce uint64
+	if err = n.db.QueryRowContext(ctx, "SELECT nonce FROM "+n.escapedTable()+" WHERE chain_id=$1 AND address=$2", key.chain, key.address).Scan(&nonce); err != nil {
+		return 0
+	}
+	var gap sql.NullInt64
+	err = n.db.QueryRowContext(ctx, "SELECT MIN(nonce) FROM "+n.escapedReservationTable()+" WHERE chain_id=$1 AND address=$2 AND state=$3", key.chain, key.address, stateGap).Scan(&gap)
+	if err == nil && gap.Valid && uint64(gap.Int64) < nonce {
+		return uint64(gap.Int64)
+	}
+	return nonce
+}
+
+// StoredNonce is the next nonce never given out
+func (n *postgresManager) StoredNonce(ctx context.Context, addr common.Address) (uint64, error) {
+	key, err := n.rowKey(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+	var nonce uint64
+	err = n.db.QueryRowContext(ctx, "SELECT nonce FROM "+n.escapedTable()+" WHERE chain_id=$1 AND address=$2", key.chain, key.address).Scan(&nonce)
+	if err == sql.ErrNoRows {
+		return 0, ethnonce.ErrNotInitAddress
+	}
+	return nonce, err
+}
+
+func (n *postgresManager) GiveNonce(addr common.Address) (uint64, error) {
+	res, err := n.GiveNonceContext(context.Background(), addr)
+	return res.Nonce, err
+}
+
+func (n *postgresManager) GiveNonceContext(ctx context.Context, addr common.Address) (ethnonce.Reservation, error) {
+	key, err := n.rowKey(ctx, addr)
+	if err != nil {
+		return ethnonce.Reservation{}, err
+	}
+	var res ethnonce.Reservation
+	err = n.updateState(ctx, key, func(state *ethnonce.AddressState) (err error) {
+		res, err = state.Give(time.Now().Unix(), n.opts.Depth, n.opts.LeaseOf(addr))
+		return
+	})
+	return res, err
+}
+
+func (n *postgresManager) SyncNonce(addr common.Address) (uint64, error) {
+	return n.SyncNonceContext(context.Background(), addr)
+}
+
+func (n *postgresManager) SyncNonceContext(ctx context.Context, addr common.Address) (uint64, error) {
+	key, err := n.rowKey(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+	if n.ethConn == nil {
+		return 0, ethnonce.ErrNoChainSource
+	}
+	nonce, err := n.ethConn.PendingNonceAt(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+	err = n.updateState(ctx, key, func(state *ethnonce.AddressState) error {
+		return state.Sync(nonce, time.Now().Unix(), n.opts.LeaseOf(addr))
+	})
+	if err == ethnonce.ErrNotInitAddress {
+		// a concurrent sync may insert first, it set the same chain nonce
+		_, err = n.db.ExecContext(ctx, "INSERT INTO "+n.escapedTable()+" (chain_id,address,nonce,commit,last_give) VALUES($1,$2,$3,$4,$5) ON CONFLICT (chain_id,address) DO NOTHING", key.chain, key.address, nonce, 0, 0)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return nonce, nil
+}
+
+func (n *postgresManager) CommitNonce(addr common.Address, nonce_number uint64, success bool) error {
+	return n.CommitNonceContext(context.Background(), addr, ethnonce.Reservation{Nonce: nonce_number}, success)
+}
+
+func (n *postgresManager) CommitNonceContext(ctx context.Context, addr common.Address, res ethnonce.Reservation, success bool) error {
+	key, err := n.rowKey(ctx, addr)
+	if err != nil {
+		return err
+	}
+	return n.updateState(ctx, key, func(state *ethnonce.AddressState) error {
+		return state.Commit(res, success)
+	})
+}
+
+func (n *postgresManager) RenewNonce(addr common.Address, nonce_number uint64) error {
+	return n.RenewNonceContext(context.Background(), addr, ethnonce.Reservation{Nonce: nonce_number})
+}
+
+func (n *postgresManager) RenewNonceContext(ctx context.Context, addr common.Address, res ethnonce.Reservation) error {
+	key, err := n.rowKey(ctx, addr)
+	if err != nil {
+		return err
+	}
+	return n.updateState(ctx, key, func(state *ethnonce.AddressState) error {
+		return state.Renew(res, time.Now().Unix())
+	})
+}
+
+func (n *postgresManager) AppendAudit(ctx context.Context, entry ethnonce.AuditEntry) error {
+	key, err := n.rowKey(ctx, entry.Address)
+	if err != nil {
+		return err
+	}
+	var success int
+	if entry.Success {
+		success = 1
+	}
+	_, err = n.db.ExecContext(ctx, "INSERT INTO "+n.escapedAuditTable()+" (chain_id,address,nonce,action,caller,tx_hash,success,created_at) VALUES($1,$2,$3,$4,$5,$6,$7,$8)",
+		key.chain, key.address, entry.Nonce, entry.Action, entry.Caller, entry.TxHash.Hex(), success, entry.Timestamp)
+	return err
+}
+
+func (n *postgresManager) AuditEntries(ctx context.Context, addr common.Address, since int64) ([]ethnonce.AuditEntry, error) {
+	key, err := n.rowKey(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := n.db.QueryContext(ctx, "SELECT nonce,action,caller,tx_hash,success,created_at FROM "+n.escapedAuditTable()+" WHERE chain_id=$1 AND address=$2 AND created_at>=$3 ORDER BY id", key.chain, key.address, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []ethnonce.AuditEntry
+	for rows.Next() {
+		entry := ethnonce.AuditEntry{Address: addr}
+		var txHash string
+		var success int
+		if err = rows.Scan(&entry.Nonce, &entry.Action, &entry.Caller, &txHash, &success, &entry.Timestamp); err != nil {
+			return nil, err
+		}
+		entry.TxHash = common.HexToHash(txHash)
+		entry.Success = success == 1
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// MigrateLegacy moves rows kept before chain id keying to chain of manager,
+// addresses kept under the chain already stay as they are
+func (n *postgresManager) MigrateLegacy(ctx context.Context) (int, error) {
+	chain, err := n.opts.ChainID(ctx)
+	if err != nil || chain == 0 {
+		return 0, err
+	}
+	tx, err := n.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	// addresses to move, chosen before the main table changes
+	moving := "SELECT address FROM " + n.escapedTable() + " WHERE chain_id=0 AND address NOT IN (SELECT address FROM " + n.escapedTable() + " WHERE chain_id=$1)"
+	for _, table := range []string{n.escapedReservationTable(), n.escapedAuditTable()} {
+		if _, err = tx.ExecContext(ctx, "UPDATE "+table+" SET chain_id=$1 WHERE chain_id=0 AND address IN ("+moving+")", chain); err != nil {
+			return 0, err
+		}
+	}
+	res, err := tx.ExecContext(ctx, "UPDATE "+n.escapedTable()+" SET chain_id=$1 WHERE chain_id=0 AND address IN ("+moving+")", chain)
+	if err != nil {
+		return 0, err
+	}
+	moved, _ := res.RowsAffected()
+	return int(moved), tx.Commit()
+}
+
+func (n *postgresManager) LeaseOf(addr common.Address) time.Duration {
+	return n.opts.LeaseOf(addr)
+}
+
+func (n *postgresManager) Close() error {
+	return n.db.Close()
+}
@@ -7,12 +7,12 @@ import (
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/garyburd/redigo/redis"
 	"github.com/qjpcpu/ethereum/ethnonce"
+	"github.com/qjpcpu/ethereum/ethnonce/conformance"
 	"testing"
 	"time"
 )
 
-func _testinit() *ethnonce.NonceManager {
-	conn, _ := ethclient.Dial("http://localhost:18545")
+func _testpool() *redis.Pool {
 	c := &redis.Pool{
 		MaxIdle:     200,
 		MaxActive:   200,
@@ -36,7 +36,12 @@ func _testinit() *ethnonce.NonceManager {
 	rc := c.Get()
 	rc.Do("DEL", "testhash")
 	rc.Close()
-	creator := PrepareRedisPoolManager("testhash", c)
+	return c
+}
+
+func _testinit() *ethnonce.NonceManager {
+	conn, _ := ethclient.Dial("http://localhost:18545")
+	creator := PrepareRedisPoolManager("testhash", _testpool())
 	return creator.SetEthClient(conn).Build()
 }
 
@@ -101,3 +106,9 @@ func TestWrap(t *testing.T) {
 		t.Fatal("nonce should increased")
 	}
 }
+
+func TestConformance(t *testing.T) {
+	conformance.Run(t, func() (ethnonce.ManagerCreator, func()) {
+		return PrepareRedisPoolManager("testhash", _testpool()), nil
+	})
+}
@@ -2,112 +2,231 @@ package iredis
 
 import (
 	"context"
+	"encoding/json"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/garyburd/redigo/redis"
 	"github.com/qjpcpu/ethereum/ethnonce"
-	"strings"
+	"math/big"
 	"time"
 )
 
+// field addr is chainid:address, or address only without chain id,
+// reserved nonces live in field addr_hold as {"nonce": give_or_renew_timestamp},
+// tokens of their holders in field addr_tok as {"nonce": "token"},
+// released nonces in field addr_gap as [nonce...]
+const luaHelpers = `
+local function decode(raw)
+	if not raw then
+		return {}
+	end
+	return cjson.decode(raw)
+end
+`
+
 var (
-	// redis-cli --eval give.lua hash_name , 0x123 timestamp(in second)
-	giveNonceScript = redis.NewScript(1, `
+	// redis-cli --eval give.lua hash_name , 0x123 timestamp(in second) depth lease_seconds token
+	giveNonceScript = redis.NewScript(1, luaHelpers+`
 local key = KEYS[1]
 local field_addr = ARGV[1]
 local timestamp = tonumber(ARGV[2])  -- second
-local field_commit = field_addr.."_cmt"
-local field_timestamp = field_addr.."_stp"
+local depth = tonumber(ARGV[3])
+local lease = tonumber(ARGV[4])
+local token = ARGV[5]
+local field_hold = field_addr.."_hold"
+local field_gap = field_addr.."_gap"
+local field_tok = field_addr.."_tok"
 -- addr not exist
 if redis.call("HEXISTS", key, field_addr) == 0 then
 	return -1
 end
-local iscommit = tonumber(redis.call("HGET", key, field_commit))
--- 0: can give nonce
-if iscommit == 0 then
-	redis.call("HSET", key, field_timestamp, timestamp)
-	redis.call("HSET", key, field_commit, 1)
-	return redis.call("HGET", key, field_addr)
+local holds = decode(redis.call("HGET", key, field_hold))
+local gaps = decode(redis.call("HGET", key, field_gap))
+-- timeout holds can be given again
+local live = 0
+local reuse = nil
+local gap_idx = nil
+for n, stp in pairs(holds) do
+	if stp + lease >= timestamp then
+		live = live + 1
+	elseif reuse == nil or tonumber(n) < reuse then
+		reuse = tonumber(n)
+	end
 end
--- come here,means user don't commit
--- user not commit, but 1 minute timeout, so we still give nonce
-if tonumber(redis.call("HGET",key, field_timestamp)) + 60 < timestamp then
-	redis.call("HSET", key, field_timestamp, timestamp)
-	return redis.call("HGET", key, field_addr)
+-- too many users hold nonce, we should wait
+if live >= depth then
+	return -2
 end
-
--- user hold nonce, we should wait
-return -2
+for i, n in ipairs(gaps) do
+	if reuse == nil or n < reuse then
+		reuse = n
+		gap_idx = i
+	end
+end
+local nonce = reuse
+if nonce == nil then
+	nonce = tonumber(redis.call("HGET", key, field_addr))
+	redis.call("HINCRBY", key, field_addr, 1)
+elseif gap_idx ~= nil then
+	table.remove(gaps, gap_idx)
+end
+local tokens = decode(redis.call("HGET", key, field_tok))
+holds[tostring(nonce)] = timestamp
+tokens[tostring(nonce)] = token
+redis.call("HSET", key, field_hold, cjson.encode(holds))
+redis.call("HSET", key, field_tok, cjson.encode(tokens))
+redis.call("HSET", key, field_gap, cjson.encode(gaps))
+return nonce
 `)
-	// redis-cli --eval ./comit_nonce.lua n , 0x123 timestamp nonce 0/1(成功使用/放弃)
-	commitNonceScript = redis.NewScript(1, `
+	// redis-cli --eval ./comit_nonce.lua n , 0x123 nonce 0/1(成功使用/放弃) token(0 for any holder)
+	commitNonceScript = redis.NewScript(1, luaHelpers+`
 local key = KEYS[1]
 local field_addr = ARGV[1]
-local timestamp = tonumber(ARGV[2])  -- second
-local nonce = tonumber(ARGV[3])
-local commit_ok = tonumber(ARGV[4])  -- 0/1 0: ok
-local field_commit = field_addr.."_cmt"
-local field_timestamp = field_addr.."_stp"
+local nonce = tonumber(ARGV[2])
+local commit_ok = tonumber(ARGV[3])  -- 0/1 0: ok
+local token = ARGV[4]
+local field_hold = field_addr.."_hold"
+local field_gap = field_addr.."_gap"
+local field_tok = field_addr.."_tok"
 -- addr not exist
 if redis.call("HEXISTS", key, field_addr) == 0 then
 	return -1
 end
-local iscommit = tonumber(redis.call("HGET", key, field_commit))
--- iscommit==1 means can commit
-if iscommit ~= 0 then
-	redis.call("HSET", key, field_timestamp, timestamp)
-	redis.call("HSET", key, field_commit, 0)
-    local n = tonumber(redis.call("HGET",key, field_addr))
-    if n ~= nonce then
-        return -2
-    end
-	if commit_ok == 0 then
-	    redis.call("HINCRBY",key, field_addr, 1)
-    end
+local holds = decode(redis.call("HGET", key, field_hold))
+local tokens = decode(redis.call("HGET", key, field_tok))
+-- not reserved or given to others, lease lost
+if holds[tostring(nonce)] == nil or (token ~= "0" and tokens[tostring(nonce)] ~= token) then
+	return -2
+end
+holds[tostring(nonce)] = nil
+tokens[tostring(nonce)] = nil
+redis.call("HSET", key, field_hold, cjson.encode(holds))
+redis.call("HSET", key, field_tok, cjson.encode(tokens))
+if commit_ok == 0 then
 	return 0
 end
-
--- iscommit already == 0, we consider is OK
+-- release nonce, drop gaps on top
+local gaps = decode(redis.call("HGET", key, field_gap))
+table.insert(gaps, nonce)
+table.sort(gaps)
+local top = tonumber(redis.call("HGET", key, field_addr))
+while #gaps > 0 and gaps[#gaps] + 1 == top do
+	top = top - 1
+	table.remove(gaps)
+end
+redis.call("HSET", key, field_addr, top)
+redis.call("HSET", key, field_gap, cjson.encode(gaps))
 return 0
 `)
-	// redis-cli --eval ./sync_nonce.lua n , 0x123 nonce_number timestamp
-	syncNonceScript = redis.NewScript(1, `
+	// redis-cli --eval ./sync_nonce.lua n , 0x123 nonce_number timestamp lease_seconds
+	syncNonceScript = redis.NewScript(1, luaHelpers+`
 local key = KEYS[1]
 local field_addr = ARGV[1]
 local nonce = ARGV[2]
 local timestamp = tonumber(ARGV[3])  -- second
-local field_commit = field_addr.."_cmt"
-local field_timestamp = field_addr.."_stp"
+local lease = tonumber(ARGV[4])
+local field_hold = field_addr.."_hold"
+local field_gap = field_addr.."_gap"
 
 if redis.call("HEXISTS", key, field_addr) ~= 0 then
-    local iscommit = tonumber(redis.call("HGET", key, field_commit))
-    local lasttime = tonumber(redis.call("HGET",key, field_timestamp))
-    if iscommit ~= 0 and lasttime + 60 > timestamp then
-        return -1
-    end
+	local holds = decode(redis.call("HGET", key, field_hold))
+	for n, stp in pairs(holds) do
+		if stp + lease >= timestamp then
+			return -1
+		end
+	end
 end
 redis.call("HSET", key, field_addr, nonce)
-redis.call("HSET", key, field_timestamp, 0)
-redis.call("HSET", key, field_commit, 0)
+redis.call("HDEL", key, field_hold, field_gap, field_addr.."_tok", field_addr.."_cmt", field_addr.."_stp")
 return 0
+`)
+	// redis-cli --eval ./renew_nonce.lua n , 0x123 nonce timestamp token(0 for any holder)
+	renewNonceScript = redis.NewScript(1, luaHelpers+`
+local key = KEYS[1]
+local field_addr = ARGV[1]
+local nonce = tonumber(ARGV[2])
+local timestamp = tonumber(ARGV[3])  -- second
+local token = ARGV[4]
+local field_hold = field_addr.."_hold"
+-- addr not exist
+if redis.call("HEXISTS", key, field_addr) == 0 then
+	return -1
+end
+local holds = decode(redis.call("HGET", key, field_hold))
+local tokens = decode(redis.call("HGET", key, field_addr.."_tok"))
+-- not reserved or given to others
+if holds[tostring(nonce)] == nil or (token ~= "0" and tokens[tostring(nonce)] ~= token) then
+	return -2
+end
+holds[tostring(nonce)] = timestamp
+redis.call("HSET", key, field_hold, cjson.encode(holds))
+return 0
+`)
+	// redis-cli --eval ./migrate_nonce.lua n , 0x123 1:0x123
+	migrateNonceScript = redis.NewScript(1, `
+local key = KEYS[1]
+local from = ARGV[1]
+local to = ARGV[2]
+-- target kept already or nothing to move
+if redis.call("HEXISTS", key, to) == 1 or redis.call("HEXISTS", key, from) == 0 then
+	return 0
+end
+for i, suffix in ipairs({"", "_hold", "_gap", "_tok"}) do
+	local v = redis.call("HGET", key, from..suffix)
+	if v then
+		redis.call("HSET", key, to..suffix, v)
+	end
+end
+redis.call("HDEL", key, from, from.."_hold", from.."_gap", from.."_tok", from.."_cmt", from.."_stp")
+return 1
+`)
+	// redis-cli --eval ./peek_nonce.lua n , 0x123
+	peekNonceScript = redis.NewScript(1, luaHelpers+`
+local key = KEYS[1]
+local field_addr = ARGV[1]
+if redis.call("HEXISTS", key, field_addr) == 0 then
+	return -1
+end
+local nonce = tonumber(redis.call("HGET", key, field_addr))
+for i, n in ipairs(decode(redis.call("HGET", key, field_addr.."_gap"))) do
+	if n < nonce then
+		nonce = n
+	end
+end
+return nonce
 `)
 )
 
 type redisManager struct {
 	NoncesName string
-	ethConn    *ethclient.Client
+	ethConn    ethnonce.ChainNonceSource
 	pool       *redis.Pool
+	opts       ethnonce.Options
 }
 
 type RedisManagerCreator struct {
 	mgr *redisManager
 }
 
-func (rc *RedisManagerCreator) SetEthClient(conn *ethclient.Client) ethnonce.ManagerCreator {
+func (rc *RedisManagerCreator) SetEthClient(conn ethnonce.ChainNonceSource) ethnonce.ManagerCreator {
 	rc.mgr.ethConn = conn
 	return rc
 }
 
+func (rc *RedisManagerCreator) SetChainID(id *big.Int) ethnonce.ManagerCreator {
+	rc.mgr.opts.SetChainID(id)
+	return rc
+}
+
+func (rc *RedisManagerCreator) SetPipeline(depth int) ethnonce.ManagerCreator {
+	rc.mgr.opts.SetDepth(depth)
+	return rc
+}
+
+func (rc *RedisManagerCreator) SetLease(lease time.Duration, addrs ...common.Address) ethnonce.ManagerCreator {
+	rc.mgr.opts.SetLease(lease, addrs...)
+	return rc
+}
+
 func (rc *RedisManagerCreator) Build() *ethnonce.NonceManager {
 	return &ethnonce.NonceManager{
 		Impl: rc.mgr,
@@ -157,44 +276,94 @@ func PrepareRedisPoolManager(key string, pool *redis.Pool) ethnonce.ManagerCreat
 		mgr: &redisManager{
 			NoncesName: key,
 			pool:       pool,
+			opts:       ethnonce.NewOptions(),
 		},
 	}
 }
 
 func (n *redisManager) PeekNonce(addr common.Address) uint64 {
+	return n.PeekNonceContext(context.Background(), addr)
+}
+
+func (n *redisManager) PeekNonceContext(ctx context.Context, addr common.Address) uint64 {
+	address, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return 0
+	}
 	conn := n.pool.Get()
 	defer conn.Close()
-	num, _ := redis.Uint64(conn.Do("HGET", n.NoncesName, strings.ToLower(addr.Hex())))
-	return num
+	num, err := redis.Int64(peekNonceScript.Do(conn, n.NoncesName, address))
+	if err != nil || num < 0 {
+		return 0
+	}
+	return uint64(num)
+}
+
+// StoredNonce is the next nonce never given out
+func (n *redisManager) StoredNonce(ctx context.Context, addr common.Address) (uint64, error) {
+	address, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+	redis_conn := n.pool.Get()
+	defer redis_conn.Close()
+	nonce, err := redis.Uint64(redis_conn.Do("HGET", n.NoncesName, address))
+	if err == redis.ErrNil {
+		return 0, ethnonce.ErrNotInitAddress
+	}
+	return nonce, err
 }
 
 func (n *redisManager) GiveNonce(addr common.Address) (uint64, error) {
+	res, err := n.GiveNonceContext(context.Background(), addr)
+	return res.Nonce, err
+}
+
+func (n *redisManager) GiveNonceContext(ctx context.Context, addr common.Address) (ethnonce.Reservation, error) {
+	if err := ctx.Err(); err != nil {
+		return ethnonce.Reservation{}, err
+	}
+	address, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return ethnonce.Reservation{}, err
+	}
 	conn := n.pool.Get()
 	defer conn.Close()
-	address := strings.ToLower(addr.Hex())
 	now := time.Now()
-	errcode, err := redis.Int64(giveNonceScript.Do(conn, n.NoncesName, address, now.Unix()))
+	token := ethnonce.NewToken()
+	errcode, err := redis.Int64(giveNonceScript.Do(conn, n.NoncesName, address, now.Unix(), n.opts.Depth, n.opts.LeaseSeconds(addr), token))
 	if err != nil && err != redis.ErrNil {
-		return 0, err
+		return ethnonce.Reservation{}, err
 	}
 	switch errcode {
 	case -1:
-		return 0, ethnonce.ErrNotInitAddress
+		return ethnonce.Reservation{}, ethnonce.ErrNotInitAddress
 	case -2:
-		return 0, ethnonce.ErrOtherHoldNonce
+		return ethnonce.Reservation{}, ethnonce.ErrOtherHoldNonce
 	default:
-		return uint64(errcode), nil
+		return ethnonce.Reservation{Nonce: uint64(errcode), Token: token}, nil
 	}
 }
 
 func (n *redisManager) SyncNonce(addr common.Address) (uint64, error) {
+	return n.SyncNonceContext(context.Background(), addr)
+}
+
+func (n *redisManager) SyncNonceContext(ctx context.Context, addr common.Address) (uint64, error) {
+	address, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
 	redis_conn := n.pool.Get()
 	defer redis_conn.Close()
-	nonce, err := n.ethConn.PendingNonceAt(context.Background(), addr)
+	if n.ethConn == nil {
+		return 0, ethnonce.ErrNoChainSource
+	}
+	nonce, err := n.ethConn.PendingNonceAt(ctx, addr)
 	if err != nil {
 		return 0, err
 	}
-	code, err := redis.Int(syncNonceScript.Do(redis_conn, n.NoncesName, strings.ToLower(addr.Hex()), nonce, time.Now().Unix()))
+	code, err := redis.Int(syncNonceScript.Do(redis_conn, n.NoncesName, address, nonce, time.Now().Unix(), n.opts.LeaseSeconds(addr)))
 	if err != nil {
 		return 0, err
 	}
@@ -205,13 +374,24 @@ func (n *redisManager) SyncNonce(addr common.Address) (uint64, error) {
 }
 
 func (n *redisManager) CommitNonce(addr common.Address, nonce_number uint64, success bool) error {
+	return n.CommitNonceContext(context.Background(), addr, ethnonce.Reservation{Nonce: nonce_number}, success)
+}
+
+func (n *redisManager) CommitNonceContext(ctx context.Context, addr common.Address, res ethnonce.Reservation, success bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	address, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return err
+	}
 	redis_conn := n.pool.Get()
 	defer redis_conn.Close()
 	ok := 0
 	if !success {
 		ok = 1
 	}
-	code, err := redis.Int(commitNonceScript.Do(redis_conn, n.NoncesName, strings.ToLower(addr.Hex()), time.Now().Unix(), nonce_number, ok))
+	code, err := redis.Int(commitNonceScript.Do(redis_conn, n.NoncesName, address, res.Nonce, ok, res.Token))
 	if err != nil {
 		return err
 	}
@@ -219,12 +399,118 @@ func (n *redisManager) CommitNonce(addr common.Address, nonce_number uint64, suc
 	case -1:
 		return ethnonce.ErrNotInitAddress
 	case -2:
-		return ethnonce.ErrOtherHoldNonce
+		return ethnonce.ErrLeaseLost
 	default:
 		return nil
 	}
 }
 
+func (n *redisManager) RenewNonce(addr common.Address, nonce_number uint64) error {
+	return n.RenewNonceContext(context.Background(), addr, ethnonce.Reservation{Nonce: nonce_number})
+}
+
+func (n *redisManager) RenewNonceContext(ctx context.Context, addr common.Address, res ethnonce.Reservation) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	address, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return err
+	}
+	redis_conn := n.pool.Get()
+	defer redis_conn.Close()
+	code, err := redis.Int(renewNonceScript.Do(redis_conn, n.NoncesName, address, res.Nonce, time.Now().Unix(), res.Token))
+	if err != nil {
+		return err
+	}
+	switch code {
+	case -1:
+		return ethnonce.ErrNotInitAddress
+	case -2:
+		return ethnonce.ErrLeaseLost
+	default:
+		return nil
+	}
+}
+
+// audit entries of address live in list key:audit:address
+func (n *redisManager) auditKey(address string) string {
+	return n.NoncesName + ":audit:" + address
+}
+
+func (n *redisManager) AppendAudit(ctx context.Context, entry ethnonce.AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	address, err := n.opts.AddressKey(ctx, entry.Address)
+	if err != nil {
+		return err
+	}
+	redis_conn := n.pool.Get()
+	defer redis_conn.Close()
+	_, err = redis_conn.Do("RPUSH", n.auditKey(address), data)
+	return err
+}
+
+func (n *redisManager) AuditEntries(ctx context.Context, addr common.Address, since int64) ([]ethnonce.AuditEntry, error) {
+	address, err := n.opts.AddressKey(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	redis_conn := n.pool.Get()
+	defer redis_conn.Close()
+	list, err := redis.Strings(redis_conn.Do("LRANGE", n.auditKey(address), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	var entries []ethnonce.AuditEntry
+	for _, data := range list {
+		var entry ethnonce.AuditEntry
+		if err = json.Unmarshal([]byte(data), &entry); err != nil {
+			return nil, err
+		}
+		if entry.Timestamp >= since {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// MigrateLegacy moves fields of address only to chain of manager
+func (n *redisManager) MigrateLegacy(ctx context.Context) (int, error) {
+	id, err := n.opts.ChainID(ctx)
+	if err != nil || id == 0 {
+		return 0, err
+	}
+	redis_conn := n.pool.Get()
+	defer redis_conn.Close()
+	fields, err := redis.Strings(redis_conn.Do("HKEYS", n.NoncesName))
+	if err != nil {
+		return 0, err
+	}
+	var moved int
+	for _, field := range fields {
+		if !ethnonce.IsLegacyKey(field) || len(field) != len(common.Address{}.Hex()) {
+			continue
+		}
+		target := ethnonce.ChainAddressKey(id, common.HexToAddress(field))
+		ok, err := redis.Int(migrateNonceScript.Do(redis_conn, n.NoncesName, field, target))
+		if err != nil {
+			return moved, err
+		}
+		if ok == 1 {
+			redis_conn.Do("RENAMENX", n.auditKey(field), n.auditKey(target))
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+func (n *redisManager) LeaseOf(addr common.Address) time.Duration {
+	return n.opts.LeaseOf(addr)
+}
+
 func (n *redisManager) Close() error {
 	return n.pool.Close()
 }
@@ -0,0 +1,113 @@
+// Package metrics exports nonce management of any ethnonce backend to
+// prometheus, address is a label so keep the addresses managed few
+package metrics
+
+import (
+	"context"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qjpcpu/ethereum/ethnonce"
+	"strings"
+	"time"
+)
+
+// Collector is ethnonce.Hooks and prometheus.Collector at once, register it
+// to prometheus and pass it to NonceManager.SetHooks
+type Collector struct {
+	giveSeconds  *prometheus.HistogramVec
+	contentions  *prometheus.CounterVec
+	leaseExpired *prometheus.CounterVec
+	syncs        *prometheus.CounterVec
+	syncDrift    *prometheus.GaugeVec
+}
+
+func NewCollector(namespace string) *Collector {
+	return &Collector{
+		giveSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "nonce",
+			Name:      "give_seconds",
+			Help:      "Time taken to give a nonce, waiting for other holders included.",
+			Buckets:   []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 30, 60},
+		}, []string{"address", "result"}),
+		contentions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "nonce",
+			Name:      "contentions_total",
+			Help:      "Times a nonce asked while others held it.",
+		}, []string{"address"}),
+		leaseExpired: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "nonce",
+			Name:      "lease_expired_total",
+			Help:      "Times a holder came back after its lease ran out.",
+		}, []string{"address"}),
+		syncs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "nonce",
+			Name:      "syncs_total",
+			Help:      "Syncs with chain pending nonce.",
+		}, []string{"address", "result"}),
+		syncDrift: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "nonce",
+			Name:      "sync_drift",
+			Help:      "Chain pending nonce minus stored nonce at last successful sync.",
+		}, []string{"address"}),
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.giveSeconds.Describe(ch)
+	c.contentions.Describe(ch)
+	c.leaseExpired.Describe(ch)
+	c.syncs.Describe(ch)
+	c.syncDrift.Describe(ch)
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.giveSeconds.Collect(ch)
+	c.contentions.Collect(ch)
+	c.leaseExpired.Collect(ch)
+	c.syncs.Collect(ch)
+	c.syncDrift.Collect(ch)
+}
+
+func (c *Collector) OnGive(ctx context.Context, addr common.Address, nonce uint64, wait time.Duration, err error) {
+	c.giveSeconds.WithLabelValues(label(addr), result(err)).Observe(wait.Seconds())
+}
+
+func (c *Collector) OnContention(ctx context.Context, addr common.Address) {
+	c.contentions.WithLabelValues(label(addr)).Inc()
+}
+
+func (c *Collector) OnLeaseExpired(ctx context.Context, addr common.Address, nonce uint64, held time.Duration) {
+	c.leaseExpired.WithLabelValues(label(addr)).Inc()
+}
+
+func (c *Collector) OnSync(ctx context.Context, addr common.Address, stored, chain uint64, err error) {
+	c.syncs.WithLabelValues(label(addr), result(err)).Inc()
+	if err == nil {
+		c.syncDrift.WithLabelValues(label(addr)).Set(float64(chain) - float64(stored))
+	}
+}
+
+func label(addr common.Address) string {
+	return strings.ToLower(addr.Hex())
+}
+
+// result keeps label values few
+func result(err error) string {
+	switch err {
+	case nil:
+		return "ok"
+	case ethnonce.ErrOtherHoldNonce, context.DeadlineExceeded:
+		return "busy"
+	case ethnonce.ErrNotInitAddress:
+		return "not_init"
+	case context.Canceled:
+		return "canceled"
+	default:
+		return "error"
+	}
+}
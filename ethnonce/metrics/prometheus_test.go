@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/qjpcpu/ethereum/ethnonce"
+	"testing"
+	"time"
+)
+
+var testAddr = common.HexToAddress(`0xe35f3e2a93322b61e5d8931f806ff38f4a4f4d88`)
+
+func TestCollector(t *testing.T) {
+	c := NewCollector("test")
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	c.OnGive(ctx, testAddr, 1, time.Millisecond, nil)
+	c.OnGive(ctx, testAddr, 0, time.Second, ethnonce.ErrOtherHoldNonce)
+	c.OnContention(ctx, testAddr)
+	c.OnContention(ctx, testAddr)
+	c.OnLeaseExpired(ctx, testAddr, 1, time.Minute)
+	c.OnSync(ctx, testAddr, 5, 3, nil)
+	c.OnSync(ctx, testAddr, 3, 9, errors.New("boom"))
+	label := "0xe35f3e2a93322b61e5d8931f806ff38f4a4f4d88"
+	if v := testutil.ToFloat64(c.contentions.WithLabelValues(label)); v != 2 {
+		t.Fatal("bad contentions", v)
+	}
+	if v := testutil.ToFloat64(c.leaseExpired.WithLabelValues(label)); v != 1 {
+		t.Fatal("bad lease expired", v)
+	}
+	if v := testutil.ToFloat64(c.syncDrift.WithLabelValues(label)); v != -2 {
+		t.Fatal("drift should be of last successful sync", v)
+	}
+	if n := testutil.CollectAndCount(c, "test_nonce_give_seconds"); n != 2 {
+		t.Fatal("should have ok and busy series", n)
+	}
+	if _, err := reg.Gather(); err != nil {
+		t.Fatal(err)
+	}
+}
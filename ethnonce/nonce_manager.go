@@ -1,85 +1,299 @@
 package ethnonce
 
 import (
+	"context"
 	"errors"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/qjpcpu/log"
-	"strings"
+	"math/big"
 	"time"
 )
 
 var (
 	ErrNotInitAddress = errors.New("not initailize")
 	ErrOtherHoldNonce = errors.New("others hold the nonce")
+	ErrLeaseLost      = errors.New("nonce not held any more")
+	ErrNoChainSource  = errors.New("no chain nonce source")
 )
 
+// ChainNonceSource tells pending nonce of an address, *ethclient.Client,
+// backends.SimulatedBackend, or any custom client will do
+type ChainNonceSource interface {
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+}
+
 type ManagerCreator interface {
-	SetEthClient(*ethclient.Client) ManagerCreator
+	// SyncNonce asks the source for pending nonce
+	SetEthClient(ChainNonceSource) ManagerCreator
+	// keep nonces of chain id apart from other chains sharing the store,
+	// without it nonces are keyed by address only
+	SetChainID(*big.Int) ManagerCreator
+	// depth is how many nonces of one address can be given out without commit,
+	// default 1 means others wait until the holder commits
+	SetPipeline(depth int) ManagerCreator
+	// how long a given nonce stays reserved without commit or renew,
+	// apply to specified addresses only when any given
+	SetLease(lease time.Duration, addrs ...common.Address) ManagerCreator
 	Build() *NonceManager
 }
 
 type NonceManager struct {
 	Impl NonceManagerLowlevel
+	// set by SetHooks
+	instr *instrument
 }
 
+// NonceManagerLowlevel can't tell holders of a nonce apart, CommitNonce and
+// RenewNonce act on whoever holds it
 type NonceManagerLowlevel interface {
 	PeekNonce(common.Address) uint64
 	GiveNonce(common.Address) (uint64, error)
 	SyncNonce(common.Address) (uint64, error)
 	CommitNonce(common.Address, uint64, bool) error
+	RenewNonce(common.Address, uint64) error
+	Close() error
+}
+
+// NonceManagerLowlevelContext is implemented besides NonceManagerLowlevel by
+// backends honoring context, NonceManager prefers it when Impl has it.
+// Commit or renew of a reservation given to another since fails with ErrLeaseLost.
+type NonceManagerLowlevelContext interface {
+	PeekNonceContext(context.Context, common.Address) uint64
+	GiveNonceContext(context.Context, common.Address) (Reservation, error)
+	SyncNonceContext(context.Context, common.Address) (uint64, error)
+	CommitNonceContext(context.Context, common.Address, Reservation, bool) error
+	RenewNonceContext(context.Context, common.Address, Reservation) error
 	Close() error
 }
 
+// WithContext adapts a backend without context methods, ctx is only checked
+// before each call and reservations carry no token
+func WithContext(impl NonceManagerLowlevel) NonceManagerLowlevelContext {
+	if c, ok := impl.(NonceManagerLowlevelContext); ok {
+		return c
+	}
+	return lowlevelContext{impl}
+}
+
+type lowlevelContext struct {
+	NonceManagerLowlevel
+}
+
+func (l lowlevelContext) PeekNonceContext(ctx context.Context, addr common.Address) uint64 {
+	return l.PeekNonce(addr)
+}
+
+func (l lowlevelContext) GiveNonceContext(ctx context.Context, addr common.Address) (Reservation, error) {
+	if err := ctx.Err(); err != nil {
+		return Reservation{}, err
+	}
+	nonce, err := l.GiveNonce(addr)
+	return Reservation{Nonce: nonce}, err
+}
+
+func (l lowlevelContext) SyncNonceContext(ctx context.Context, addr common.Address) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return l.SyncNonce(addr)
+}
+
+func (l lowlevelContext) CommitNonceContext(ctx context.Context, addr common.Address, res Reservation, success bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return l.CommitNonce(addr, res.Nonce, success)
+}
+
+func (l lowlevelContext) RenewNonceContext(ctx context.Context, addr common.Address, res Reservation) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return l.RenewNonce(addr, res.Nonce)
+}
+
+const (
+	// MustGiveNonce waits at most this long
+	mustGiveTimeout = 60 * time.Second
+	minWaitBackoff  = 50 * time.Millisecond
+	maxWaitBackoff  = 2 * time.Second
+)
+
 func (n *NonceManager) PeekNonce(addr common.Address) uint64 {
-	return n.Impl.PeekNonce(addr)
+	return n.PeekNonceContext(context.Background(), addr)
+}
+
+func (n *NonceManager) PeekNonceContext(ctx context.Context, addr common.Address) uint64 {
+	return WithContext(n.Impl).PeekNonceContext(ctx, addr)
 }
 
 func (n *NonceManager) GiveNonce(addr common.Address) (uint64, error) {
-	return n.Impl.GiveNonce(addr)
+	res, err := n.GiveNonceContext(context.Background(), addr)
+	return res.Nonce, err
+}
+
+// GiveNonceContext reserves a nonce, commit or renew it with the reservation
+// so a holder whose lease expired can't touch the nonce given to another
+func (n *NonceManager) GiveNonceContext(ctx context.Context, addr common.Address) (Reservation, error) {
+	start := time.Now()
+	res, err := n.give(ctx, addr)
+	n.observeGive(ctx, addr, res.Nonce, start, err)
+	return res, err
+}
+
+func (n *NonceManager) give(ctx context.Context, addr common.Address) (Reservation, error) {
+	res, err := WithContext(n.Impl).GiveNonceContext(ctx, addr)
+	switch err {
+	case nil:
+		n.audit(ctx, AuditEntry{Action: AuditGive, Address: addr, Nonce: res.Nonce})
+	case ErrOtherHoldNonce:
+		n.observeContention(ctx, addr)
+	}
+	return res, err
 }
 
 func (n *NonceManager) SyncNonce(addr common.Address) (uint64, error) {
-	return n.Impl.SyncNonce(addr)
+	return n.SyncNonceContext(context.Background(), addr)
+}
+
+func (n *NonceManager) SyncNonceContext(ctx context.Context, addr common.Address) (uint64, error) {
+	observe := n.observeSync(ctx, addr)
+	nonce, err := WithContext(n.Impl).SyncNonceContext(ctx, addr)
+	observe(nonce, err)
+	if err == nil {
+		n.audit(ctx, AuditEntry{Action: AuditSync, Address: addr, Nonce: nonce})
+	}
+	return nonce, err
 }
 
+// CommitNonce commits whoever holds the nonce, CommitNonceContext with the
+// reservation given is safer
 func (n *NonceManager) CommitNonce(addr common.Address, nonce_number uint64, success bool) error {
-	return n.Impl.CommitNonce(addr, nonce_number, success)
+	return n.CommitNonceContext(context.Background(), addr, Reservation{Nonce: nonce_number}, success)
+}
+
+func (n *NonceManager) CommitNonceContext(ctx context.Context, addr common.Address, res Reservation, success bool) error {
+	return n.CommitNonceTx(ctx, addr, res, common.Hash{}, success)
+}
+
+// CommitNonceTx commits and records the tx hash sent with the nonce in audit trail
+func (n *NonceManager) CommitNonceTx(ctx context.Context, addr common.Address, res Reservation, txHash common.Hash, success bool) error {
+	err := WithContext(n.Impl).CommitNonceContext(ctx, addr, res, success)
+	if err == nil || err == ErrLeaseLost {
+		n.observeRelease(ctx, addr, res.Nonce, false, err)
+	}
+	if err == nil {
+		n.audit(ctx, AuditEntry{Action: AuditCommit, Address: addr, Nonce: res.Nonce, TxHash: txHash, Success: success})
+	}
+	return err
+}
+
+// RenewNonce extends the lease of a given nonce, so a slow signer won't lose it
+func (n *NonceManager) RenewNonce(addr common.Address, res Reservation) error {
+	return n.RenewNonceContext(context.Background(), addr, res)
+}
+
+func (n *NonceManager) RenewNonceContext(ctx context.Context, addr common.Address, res Reservation) error {
+	err := WithContext(n.Impl).RenewNonceContext(ctx, addr, res)
+	if err == nil || err == ErrLeaseLost {
+		n.observeRelease(ctx, addr, res.Nonce, true, err)
+	}
+	return err
 }
 
 func (n *NonceManager) Close() error {
 	return n.Impl.Close()
 }
 
+// MustGiveNonce waits up to 60 seconds for others to commit
 func (n *NonceManager) MustGiveNonce(addr common.Address) (uint64, error) {
-	var code uint64
-	var err error
-	for i := 0; i < 600; i++ {
-		code, err = n.Impl.GiveNonce(addr)
-		if err == nil || err == ErrNotInitAddress {
-			break
+	res, err := n.mustGive(addr)
+	return res.Nonce, err
+}
+
+func (n *NonceManager) mustGive(addr common.Address) (Reservation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mustGiveTimeout)
+	defer cancel()
+	res, err := n.WaitNonce(ctx, addr)
+	if err == context.DeadlineExceeded {
+		err = ErrOtherHoldNonce
+	}
+	return res, err
+}
+
+// WaitNonce retries with backoff while others hold the nonce, until ctx done
+func (n *NonceManager) WaitNonce(ctx context.Context, addr common.Address) (res Reservation, err error) {
+	start := time.Now()
+	defer func() { n.observeGive(ctx, addr, res.Nonce, start, err) }()
+	backoff := minWaitBackoff
+	for {
+		res, err = n.give(ctx, addr)
+		if err != ErrOtherHoldNonce {
+			return res, err
+		}
+		select {
+		case <-ctx.Done():
+			return Reservation{}, ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxWaitBackoff {
+			backoff = maxWaitBackoff
 		}
-		// err == ErrOtherHoldNonce
-		<-time.After(100 * time.Millisecond)
 	}
-	return code, err
 }
 
 func (n *NonceManager) GiveNonceForTx(addr common.Address, txJob func(nonce uint64) (*types.Transaction, error)) (*types.Transaction, error) {
-	nonce, err := n.MustGiveNonce(addr)
+	res, err := n.mustGive(addr)
 	if err != nil {
 		return nil, err
 	}
+	return n.doTxJob(context.Background(), addr, res, txJob)
+}
+
+func (n *NonceManager) GiveNonceForTxContext(ctx context.Context, addr common.Address, txJob func(nonce uint64) (*types.Transaction, error)) (*types.Transaction, error) {
+	res, err := n.WaitNonce(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return n.doTxJob(ctx, addr, res, txJob)
+}
+
+// the job may have broadcast tx already, so commit regardless of caller's ctx,
+// job errors are classified by ClassifySendError
+func (n *NonceManager) doTxJob(callerCtx context.Context, addr common.Address, res Reservation, txJob func(nonce uint64) (*types.Transaction, error)) (*types.Transaction, error) {
+	ctx := WithCaller(context.Background(), CallerOf(callerCtx))
+	nonce := res.Nonce
 	if tx, err := txJob(nonce); err != nil {
-		n.Impl.CommitNonce(addr, nonce, false)
-		if strings.Contains(err.Error(), "nonce too low") || strings.Contains(err.Error(), "nonce too high") {
-			new_nonce, _ := n.Impl.SyncNonce(addr)
+		switch ClassifySendError(err) {
+		case SendErrKnownTx:
+			// node got the tx in a former try, the nonce is taken
+			n.CommitNonceContext(ctx, addr, res, true)
+		case SendErrNonceUsed, SendErrNonceGap:
+			n.CommitNonceContext(ctx, addr, res, false)
+			new_nonce, _ := n.SyncNonceContext(ctx, addr)
 			log.Debugf("nonce:%d of %s is [%v], auto sync to %d", nonce, addr.Hex(), err, new_nonce)
+		case SendErrUnknown:
+			// node may have the tx, giving the nonce again may double spend it,
+			// Reconciler resyncs if the tx is lost
+			success := isBroadcastError(err)
+			if success {
+				log.Debugf("nonce:%d of %s is [%v], kept as taken", nonce, addr.Hex(), err)
+			}
+			n.CommitNonceContext(ctx, addr, res, success)
+		default:
+			n.CommitNonceContext(ctx, addr, res, false)
+		}
+		if b, ok := err.(broadcastError); ok {
+			err = b.error
 		}
 		return nil, err
 	} else {
-		n.Impl.CommitNonce(addr, nonce, true)
+		var txHash common.Hash
+		if tx != nil {
+			txHash = tx.Hash()
+		}
+		n.CommitNonceTx(ctx, addr, res, txHash, true)
 		return tx, nil
 	}
 }
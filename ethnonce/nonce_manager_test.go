@@ -0,0 +1,51 @@
+package ethnonce
+
+import (
+	"context"
+	"github.com/ethereum/go-ethereum/common"
+	"testing"
+	"time"
+)
+
+// busyManager always says others hold the nonce until free is set
+type busyManager struct {
+	tries int
+	free  int
+}
+
+func (m *busyManager) PeekNonce(common.Address) uint64 { return 0 }
+func (m *busyManager) GiveNonce(addr common.Address) (uint64, error) {
+	m.tries++
+	if m.free > 0 && m.tries >= m.free {
+		return 7, nil
+	}
+	return 0, ErrOtherHoldNonce
+}
+func (m *busyManager) SyncNonce(common.Address) (uint64, error) { return 0, nil }
+func (m *busyManager) CommitNonce(common.Address, uint64, bool) error {
+	return nil
+}
+func (m *busyManager) RenewNonce(common.Address, uint64) error { return nil }
+func (m *busyManager) Close() error                            { return nil }
+
+func TestWaitNonceDeadline(t *testing.T) {
+	mgr := &NonceManager{Impl: &busyManager{}}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := mgr.WaitNonce(ctx, common.Address{}); err != context.DeadlineExceeded {
+		t.Fatal("should exceed deadline", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("should return soon after deadline")
+	}
+}
+
+func TestWaitNonceBackoff(t *testing.T) {
+	impl := &busyManager{free: 3}
+	mgr := &NonceManager{Impl: impl}
+	res, err := mgr.WaitNonce(context.Background(), common.Address{})
+	if err != nil || res.Nonce != 7 || impl.tries != 3 {
+		t.Fatal("should get nonce after others commit", res, err, impl.tries)
+	}
+}
@@ -0,0 +1,75 @@
+package ethnonce
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"sync"
+	"time"
+)
+
+// DefaultLease is how long a given nonce stays reserved without commit or renew,
+// after that it can be given to others
+const DefaultLease = 60 * time.Second
+
+// Options are the settings every backend shares, set by ManagerCreator
+type Options struct {
+	// how many nonces of one address can be given out without commit
+	Depth int
+	// lease of all addresses, zero means DefaultLease
+	Lease time.Duration
+	// lease of specified addresses, override Lease
+	AddressLease map[common.Address]time.Duration
+	// chain id in keys
+	chain *chainKeying
+}
+
+func NewOptions() Options {
+	return Options{
+		Depth:        1,
+		Lease:        DefaultLease,
+		AddressLease: make(map[common.Address]time.Duration),
+		chain:        &chainKeying{Mutex: new(sync.Mutex)},
+	}
+}
+
+func (o *Options) SetDepth(depth int) {
+	if depth < 1 {
+		depth = 1
+	}
+	o.Depth = depth
+}
+
+// SetLease set lease of all addresses when no address given
+func (o *Options) SetLease(lease time.Duration, addrs ...common.Address) {
+	if len(addrs) == 0 {
+		o.Lease = lease
+		return
+	}
+	if o.AddressLease == nil {
+		o.AddressLease = make(map[common.Address]time.Duration)
+	}
+	for _, addr := range addrs {
+		o.AddressLease[addr] = lease
+	}
+}
+
+func (o *Options) LeaseOf(addr common.Address) time.Duration {
+	if lease, ok := o.AddressLease[addr]; ok && lease > 0 {
+		return lease
+	}
+	if o.Lease > 0 {
+		return o.Lease
+	}
+	return DefaultLease
+}
+
+// LeaseSeconds is the lease in whole seconds, at least 1
+func (o *Options) LeaseSeconds(addr common.Address) int64 {
+	return leaseSeconds(o.LeaseOf(addr))
+}
+
+func leaseSeconds(lease time.Duration) int64 {
+	if sec := int64(lease / time.Second); sec > 0 {
+		return sec
+	}
+	return 1
+}
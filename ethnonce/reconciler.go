@@ -0,0 +1,330 @@
+package ethnonce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/qjpcpu/ethereum/contracts"
+	"math/big"
+	"sync"
+	"time"
+)
+
+var ErrStoredNotSupported = errors.New("stored nonce not readable")
+
+type ReconcileKind int
+
+const (
+	// stored nonce ahead of chain pending nonce, txs committed were dropped
+	ReconcileGap ReconcileKind = iota
+	// mined nonce not moving while txs pending, reported only: the stuck tx
+	// is not replaced, resend it with higher gas price to recover
+	ReconcileStuck
+	// stored nonce reset to chain pending nonce
+	ReconcileResync
+	// a gap nonce taken by filler transaction
+	ReconcileFill
+	ReconcileError
+)
+
+func (k ReconcileKind) String() string {
+	switch k {
+	case ReconcileGap:
+		return "gap"
+	case ReconcileStuck:
+		return "stuck"
+	case ReconcileResync:
+		return "resync"
+	case ReconcileFill:
+		return "fill"
+	default:
+		return "error"
+	}
+}
+
+type ReconcileEvent struct {
+	Kind    ReconcileKind
+	Address common.Address
+	// next nonce never given out by manager
+	Stored uint64
+	// chain pending and latest mined nonce
+	Pending uint64
+	Mined   uint64
+	// nonce filled, and the filler tx
+	Nonce uint64
+	Tx    *types.Transaction
+	Err   error
+}
+
+func (evt ReconcileEvent) String() string {
+	return fmt.Sprintf(
+		`%s address: %s,stored: %d,pending: %d,mined: %d,nonce: %d,err: %v`,
+		evt.Kind,
+		evt.Address.Hex(),
+		evt.Stored,
+		evt.Pending,
+		evt.Mined,
+		evt.Nonce,
+		evt.Err,
+	)
+}
+
+// ChainStateReader tells pending and mined nonce, *ethclient.Client will do
+type ChainStateReader interface {
+	ChainNonceSource
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+}
+
+// StoredNonceReader is implemented by backends which tell the next nonce
+// never given out, unlike PeekNonce released gaps are ignored and failures
+// of store are returned
+type StoredNonceReader interface {
+	StoredNonce(ctx context.Context, addr common.Address) (uint64, error)
+}
+
+// StoredNonce of addr, ErrNotInitAddress when never synced
+func (n *NonceManager) StoredNonce(ctx context.Context, addr common.Address) (uint64, error) {
+	reader, ok := n.Impl.(StoredNonceReader)
+	if !ok {
+		return 0, ErrStoredNotSupported
+	}
+	return reader.StoredNonce(ctx, addr)
+}
+
+// GapFiller sends a transaction taking the nonce of from
+type GapFiller func(ctx context.Context, from common.Address, nonce uint64) (*types.Transaction, error)
+
+// SelfTransferFiller fills gap with zero value transfer to from itself
+func SelfTransferFiller(conn *ethclient.Client, signer bind.SignerFn) GapFiller {
+	return func(ctx context.Context, from common.Address, nonce uint64) (*types.Transaction, error) {
+		return contracts.TransferETH(conn, from, from, big.NewInt(0), signer, nonce, nil)
+	}
+}
+
+type reconcileState struct {
+	filler GapFiller
+	// when stored and chain nonce first seen apart, zero means they agree
+	gapSince time.Time
+	// mined nonce and since when it not moved
+	mined       uint64
+	minedSince  time.Time
+	stuckReport bool
+}
+
+// Reconciler compares nonces of manager with chain periodically, resync or
+// fill gaps after they last for stuck timeout. Stuck txs are only reported.
+type Reconciler struct {
+	mgr          *NonceManager
+	chain        ChainStateReader
+	interval     time.Duration
+	stuckTimeout time.Duration
+	eventCh      chan<- ReconcileEvent
+	states       map[common.Address]*reconcileState
+	// one round at a time
+	round *sync.Mutex
+	*sync.Mutex
+}
+
+func (n *NonceManager) NewReconciler(chain ChainStateReader) *Reconciler {
+	return &Reconciler{
+		mgr:          n,
+		chain:        chain,
+		interval:     30 * time.Second,
+		stuckTimeout: 5 * time.Minute,
+		states:       make(map[common.Address]*reconcileState),
+		round:        new(sync.Mutex),
+		Mutex:        new(sync.Mutex),
+	}
+}
+
+// Watch addr, gaps are filled by filler or resync when filler is nil
+func (r *Reconciler) Watch(addr common.Address, filler GapFiller) *Reconciler {
+	r.Lock()
+	defer r.Unlock()
+	r.states[addr] = &reconcileState{filler: filler}
+	return r
+}
+
+func (r *Reconciler) Unwatch(addr common.Address) *Reconciler {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.states, addr)
+	return r
+}
+
+func (r *Reconciler) SetInterval(interval time.Duration) *Reconciler {
+	r.interval = interval
+	return r
+}
+
+// SetStuckTimeout set how long stored and chain nonce stay apart before
+// handled, or a nonce stuck before reported. Should be longer than lease so
+// in-flight nonces are not taken as gaps
+func (r *Reconciler) SetStuckTimeout(timeout time.Duration) *Reconciler {
+	r.stuckTimeout = timeout
+	return r
+}
+
+func (r *Reconciler) SetEventChan(ch chan<- ReconcileEvent) *Reconciler {
+	r.eventCh = ch
+	return r
+}
+
+// Run reconciles every interval until ctx done
+func (r *Reconciler) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		r.ReconcileOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Reconciler) ReconcileOnce(ctx context.Context) {
+	r.round.Lock()
+	defer r.round.Unlock()
+	r.Lock()
+	addrs := make([]common.Address, 0, len(r.states))
+	for addr := range r.states {
+		addrs = append(addrs, addr)
+	}
+	r.Unlock()
+	for _, addr := range addrs {
+		if ctx.Err() != nil {
+			return
+		}
+		r.reconcile(ctx, addr, time.Now())
+	}
+}
+
+func (r *Reconciler) reconcile(ctx context.Context, addr common.Address, now time.Time) {
+	r.Lock()
+	st, ok := r.states[addr]
+	r.Unlock()
+	if !ok {
+		return
+	}
+	evt := ReconcileEvent{Address: addr}
+	var err error
+	if evt.Pending, err = r.chain.PendingNonceAt(ctx, addr); err != nil {
+		r.sendErr(ctx, evt, err)
+		return
+	}
+	if evt.Mined, err = r.chain.NonceAt(ctx, addr, nil); err != nil {
+		r.sendErr(ctx, evt, err)
+		return
+	}
+	r.checkStuck(ctx, st, evt, now)
+
+	evt.Stored, err = r.mgr.StoredNonce(ctx, addr)
+	if err == ErrNotInitAddress {
+		r.resync(ctx, evt)
+		return
+	}
+	if err != nil {
+		// store unreadable, check again next round
+		r.sendErr(ctx, evt, err)
+		return
+	}
+	if evt.Stored == evt.Pending {
+		st.gapSince = time.Time{}
+		return
+	}
+	// nonces in flight or just sent make them apart for a while
+	if st.gapSince.IsZero() {
+		st.gapSince = now
+		return
+	}
+	if now.Sub(st.gapSince) < r.stuckTimeout {
+		return
+	}
+	st.gapSince = time.Time{}
+	if evt.Stored < evt.Pending {
+		// txs sent without manager, stored nonce would be too low
+		r.resync(ctx, evt)
+		return
+	}
+	r.send(ctx, withKind(evt, ReconcileGap))
+	if st.filler == nil {
+		r.resync(ctx, evt)
+	} else {
+		r.fill(ctx, st.filler, evt)
+	}
+}
+
+func (r *Reconciler) checkStuck(ctx context.Context, st *reconcileState, evt ReconcileEvent, now time.Time) {
+	if evt.Mined >= evt.Pending || evt.Mined != st.mined || st.minedSince.IsZero() {
+		st.mined, st.minedSince, st.stuckReport = evt.Mined, now, false
+		return
+	}
+	if !st.stuckReport && now.Sub(st.minedSince) >= r.stuckTimeout {
+		st.stuckReport = true
+		stuck := withKind(evt, ReconcileStuck)
+		stuck.Nonce = evt.Mined
+		r.send(ctx, stuck)
+	}
+}
+
+func (r *Reconciler) resync(ctx context.Context, evt ReconcileEvent) {
+	nonce, err := r.mgr.SyncNonceContext(ctx, evt.Address)
+	if err != nil {
+		r.sendErr(ctx, evt, err)
+		return
+	}
+	resynced := withKind(evt, ReconcileResync)
+	resynced.Nonce = nonce
+	r.send(ctx, resynced)
+}
+
+// fill missing nonces one by one, chain pending nonce tells the next missing one
+func (r *Reconciler) fill(ctx context.Context, filler GapFiller, evt ReconcileEvent) {
+	for nonce := evt.Pending; nonce < evt.Stored; {
+		tx, err := filler(ctx, evt.Address, nonce)
+		if err != nil {
+			r.sendErr(ctx, evt, err)
+			return
+		}
+		filled := withKind(evt, ReconcileFill)
+		filled.Nonce, filled.Tx = nonce, tx
+		r.send(ctx, filled)
+		next, err := r.chain.PendingNonceAt(ctx, evt.Address)
+		if err != nil {
+			r.sendErr(ctx, evt, err)
+			return
+		}
+		if next <= nonce {
+			// filler not in pool yet, check next round
+			return
+		}
+		nonce = next
+	}
+}
+
+func (r *Reconciler) sendErr(ctx context.Context, evt ReconcileEvent, err error) {
+	evt = withKind(evt, ReconcileError)
+	evt.Err = err
+	r.send(ctx, evt)
+}
+
+func (r *Reconciler) send(ctx context.Context, evt ReconcileEvent) {
+	if r.eventCh == nil {
+		return
+	}
+	select {
+	case r.eventCh <- evt:
+	case <-ctx.Done():
+	}
+}
+
+func withKind(evt ReconcileEvent, kind ReconcileKind) ReconcileEvent {
+	evt.Kind = kind
+	return evt
+}
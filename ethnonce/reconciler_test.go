@@ -0,0 +1,184 @@
+package ethnonce
+
+import (
+	"context"
+	"errors"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// stateManager keeps one address in memory
+type stateManager struct {
+	state *AddressState
+	chain *fakeChainState
+	// StoredNonce fails with it when set
+	storeErr error
+}
+
+func (m *stateManager) PeekNonce(common.Address) uint64 { return m.state.Peek() }
+func (m *stateManager) StoredNonce(context.Context, common.Address) (uint64, error) {
+	if m.storeErr != nil {
+		return 0, m.storeErr
+	}
+	return m.state.Nonce, nil
+}
+func (m *stateManager) GiveNonce(addr common.Address) (uint64, error) {
+	res, err := m.state.Give(time.Now().Unix(), 1, DefaultLease)
+	return res.Nonce, err
+}
+func (m *stateManager) SyncNonce(addr common.Address) (uint64, error) {
+	return m.chain.pending, m.state.Sync(m.chain.pending, time.Now().Unix(), DefaultLease)
+}
+func (m *stateManager) CommitNonce(addr common.Address, nonce uint64, ok bool) error {
+	return m.state.Commit(Reservation{Nonce: nonce}, ok)
+}
+func (m *stateManager) RenewNonce(common.Address, uint64) error { return nil }
+func (m *stateManager) Close() error                            { return nil }
+
+type fakeChainState struct {
+	pending, mined uint64
+}
+
+func (c *fakeChainState) PendingNonceAt(context.Context, common.Address) (uint64, error) {
+	return c.pending, nil
+}
+
+func (c *fakeChainState) NonceAt(context.Context, common.Address, *big.Int) (uint64, error) {
+	return c.mined, nil
+}
+
+func newTestReconciler(stored, pending, mined uint64) (*Reconciler, *fakeChainState, *stateManager, chan ReconcileEvent) {
+	chain := &fakeChainState{pending: pending, mined: mined}
+	impl := &stateManager{state: NewAddressState(stored), chain: chain}
+	ch := make(chan ReconcileEvent, 100)
+	r := (&NonceManager{Impl: impl}).NewReconciler(chain).SetStuckTimeout(time.Minute).SetEventChan(ch)
+	return r, chain, impl, ch
+}
+
+func expectEvents(t *testing.T, ch chan ReconcileEvent, kinds ...ReconcileKind) []ReconcileEvent {
+	var evts []ReconcileEvent
+	for _, kind := range kinds {
+		select {
+		case evt := <-ch:
+			if evt.Kind != kind {
+				t.Fatalf("expect %s event, got %s", kind, evt)
+			}
+			evts = append(evts, evt)
+		default:
+			t.Fatalf("expect %s event, got none", kind)
+		}
+	}
+	select {
+	case evt := <-ch:
+		t.Fatal("unexpected event", evt)
+	default:
+	}
+	return evts
+}
+
+func TestReconcileChainAhead(t *testing.T) {
+	r, _, impl, ch := newTestReconciler(5, 8, 8)
+	addr := common.Address{}
+	r.Watch(addr, nil)
+	now := time.Now()
+	r.reconcile(context.Background(), addr, now)
+	expectEvents(t, ch)
+	r.reconcile(context.Background(), addr, now.Add(time.Minute))
+	expectEvents(t, ch, ReconcileResync)
+	if impl.state.Peek() != 8 {
+		t.Fatal("should resync", impl.state.Peek())
+	}
+}
+
+func TestReconcileStoreError(t *testing.T) {
+	r, _, impl, ch := newTestReconciler(5, 8, 8)
+	addr := common.Address{}
+	r.Watch(addr, nil)
+	impl.storeErr = errors.New("store down")
+	now := time.Now()
+	r.reconcile(context.Background(), addr, now)
+	r.reconcile(context.Background(), addr, now.Add(time.Minute))
+	expectEvents(t, ch, ReconcileError, ReconcileError)
+	if impl.state.Peek() != 5 {
+		t.Fatal("should not resync while store unreadable", impl.state.Peek())
+	}
+	// not synced yet, no grace needed
+	impl.storeErr = ErrNotInitAddress
+	r.reconcile(context.Background(), addr, now.Add(2*time.Minute))
+	expectEvents(t, ch, ReconcileResync)
+}
+
+func TestReconcileInFlight(t *testing.T) {
+	r, _, impl, ch := newTestReconciler(5, 5, 5)
+	addr := common.Address{}
+	r.Watch(addr, nil)
+	// nonce 5 released and 6 in flight, stored ahead of chain for a while
+	res, _ := impl.state.Give(time.Now().Unix(), 2, DefaultLease)
+	impl.state.Give(time.Now().Unix(), 2, DefaultLease)
+	impl.state.Commit(res, false)
+	now := time.Now()
+	r.reconcile(context.Background(), addr, now)
+	r.reconcile(context.Background(), addr, now.Add(30*time.Second))
+	expectEvents(t, ch)
+	if impl.state.Peek() != 5 || impl.state.Nonce != 7 {
+		t.Fatal("should keep state", impl.state.Peek(), impl.state.Nonce)
+	}
+}
+
+func TestReconcileGapResync(t *testing.T) {
+	r, _, impl, ch := newTestReconciler(8, 5, 5)
+	addr := common.Address{}
+	r.Watch(addr, nil)
+	now := time.Now()
+	r.reconcile(context.Background(), addr, now)
+	r.reconcile(context.Background(), addr, now.Add(30*time.Second))
+	expectEvents(t, ch)
+	r.reconcile(context.Background(), addr, now.Add(time.Minute))
+	expectEvents(t, ch, ReconcileGap, ReconcileResync)
+	if impl.state.Peek() != 5 {
+		t.Fatal("should resync", impl.state.Peek())
+	}
+}
+
+func TestReconcileGapFill(t *testing.T) {
+	r, chain, impl, ch := newTestReconciler(8, 5, 5)
+	addr := common.Address{}
+	var filled []uint64
+	r.Watch(addr, func(ctx context.Context, from common.Address, nonce uint64) (*types.Transaction, error) {
+		filled = append(filled, nonce)
+		chain.pending = nonce + 1
+		return new(types.Transaction), nil
+	})
+	now := time.Now()
+	r.reconcile(context.Background(), addr, now)
+	r.reconcile(context.Background(), addr, now.Add(time.Minute))
+	expectEvents(t, ch, ReconcileGap, ReconcileFill, ReconcileFill, ReconcileFill)
+	if len(filled) != 3 || filled[0] != 5 || filled[2] != 7 {
+		t.Fatal("should fill 5~7", filled)
+	}
+	if impl.state.Peek() != 8 {
+		t.Fatal("stored nonce should not change", impl.state.Peek())
+	}
+}
+
+func TestReconcileStuck(t *testing.T) {
+	r, chain, _, ch := newTestReconciler(8, 8, 6)
+	addr := common.Address{}
+	r.Watch(addr, nil)
+	now := time.Now()
+	r.reconcile(context.Background(), addr, now)
+	r.reconcile(context.Background(), addr, now.Add(time.Minute))
+	evts := expectEvents(t, ch, ReconcileStuck)
+	if evts[0].Nonce != 6 {
+		t.Fatal("nonce 6 should be stuck", evts[0])
+	}
+	// report once
+	r.reconcile(context.Background(), addr, now.Add(2*time.Minute))
+	expectEvents(t, ch)
+	chain.mined = 7
+	r.reconcile(context.Background(), addr, now.Add(3*time.Minute))
+	expectEvents(t, ch)
+}
@@ -0,0 +1,202 @@
+package ethnonce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/qjpcpu/ethereum/contracts"
+	"math/big"
+	"strings"
+)
+
+var ErrNoSigner = errors.New("no signer")
+
+// SendErrorKind tells what a broadcast error means for the nonce
+type SendErrorKind int
+
+const (
+	// not sure whether node got the tx, e.g. network error
+	SendErrUnknown SendErrorKind = iota
+	// node refused the tx before taking its nonce, e.g. insufficient funds
+	SendErrRejected
+	// nonce taken by other tx already: nonce too low, replacement underpriced
+	SendErrNonceUsed
+	// nonce ahead of chain
+	SendErrNonceGap
+	// node has the very tx already
+	SendErrKnownTx
+)
+
+func (k SendErrorKind) String() string {
+	switch k {
+	case SendErrRejected:
+		return "rejected"
+	case SendErrNonceUsed:
+		return "nonce used"
+	case SendErrNonceGap:
+		return "nonce gap"
+	case SendErrKnownTx:
+		return "known tx"
+	default:
+		return "unknown"
+	}
+}
+
+var sendErrorPatterns = []struct {
+	pattern string
+	kind    SendErrorKind
+}{
+	{"nonce too low", SendErrNonceUsed},
+	{"replacement transaction underpriced", SendErrNonceUsed},
+	{"nonce too high", SendErrNonceGap},
+	{"known transaction", SendErrKnownTx},
+	{"already known", SendErrKnownTx},
+	{"insufficient funds", SendErrRejected},
+	{"intrinsic gas too low", SendErrRejected},
+	{"exceeds block gas limit", SendErrRejected},
+	{"transaction underpriced", SendErrRejected},
+	{"gas required exceeds allowance", SendErrRejected},
+	{"oversized data", SendErrRejected},
+	{"negative value", SendErrRejected},
+	{"invalid sender", SendErrRejected},
+}
+
+// BroadcastError marks err of a tx job as returned by broadcasting the tx,
+// when unknown the node may have the tx, so the nonce is kept as taken and
+// left to Reconciler, other job errors give the nonce again
+func BroadcastError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return broadcastError{err}
+}
+
+type broadcastError struct {
+	error
+}
+
+func isBroadcastError(err error) bool {
+	_, ok := err.(broadcastError)
+	return ok
+}
+
+// ClassifySendError matches error text of geth tx pool, nil error is unknown
+func ClassifySendError(err error) SendErrorKind {
+	if err == nil {
+		return SendErrUnknown
+	}
+	msg := strings.ToLower(err.Error())
+	for _, p := range sendErrorPatterns {
+		if strings.Contains(msg, p.pattern) {
+			return p.kind
+		}
+	}
+	return SendErrUnknown
+}
+
+// Sender gives nonce of from, signs and broadcasts tx with it, then commits
+// or resyncs the nonce by the result
+type Sender struct {
+	mgr    *NonceManager
+	conn   *ethclient.Client
+	from   common.Address
+	signer bind.SignerFn
+	// nil asks node for every tx
+	gasPrice *big.Int
+	// 0 estimates for every tx
+	gasLimit uint64
+}
+
+func NewSender(mgr *NonceManager, conn *ethclient.Client, from common.Address, signer bind.SignerFn) *Sender {
+	return &Sender{
+		mgr:    mgr,
+		conn:   conn,
+		from:   from,
+		signer: signer,
+	}
+}
+
+// NewSenderFromOpts takes from, signer, gas price and gas limit of builder
+func NewSenderFromOpts(mgr *NonceManager, conn *ethclient.Client, builder *contracts.TxOptsBuilder) (*Sender, error) {
+	if builder.Err != nil {
+		return nil, builder.Err
+	}
+	opts := builder.Get()
+	if opts.Signer == nil {
+		return nil, ErrNoSigner
+	}
+	s := NewSender(mgr, conn, opts.From, opts.Signer)
+	s.gasPrice = opts.GasPrice
+	s.gasLimit = opts.GasLimit
+	return s, nil
+}
+
+func (s *Sender) SetGasPrice(price *big.Int) *Sender {
+	s.gasPrice = price
+	return s
+}
+
+func (s *Sender) SetGasLimit(limit uint64) *Sender {
+	s.gasLimit = limit
+	return s
+}
+
+func (s *Sender) From() common.Address {
+	return s.from
+}
+
+// Send waits up to 60 seconds for nonce like MustGiveNonce
+func (s *Sender) Send(to common.Address, value *big.Int, data []byte) (*types.Transaction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mustGiveTimeout)
+	defer cancel()
+	tx, err := s.SendContext(ctx, to, value, data)
+	if err == context.DeadlineExceeded {
+		err = ErrOtherHoldNonce
+	}
+	return tx, err
+}
+
+// SendContext waits for nonce until ctx done, the tx is sent with nonce given
+// and the nonce committed by ClassifySendError of broadcast error
+func (s *Sender) SendContext(ctx context.Context, to common.Address, value *big.Int, data []byte) (*types.Transaction, error) {
+	if s.signer == nil {
+		return nil, ErrNoSigner
+	}
+	return s.mgr.GiveNonceForTxContext(ctx, s.from, func(nonce uint64) (*types.Transaction, error) {
+		return s.sendTx(ctx, nonce, to, value, data)
+	})
+}
+
+// sendTx signs and sends with nonce as is, 0 included
+func (s *Sender) sendTx(ctx context.Context, nonce uint64, to common.Address, value *big.Int, data []byte) (*types.Transaction, error) {
+	gasPrice := s.gasPrice
+	if gasPrice == nil {
+		gp, err := s.conn.SuggestGasPrice(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve gas price: %v", err)
+		}
+		gasPrice = gp
+	}
+	gasLimit := s.gasLimit
+	if gasLimit == 0 {
+		var err error
+		gasLimit, err = s.conn.EstimateGas(ctx, ethereum.CallMsg{From: s.from, To: &to, Value: value, Data: data})
+		if err != nil {
+			return nil, err
+		}
+	}
+	rawTx := types.NewTransaction(nonce, to, value, gasLimit, gasPrice, data)
+	signedTx, err := s.signer(types.HomesteadSigner{}, s.from, rawTx)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.conn.SendTransaction(ctx, signedTx); err != nil {
+		return nil, BroadcastError(err)
+	}
+	return signedTx, nil
+}
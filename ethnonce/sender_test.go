@@ -0,0 +1,120 @@
+package ethnonce
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rlp"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClassifySendError(t *testing.T) {
+	cases := map[string]SendErrorKind{
+		"nonce too low":                                    SendErrNonceUsed,
+		"replacement transaction underpriced":              SendErrNonceUsed,
+		"nonce too high":                                   SendErrNonceGap,
+		"known transaction: 8c3f":                          SendErrKnownTx,
+		"already known":                                    SendErrKnownTx,
+		"insufficient funds for gas * price + value":       SendErrRejected,
+		"transaction underpriced":                          SendErrRejected,
+		"Post https://node: dial tcp: i/o timeout":         SendErrUnknown,
+		"gas required exceeds allowance or always failing": SendErrRejected,
+	}
+	for msg, kind := range cases {
+		if got := ClassifySendError(errors.New(msg)); got != kind {
+			t.Errorf("%s should be %s, got %s", msg, kind, got)
+		}
+	}
+	if ClassifySendError(nil) != SendErrUnknown {
+		t.Error("nil should be unknown")
+	}
+}
+
+func TestTxJobCommitByError(t *testing.T) {
+	cases := []struct {
+		err       string
+		broadcast bool
+		peek      uint64
+	}{
+		// chain pending 7 is taken after resync
+		{"replacement transaction underpriced", true, 7},
+		{"nonce too low", true, 7},
+		// nonce 5 taken by tx node knows
+		{"known transaction: 8c3f", true, 6},
+		// node may have got the tx
+		{"i/o timeout", true, 6},
+		// nonce 5 given again
+		{"insufficient funds for gas * price + value", true, 5},
+		{"i/o timeout", false, 5},
+	}
+	for _, c := range cases {
+		chain := &fakeChainState{pending: 7}
+		mgr := &NonceManager{Impl: &stateManager{state: NewAddressState(5), chain: chain}}
+		_, err := mgr.GiveNonceForTx(common.Address{}, func(nonce uint64) (*types.Transaction, error) {
+			if c.broadcast {
+				return nil, BroadcastError(errors.New(c.err))
+			}
+			return nil, errors.New(c.err)
+		})
+		if err == nil || err.Error() != c.err || isBroadcastError(err) {
+			t.Fatal("should return job error", err)
+		}
+		if peek := mgr.PeekNonce(common.Address{}); peek != c.peek {
+			t.Errorf("after %s should peek %d, got %d", c.err, c.peek, peek)
+		}
+	}
+}
+
+// rawTxNode answers eth_sendRawTransaction only, keeping txs sent
+func rawTxNode(t *testing.T, sent *[]*types.Transaction) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+			Params []hexutil.Bytes `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Method != "eth_sendRawTransaction" {
+			t.Error("unexpected call", req.Method, err)
+			return
+		}
+		tx := new(types.Transaction)
+		if err := rlp.DecodeBytes(req.Params[0], tx); err != nil {
+			t.Error(err)
+			return
+		}
+		*sent = append(*sent, tx)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": tx.Hash()})
+	}))
+}
+
+func TestSenderFirstNonce(t *testing.T) {
+	var sent []*types.Transaction
+	node := rawTxNode(t, &sent)
+	defer node.Close()
+	conn, err := ethclient.Dial(node.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := crypto.GenerateKey()
+	opts := bind.NewKeyedTransactor(key)
+	chain := &fakeChainState{pending: 0}
+	mgr := &NonceManager{Impl: &stateManager{state: NewAddressState(0), chain: chain}}
+	s := NewSender(mgr, conn, opts.From, opts.Signer).SetGasPrice(big.NewInt(1)).SetGasLimit(21000)
+	for i := uint64(0); i < 2; i++ {
+		if _, err = s.Send(common.HexToAddress("0x01"), big.NewInt(1), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sent) != 2 || sent[0].Nonce() != 0 || sent[1].Nonce() != 1 {
+		t.Fatal("should send with nonces given from 0")
+	}
+}
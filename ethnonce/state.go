@@ -0,0 +1,165 @@
+package ethnonce
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sort"
+	"time"
+)
+
+// Reservation is a given nonce, Token tells this give apart from a later give
+// of the same nonce after the lease expired. Zero Token matches any holder,
+// as CommitNonce of NonceManagerLowlevel does.
+type Reservation struct {
+	Nonce uint64
+	Token uint64
+}
+
+// NewToken makes a non zero reservation token, 53 bits at most so json
+// numbers of any language keep it exact
+func NewToken() uint64 {
+	var b [8]byte
+	rand.Read(b[:])
+	if token := binary.BigEndian.Uint64(b[:]) & (1<<53 - 1); token != 0 {
+		return token
+	}
+	return 1
+}
+
+// AddressState is the reservation bookkeeping of one address, backends which
+// can load and save it atomically share these rules
+type AddressState struct {
+	// next nonce never given out
+	Nonce uint64 `json:"nonce"`
+	// reserved nonce => give or renew timestamp(in second)
+	Holds map[uint64]int64 `json:"holds"`
+	// nonces released by failure commit, ascending, all less than Nonce
+	Gaps []uint64 `json:"gaps"`
+	// reserved nonce => token of its holder
+	Tokens map[uint64]uint64 `json:"tokens,omitempty"`
+}
+
+func NewAddressState(nonce uint64) *AddressState {
+	return &AddressState{Nonce: nonce, Holds: make(map[uint64]int64), Tokens: make(map[uint64]uint64)}
+}
+
+// Held tells res is still reserved by its holder
+func (s *AddressState) Held(res Reservation) bool {
+	if _, ok := s.Holds[res.Nonce]; !ok {
+		return false
+	}
+	return res.Token == 0 || s.Tokens[res.Nonce] == res.Token
+}
+
+func (s *AddressState) expired(nonce uint64, now int64, lease time.Duration) bool {
+	return s.Holds[nonce]+leaseSeconds(lease) < now
+}
+
+// LiveHolds counts reservations whose lease not expired yet
+func (s *AddressState) LiveHolds(now int64, lease time.Duration) int {
+	var cnt int
+	for n := range s.Holds {
+		if !s.expired(n, now, lease) {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// Peek returns the nonce next Give would hand out, expired holds excluded
+func (s *AddressState) Peek() uint64 {
+	if len(s.Gaps) > 0 {
+		return s.Gaps[0]
+	}
+	return s.Nonce
+}
+
+// Give reserves the lowest reusable nonce: released gaps and expired holds
+// first, then a fresh one. depth limits the reservations alive at same time.
+func (s *AddressState) Give(now int64, depth int, lease time.Duration) (Reservation, error) {
+	if depth < 1 {
+		depth = 1
+	}
+	if s.Holds == nil {
+		s.Holds = make(map[uint64]int64)
+	}
+	if s.Tokens == nil {
+		s.Tokens = make(map[uint64]uint64)
+	}
+	if s.LiveHolds(now, lease) >= depth {
+		return Reservation{}, ErrOtherHoldNonce
+	}
+	var reuse []uint64
+	reuse = append(reuse, s.Gaps...)
+	for n := range s.Holds {
+		if s.expired(n, now, lease) {
+			reuse = append(reuse, n)
+		}
+	}
+	var nonce uint64
+	if len(reuse) == 0 {
+		nonce = s.Nonce
+		s.Nonce++
+	} else {
+		sort.Slice(reuse, func(i, j int) bool { return reuse[i] < reuse[j] })
+		nonce = reuse[0]
+		s.removeGap(nonce)
+	}
+	res := Reservation{Nonce: nonce, Token: NewToken()}
+	s.Holds[nonce] = now
+	s.Tokens[nonce] = res.Token
+	return res, nil
+}
+
+// Commit finishes a reservation, a failed nonce becomes a gap for next Give.
+// Commit a nonce not reserved by res any more, e.g. its lease expired and it
+// was given to another, fails with ErrLeaseLost.
+func (s *AddressState) Commit(res Reservation, success bool) error {
+	if !s.Held(res) {
+		return ErrLeaseLost
+	}
+	nonce := res.Nonce
+	delete(s.Holds, nonce)
+	delete(s.Tokens, nonce)
+	if success {
+		return nil
+	}
+	s.Gaps = append(s.Gaps, nonce)
+	sort.Slice(s.Gaps, func(i, j int) bool { return s.Gaps[i] < s.Gaps[j] })
+	// drop gaps on top, so Nonce goes back to the lowest unused one
+	for len(s.Gaps) > 0 && s.Gaps[len(s.Gaps)-1]+1 == s.Nonce {
+		s.Nonce--
+		s.Gaps = s.Gaps[:len(s.Gaps)-1]
+	}
+	return nil
+}
+
+// Renew extends the lease of res from now on
+func (s *AddressState) Renew(res Reservation, now int64) error {
+	if !s.Held(res) {
+		return ErrLeaseLost
+	}
+	s.Holds[res.Nonce] = now
+	return nil
+}
+
+// Sync resets to the chain pending nonce, refused while any reservation alive
+func (s *AddressState) Sync(nonce uint64, now int64, lease time.Duration) error {
+	if s.LiveHolds(now, lease) > 0 {
+		return ErrOtherHoldNonce
+	}
+	s.Nonce = nonce
+	s.Holds = make(map[uint64]int64)
+	s.Tokens = make(map[uint64]uint64)
+	s.Gaps = nil
+	return nil
+}
+
+func (s *AddressState) removeGap(nonce uint64) {
+	for i, n := range s.Gaps {
+		if n == nonce {
+			s.Gaps = append(s.Gaps[:i], s.Gaps[i+1:]...)
+			return
+		}
+	}
+}
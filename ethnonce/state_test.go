@@ -0,0 +1,117 @@
+package ethnonce
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"testing"
+	"time"
+)
+
+func TestStateSingleHold(t *testing.T) {
+	s := NewAddressState(5)
+	res, err := s.Give(100, 1, DefaultLease)
+	if err != nil || res.Nonce != 5 || res.Token == 0 {
+		t.Fatal("bad give", res, err)
+	}
+	if _, err = s.Give(101, 1, DefaultLease); err != ErrOtherHoldNonce {
+		t.Fatal("should hold")
+	}
+	s.Commit(res, false)
+	if s.Peek() != 5 || len(s.Gaps) != 0 {
+		t.Fatal("nonce should keep unchanged", s.Peek())
+	}
+	res, _ = s.Give(102, 1, DefaultLease)
+	s.Commit(res, true)
+	if s.Peek() != 6 {
+		t.Fatal("nonce should increased", s.Peek())
+	}
+}
+
+func TestStateHoldTimeout(t *testing.T) {
+	s := NewAddressState(5)
+	s.Give(100, 1, DefaultLease)
+	if _, err := s.Give(100+60, 1, DefaultLease); err != ErrOtherHoldNonce {
+		t.Fatal("should hold")
+	}
+	if err := s.Sync(7, 100+60, DefaultLease); err != ErrOtherHoldNonce {
+		t.Fatal("should not sync while hold")
+	}
+	res, err := s.Give(100+61, 1, DefaultLease)
+	if err != nil || res.Nonce != 5 {
+		t.Fatal("timeout nonce should be given again", res, err)
+	}
+	if err = s.Sync(7, 100+122, DefaultLease); err != nil || s.Peek() != 7 {
+		t.Fatal("should sync", err)
+	}
+}
+
+func TestStatePipeline(t *testing.T) {
+	s := NewAddressState(0)
+	for i := uint64(0); i < 3; i++ {
+		if res, _ := s.Give(100, 3, DefaultLease); res.Nonce != i {
+			t.Fatal("should give consecutive nonce", res.Nonce)
+		}
+	}
+	if _, err := s.Give(100, 3, DefaultLease); err != ErrOtherHoldNonce {
+		t.Fatal("should wait for commit")
+	}
+	s.Commit(Reservation{Nonce: 0}, false)
+	s.Commit(Reservation{Nonce: 1}, false)
+	if s.Peek() != 0 || len(s.Gaps) != 2 {
+		t.Fatal("gaps should be kept", s.Gaps)
+	}
+	if res, _ := s.Give(100, 3, DefaultLease); res.Nonce != 0 {
+		t.Fatal("should reuse lowest gap", res.Nonce)
+	}
+	s.Commit(Reservation{Nonce: 2}, false)
+	if s.Nonce != 1 || len(s.Gaps) != 0 {
+		t.Fatal("gaps on top should be dropped", s.Nonce, s.Gaps)
+	}
+	// not reserved
+	if err := s.Commit(Reservation{Nonce: 9}, true); err != ErrLeaseLost || s.Nonce != 1 {
+		t.Fatal("bad commit", err)
+	}
+}
+
+func TestStateRenew(t *testing.T) {
+	s := NewAddressState(5)
+	lease := 5 * time.Second
+	res, _ := s.Give(100, 1, lease)
+	if err := s.Renew(res, 104); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Give(108, 1, lease); err != ErrOtherHoldNonce {
+		t.Fatal("renewed nonce should be held")
+	}
+	res1, _ := s.Give(110, 1, lease)
+	if res1.Nonce != res.Nonce || res1.Token == res.Token {
+		t.Fatal("expired nonce should be given again with a new token")
+	}
+	// the first holder lost it
+	if err := s.Renew(res, 111); err != ErrLeaseLost {
+		t.Fatal("stale renew should fail", err)
+	}
+	if err := s.Commit(res, false); err != ErrLeaseLost || !s.Held(res1) {
+		t.Fatal("stale commit should fail", err)
+	}
+	s.Commit(res1, true)
+	if err := s.Renew(res1, 111); err != ErrLeaseLost {
+		t.Fatal("should lose lease after commit")
+	}
+}
+
+func TestOptionsLease(t *testing.T) {
+	opts := NewOptions()
+	addr := common.HexToAddress(`0xe35f3e2a93322b61e5d8931f806ff38f4a4f4d88`)
+	if opts.LeaseOf(addr) != DefaultLease {
+		t.Fatal("bad default lease")
+	}
+	opts.SetLease(5 * time.Second)
+	opts.SetLease(10*time.Minute, addr)
+	if opts.LeaseOf(common.Address{}) != 5*time.Second || opts.LeaseOf(addr) != 10*time.Minute {
+		t.Fatal("bad lease")
+	}
+	opts.SetLease(time.Millisecond)
+	if opts.LeaseSeconds(common.Address{}) != 1 {
+		t.Fatal("lease should be at least 1 second")
+	}
+}
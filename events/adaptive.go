@@ -0,0 +1,99 @@
+package events
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultStep       = 1000
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = time.Minute
+	// range grows back when fewer logs than this came out
+	sparseLogs = 1000
+)
+
+// errors of providers refusing a range as too large or too slow to query
+var rangeErrorPatterns = []string{
+	"more than",
+	"too many",
+	"limit exceeded",
+	"response size",
+	"block range",
+	"range too large",
+	"timeout",
+	"timed out",
+}
+
+// isRangeError tells whether a smaller range may get through
+func isRangeError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, p := range rangeErrorPatterns {
+		if strings.Contains(msg, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// rangePolicy sizes ranges between 1 and maxStep blocks beyond from, and
+// backs off exponentially on failures
+type rangePolicy struct {
+	step       uint64
+	maxStep    uint64
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	// since last range got through
+	splits   int
+	failures int
+	retryAt  time.Time
+}
+
+// split halves range [from,to], false when it's too small already
+func (p *rangePolicy) split(from, to uint64) bool {
+	half := (to - from) / 2
+	if half < 1 {
+		return false
+	}
+	p.step = half
+	p.splits++
+	return true
+}
+
+// fail defers next try, the wait doubles for each failure in a row
+func (p *rangePolicy) fail() time.Duration {
+	wait := p.minBackoff
+	for i := 0; i < p.failures && wait < p.maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > p.maxBackoff {
+		wait = p.maxBackoff
+	}
+	p.failures++
+	p.retryAt = time.Now().Add(wait)
+	return wait
+}
+
+func (p *rangePolicy) waiting() bool {
+	return time.Now().Before(p.retryAt)
+}
+
+// succeed grows step when range had few logs and was not just split,
+// returns splits and failures before it got through
+func (p *rangePolicy) succeed(logs int) (int, int) {
+	splits, failures := p.splits, p.failures
+	p.splits, p.failures, p.retryAt = 0, 0, time.Time{}
+	if splits == 0 && logs < sparseLogs && p.step < p.maxStep {
+		if p.step *= 2; p.step > p.maxStep {
+			p.step = p.maxStep
+		}
+	}
+	return splits, failures
+}
@@ -0,0 +1,60 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestIsRangeError(t *testing.T) {
+	for _, err := range []error{
+		errors.New("query returned more than 10000 results"),
+		errors.New("Log response size exceeded"),
+		errors.New("read tcp: i/o timeout"),
+		context.DeadlineExceeded,
+	} {
+		if !isRangeError(err) {
+			t.Fatal("should be range error", err)
+		}
+	}
+	if isRangeError(errors.New("connection refused")) || isRangeError(nil) {
+		t.Fatal("should not be range error")
+	}
+}
+
+func TestRangePolicy(t *testing.T) {
+	p := &rangePolicy{step: 1000, maxStep: 2000, minBackoff: time.Millisecond, maxBackoff: 3 * time.Millisecond}
+	if !p.split(100, 1100) || p.step != 500 || !p.split(100, 600) || p.step != 250 {
+		t.Fatal("should halve range", p.step)
+	}
+	if p.split(100, 101) {
+		t.Fatal("range of 2 blocks can't split")
+	}
+	if splits, _ := p.succeed(10); splits != 2 || p.step != 250 {
+		t.Fatal("should not grow right after split", splits, p.step)
+	}
+	p.succeed(10)
+	if p.step != 500 {
+		t.Fatal("should grow when sparse", p.step)
+	}
+	p.succeed(sparseLogs)
+	if p.step != 500 {
+		t.Fatal("should keep step when dense", p.step)
+	}
+	p.step = 1500
+	p.succeed(0)
+	if p.step != 2000 {
+		t.Fatal("should not exceed max", p.step)
+	}
+
+	if p.fail() != time.Millisecond || p.fail() != 2*time.Millisecond || p.fail() != 3*time.Millisecond {
+		t.Fatal("backoff should double up to max")
+	}
+	if !p.waiting() {
+		t.Fatal("should wait after failure")
+	}
+	if _, failures := p.succeed(0); failures != 3 || p.waiting() {
+		t.Fatal("success should reset backoff", failures)
+	}
+}
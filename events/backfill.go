@@ -0,0 +1,67 @@
+package events
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/qjpcpu/ethereum/swg"
+	"math/big"
+)
+
+// scanRange is blocks [from,to] and what was fetched of them
+type scanRange struct {
+	from, to uint64
+	// hash of block to, set when reorg watched
+	toHash common.Hash
+	logs   []types.Log
+	extras *extras
+	err    error
+	// err came from querying header of to
+	header bool
+}
+
+// planRanges cuts [from,to] by step, into one range unless backfill workers set
+func (es *eventScanner) planRanges(from, to uint64) []scanRange {
+	var ranges []scanRange
+	for len(ranges) == 0 || (len(ranges) < es.workers && from <= to) {
+		end := to
+		if from+es.policy.step < to {
+			end = from + es.policy.step
+		}
+		ranges = append(ranges, scanRange{from: from, to: end})
+		from = end + 1
+	}
+	return ranges
+}
+
+// fetchRanges queries ranges concurrently, results keep the order of ranges
+func (es *eventScanner) fetchRanges(ranges []scanRange) []scanRange {
+	if len(ranges) == 1 {
+		es.fetchRange(&ranges[0])
+		return ranges
+	}
+	wg := swg.New(es.workers)
+	for i := range ranges {
+		wg.Add()
+		go func(rg *scanRange) {
+			defer wg.Done()
+			es.fetchRange(rg)
+		}(&ranges[i])
+	}
+	wg.Wait()
+	return ranges
+}
+
+func (es *eventScanner) fetchRange(rg *scanRange) {
+	// hash of range end taken before logs, a reorg in between shows up next round
+	if es.reorg != nil {
+		header, err := es.conn.HeaderByNumber(es.ctx, new(big.Int).SetUint64(rg.to))
+		if err != nil {
+			rg.err, rg.header = err, true
+			return
+		}
+		rg.toHash = header.Hash()
+	}
+	if rg.logs, rg.err = es.filterLogs(es.queries, rg.from, rg.to); rg.err == nil {
+		rg.extras, rg.err = es.fetchExtras(rg.logs)
+	}
+}
@@ -0,0 +1,106 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPlanRanges(t *testing.T) {
+	es := &eventScanner{policy: rangePolicy{step: 99}}
+	if ranges := es.planRanges(1, 1000); len(ranges) != 1 || ranges[0].to != 100 {
+		t.Fatal("should plan one range without workers", ranges)
+	}
+	es.workers = 4
+	ranges := es.planRanges(1, 250)
+	if len(ranges) != 3 {
+		t.Fatal("should cut into 3 ranges", ranges)
+	}
+	for i, want := range [][2]uint64{{1, 100}, {101, 200}, {201, 250}} {
+		if ranges[i].from != want[0] || ranges[i].to != want[1] {
+			t.Fatal("bad range", i, ranges[i])
+		}
+	}
+	if ranges = es.planRanges(1, 10000); len(ranges) != 4 || ranges[3].to != 400 {
+		t.Fatal("should plan at most workers ranges", ranges)
+	}
+}
+
+func transferLog(cm contractMeta, block uint64, index uint) types.Log {
+	return types.Log{
+		Address:     cm.contract,
+		Topics:      []common.Hash{cm.bc.EventTopic("Transfer"), common.HexToAddress("0x01").Hash(), common.HexToAddress("0x02").Hash()},
+		Data:        common.LeftPadBytes([]byte{1}, 32),
+		BlockNumber: block,
+		BlockHash:   common.BigToHash(new(big.Int).SetUint64(block)),
+		TxHash:      common.BigToHash(new(big.Int).SetUint64(block*100 + uint64(index))),
+		Index:       index,
+	}
+}
+
+func TestFetchRangesInOrder(t *testing.T) {
+	token := common.HexToAddress("0x10")
+	es := tokenScanner(t, token)
+	cm, _ := es.Contracts.GetMeta(token)
+	var mu sync.Mutex
+	var inflight, maxInflight int
+	var finished []uint64
+	node, conn := fakeNode(t, map[string]rpcHandler{
+		"eth_getLogs": func(params []json.RawMessage) (interface{}, error) {
+			var q struct{ FromBlock, ToBlock *hexutil.Big }
+			if err := json.Unmarshal(params[0], &q); err != nil {
+				return nil, err
+			}
+			from, to := q.FromBlock.ToInt().Uint64(), q.ToBlock.ToInt().Uint64()
+			mu.Lock()
+			if inflight++; inflight > maxInflight {
+				maxInflight = inflight
+			}
+			mu.Unlock()
+			// earlier ranges answer later
+			time.Sleep(time.Duration(50-from) * 3 * time.Millisecond)
+			mu.Lock()
+			inflight--
+			finished = append(finished, from)
+			mu.Unlock()
+			return []types.Log{transferLog(cm, from, 0), transferLog(cm, to, 0), transferLog(cm, to, 1)}, nil
+		},
+	})
+	defer node.Close()
+	dataCh := make(chan Event, 100)
+	es.ctx, es.conn, es.DataChan = context.Background(), conn, dataCh
+	es.workers, es.policy.step, es.From = 4, 9, 1
+	es.queries, _ = es.buildQueries()
+
+	for _, rg := range es.fetchRanges(es.planRanges(1, 40)) {
+		if rg.err != nil {
+			t.Fatal(rg.err)
+		}
+		if !es.deliverRange(rg) {
+			t.Fatal("should deliver range", rg.from)
+		}
+	}
+	close(dataCh)
+	if maxInflight < 2 || len(finished) != 4 || finished[3] != 1 {
+		t.Fatal("ranges should be fetched concurrently", maxInflight, finished)
+	}
+	var prev *Event
+	var cnt int
+	for evt := range dataCh {
+		if prev != nil && (evt.BlockNumber < prev.BlockNumber || evt.BlockNumber == prev.BlockNumber && evt.LogIndex <= prev.LogIndex) {
+			t.Fatal("events out of order", prev.BlockNumber, prev.LogIndex, evt.BlockNumber, evt.LogIndex)
+		}
+		evt := evt
+		prev = &evt
+		cnt++
+	}
+	if cnt != 12 || es.From != 41 {
+		t.Fatal("should deliver all ranges", cnt, es.From)
+	}
+}
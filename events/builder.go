@@ -4,33 +4,64 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	ethereum "github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/qjpcpu/common/redo"
 	abi "github.com/qjpcpu/ethereum/mabi"
 	bind "github.com/qjpcpu/ethereum/mabi/mbind"
-	"math/big"
+	"github.com/qjpcpu/log"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Event struct {
 	BlockNumber uint64
+	BlockHash   common.Hash
 	TxHash      common.Hash
+	TxIndex     uint
+	LogIndex    uint
 	Address     common.Address
 	Name        string
 	Data        abi.JSONObj
+	// pointer to struct of the type set by SetEventType, nil otherwise
+	Value interface{}
+	// true retracts an event delivered before, its block is not canonical any more
+	Removed bool
+	// set by SetEnrich
+	BlockTime time.Time
+	From      common.Address
+	// types.ReceiptStatusSuccessful or types.ReceiptStatusFailed
+	TxStatus uint64
+	// decoded from, kept for spill
+	log types.Log
 }
 
 type Progress struct {
 	From uint64
 	To   uint64
+	// range length beyond From of next scan
+	Step uint64
+	// times the range was halved before it got through
+	Splits int
+	// failed tries of the range before it got through
+	Failures int
+	// events dropped by SlowDrop so far
+	Dropped uint64
+	// set for range backfilled of contract added by AddContract
+	Contract common.Address
 }
 
 func (evt Event) String() string {
+	var removed string
+	if evt.Removed {
+		removed = "[removed] "
+	}
 	return fmt.Sprintf(
-		`block: %v,tx: %s,address: %s,event: %s,data: %s`,
+		`%sblock: %v,tx: %s,address: %s,event: %s,data: %s`,
+		removed,
 		evt.BlockNumber,
 		evt.TxHash.Hex(),
 		evt.Address.Hex(),
@@ -42,11 +73,13 @@ func (evt Event) String() string {
 type Builder struct {
 	es       *eventScanner
 	interval time.Duration
+	err      error
+	recipet  *redo.Recipet
 }
 
 func NewScanBuilder() *Builder {
 	return &Builder{
-		es: &eventScanner{Contracts: make(contractMap)},
+		es: &eventScanner{ctx: context.Background(), Contracts: make(contractMap), contractsMu: new(sync.RWMutex), changes: newContractChanges(), types: make(eventTypes), filters: make(topicFilters), decoders: make(decoders)},
 	}
 }
 
@@ -55,7 +88,17 @@ func (b *Builder) SetClient(conn *ethclient.Client) *Builder {
 	return b
 }
 
-// set addr to address(0) e.g.common.Address{} to filter any contracts with same abi
+// SetRPCClient scans with ethclient over rc, blocks and receipts of
+// SetEnrich are queried in batches instead of one request each
+func (b *Builder) SetRPCClient(rc *rpc.Client) *Builder {
+	b.es.conn = ethclient.NewClient(rc)
+	b.es.rpc = rc
+	return b
+}
+
+// set addr to address(0) e.g.common.Address{} to filter any contracts with same abi,
+// an event is given by name or by full signature like Transfer(address,address,uint256)
+// when overloaded, Event.Name is as given. Anonymous events need SetDecoder.
 func (b *Builder) SetContract(addr common.Address, abi_str string, evt_name string, evt_names ...string) *Builder {
 	b.es.Contracts[strings.ToLower(addr.Hex())] = contractMeta{
 		contract:  addr,
@@ -65,6 +108,30 @@ func (b *Builder) SetContract(addr common.Address, abi_str string, evt_name stri
 	return b
 }
 
+// SetEventType decodes event evt_name into a new struct of typ's type as
+// Event.Value, typ is a struct or pointer to it. Arguments map to fields the
+// way mbind generated bindings do: `_from` to `From`, a `Raw types.Log`
+// field gets the log. Data is still filled.
+func (b *Builder) SetEventType(evt_name string, typ interface{}) *Builder {
+	st, err := structTypeOf(typ)
+	if err != nil {
+		b.err = fmt.Errorf("type of %s:%v", evt_name, err)
+		return b
+	}
+	b.es.types[evt_name] = st
+	return b
+}
+
+// SetTopicFilter scans event evt_name only when its indexed arguments match,
+// query gives values by indexed position and any of a position's values
+// matches, nil or empty position matches all, e.g. Transfer to one of addrs:
+// SetTopicFilter("Transfer", nil, addrs). Values are converted the way mbind
+// FilterLogs does.
+func (b *Builder) SetTopicFilter(evt_name string, query ...[]interface{}) *Builder {
+	b.es.filters[evt_name] = query
+	return b
+}
+
 func (b *Builder) SetGracefullExit(yes bool) *Builder {
 	b.es.GracefullExit = yes
 	return b
@@ -75,6 +142,28 @@ func (b *Builder) SetBlockMargin(margin uint64) *Builder {
 	return b
 }
 
+// SetReorgDepth watches blocks this far behind the scanned head, events of
+// blocks reorganized are retracted with Removed set before the new ones,
+// e.g. DefaultReorgDepth. Not watched by default or with 0.
+func (b *Builder) SetReorgDepth(depth uint64) *Builder {
+	b.es.reorgDepth = depth
+	return b
+}
+
+// SetCheckpoint saves progress to cp after each range delivered, and scan
+// starts after block saved in cp instead of SetFrom if any
+func (b *Builder) SetCheckpoint(cp Checkpoint) *Builder {
+	b.es.checkpoint = cp
+	return b
+}
+
+// SetBackfillCheckpoint saves backfill progress of contracts added by
+// AddContract to the checkpoint cp returns for each, keep one key per contract
+func (b *Builder) SetBackfillCheckpoint(cp func(contract common.Address) Checkpoint) *Builder {
+	b.es.backfillCheckpoint = cp
+	return b
+}
+
 func (b *Builder) SetFrom(f uint64) *Builder {
 	b.es.From = f
 	return b
@@ -85,6 +174,67 @@ func (b *Builder) SetStep(f uint64) *Builder {
 	return b
 }
 
+// SetMaxStep lets step grow up to max when logs are sparse, default is step
+func (b *Builder) SetMaxStep(max uint64) *Builder {
+	b.es.policy.maxStep = max
+	return b
+}
+
+// SetBackoff waits min after a failed scan and doubles it for each failure
+// in a row up to max, the wait is rounded up to interval
+func (b *Builder) SetBackoff(min, max time.Duration) *Builder {
+	b.es.policy.minBackoff, b.es.policy.maxBackoff = min, max
+	return b
+}
+
+// SetBackfillWorkers queries up to workers ranges of step at once while far
+// behind, events are still delivered in block and log index order
+func (b *Builder) SetBackfillWorkers(workers int) *Builder {
+	b.es.workers = workers
+	return b
+}
+
+// SetLive subscribes logs once caught up with no To, so new events are
+// scanned as soon as mined instead of next interval, polling goes on when
+// subscription is not supported or dropped
+func (b *Builder) SetLive(yes bool) *Builder {
+	b.es.live = yes
+	return b
+}
+
+// SetContext stops scanning when ctx done, RPCs and delivery in flight are
+// cancelled
+func (b *Builder) SetContext(ctx context.Context) *Builder {
+	b.es.ctx = ctx
+	return b
+}
+
+// SetSlowConsumer tells what to do when DataChan is full, default SlowBlock
+func (b *Builder) SetSlowConsumer(policy SlowPolicy) *Builder {
+	b.es.slow = policy
+	return b
+}
+
+// SetSpillFile is where SlowSpill keeps events, the file is truncated on
+// run and removed on Stop
+func (b *Builder) SetSpillFile(file_path string) *Builder {
+	b.es.spillPath = file_path
+	return b
+}
+
+// SetEnrich fetches block time, sender or receipt status of events, recent
+// blocks and receipts are cached
+func (b *Builder) SetEnrich(enrich Enrich) *Builder {
+	b.es.enrich = enrich
+	return b
+}
+
+// SetSink writes events to sink instead of DataChan, closed on Stop
+func (b *Builder) SetSink(sink Sink) *Builder {
+	b.es.sink = sink
+	return b
+}
+
 func (b *Builder) SetTo(f uint64) *Builder {
 	b.es.To = f
 	return b
@@ -109,19 +259,63 @@ func (b *Builder) BuildAndRun() (*redo.Recipet, error) {
 	if err := b.Build(); err != nil {
 		return nil, err
 	}
+	if b.es.slow == SlowSpill {
+		q, err := newSpillQueue(b.es.spillPath)
+		if err != nil {
+			return nil, err
+		}
+		b.es.spill, b.es.pumpDone = q, make(chan struct{})
+		go b.es.pumpSpill()
+	}
 	var recipet *redo.Recipet
 	if b.es.GracefullExit {
 		recipet = redo.PerformSafe(b.es.scan, b.interval)
 	} else {
 		recipet = redo.Perform(b.es.scan, b.interval)
 	}
+	b.recipet = recipet
 	return recipet, nil
 }
 
+// Stop cancels scanning and waits it out, returns the last block whose
+// events are all delivered, scan again after it to miss none
+func (b *Builder) Stop() uint64 {
+	if b.es.cancel != nil {
+		b.es.cancel()
+	}
+	if b.recipet != nil {
+		<-b.recipet.WaitChan()
+	}
+	if b.es.spill != nil {
+		<-b.es.pumpDone
+	}
+	last := b.es.delivered()
+	if b.es.spill != nil {
+		b.es.spill.close()
+	}
+	if b.es.sink != nil {
+		if err := b.es.sink.Close(); err != nil {
+			log.Errorf("close sink fail:%v", err)
+		}
+	}
+	return last
+}
+
+// Dropped counts events dropped by SlowDrop
+func (b *Builder) Dropped() uint64 {
+	return b.es.Dropped()
+}
+
 func (b *Builder) Build() error {
-	if b.es.DataChan == nil {
+	if b.err != nil {
+		return b.err
+	}
+	if b.es.DataChan == nil && b.es.sink == nil {
 		return errors.New("data channel should not be empty")
 	}
+	if b.es.slow == SlowSpill && b.es.spillPath == "" {
+		return errors.New("no spill file")
+	}
 	if b.es.conn == nil {
 		return errors.New("no eth client")
 	}
@@ -136,31 +330,101 @@ func (b *Builder) Build() error {
 	if b.interval == time.Duration(0) {
 		b.interval = time.Second * 3
 	}
+	b.es.interval = b.interval
+	b.es.ctx, b.es.cancel = context.WithCancel(b.es.ctx)
 	if b.es.StepLength == 0 {
-		b.es.StepLength = 1000
+		b.es.StepLength = DefaultStep
 	}
-
-	for key, cm := range b.es.Contracts {
-		if len(cm.evt_names) == 0 {
-			return errors.New("no event names")
+	if b.es.policy.maxStep < b.es.StepLength {
+		b.es.policy.maxStep = b.es.StepLength
+	}
+	b.es.policy.step = b.es.StepLength
+	if b.es.policy.minBackoff <= 0 {
+		b.es.policy.minBackoff = DefaultMinBackoff
+	}
+	if b.es.policy.maxBackoff == 0 {
+		b.es.policy.maxBackoff = DefaultMaxBackoff
+	}
+	if b.es.policy.maxBackoff < b.es.policy.minBackoff {
+		b.es.policy.maxBackoff = b.es.policy.minBackoff
+	}
+	if b.es.reorgDepth > 0 {
+		b.es.reorg = newReorgTracker(b.es.reorgDepth)
+	}
+	if b.es.enrich != 0 {
+		b.es.extraCache = newExtraCache(enrichCacheSize)
+	}
+	if b.es.checkpoint != nil {
+		block, ok, err := b.es.checkpoint.Load()
+		if err != nil {
+			return fmt.Errorf("load checkpoint fail:%v", err)
 		}
-		if cm.abi_str == "" {
-			return errors.New("need ABI")
+		if ok {
+			b.es.From = block + 1
 		}
-		bc, err := bindContract(cm.abi_str, cm.contract, b.es.conn)
+	}
+
+	for key, cm := range b.es.Contracts {
+		cm, err := b.es.bindMeta(cm)
 		if err != nil {
 			return err
 		}
-		cm.bc = bc
 		b.es.Contracts[key] = cm
 	}
+	for name, typ := range b.es.types {
+		var found bool
+		for _, cm := range b.es.Contracts {
+			_, evt, ok := cm.event(name)
+			if !ok || !cm.HasEvent(name) {
+				continue
+			}
+			found = true
+			if err := checkEventType(typ, evt); err != nil {
+				return err
+			}
+		}
+		if !found {
+			return fmt.Errorf("type set for event %s not scanned", name)
+		}
+	}
+	for name := range b.es.filters {
+		var found bool
+		for _, cm := range b.es.Contracts {
+			found = found || cm.HasEvent(name)
+		}
+		if !found {
+			return fmt.Errorf("filter set for event %s not scanned", name)
+		}
+	}
+	queries, err := b.es.buildQueries()
+	if err != nil {
+		return err
+	}
+	b.es.queries = queries
 	return nil
 }
 
+func (es *eventScanner) bindMeta(cm contractMeta) (contractMeta, error) {
+	if len(cm.evt_names) == 0 {
+		return cm, errors.New("no event names")
+	}
+	if cm.abi_str == "" {
+		return cm, errors.New("need ABI")
+	}
+	parsed, err := abi.JSON(strings.NewReader(cm.abi_str))
+	if err != nil {
+		return cm, err
+	}
+	cm.abi = parsed
+	cm.bc = bind.NewBoundContract(cm.contract, parsed, es.conn, es.conn, es.conn)
+	return cm, es.checkEvents(cm)
+}
+
 type contractMeta struct {
 	contract  common.Address
 	abi_str   string
 	evt_names []string
+	abi       abi.ABI
 	bc        *bind.BoundContract
 }
 
@@ -185,16 +449,6 @@ func (cm contractMap) Contracts() []common.Address {
 	return arr
 }
 
-func (cm contractMap) Topics() []common.Hash {
-	var arr []common.Hash
-	for _, e := range cm {
-		for _, evt := range e.evt_names {
-			arr = append(arr, e.bc.EventTopic(evt))
-		}
-	}
-	return arr
-}
-
 func (cm contractMap) GetMeta(addr common.Address) (contractMeta, bool) {
 	meta, ok := cm[strings.ToLower(addr.Hex())]
 	if !ok {
@@ -206,7 +460,10 @@ func (cm contractMap) GetMeta(addr common.Address) (contractMeta, bool) {
 }
 
 type eventScanner struct {
+	// first for 64-bit alignment of atomic
+	dropped       uint64
 	conn          *ethclient.Client
+	rpc           *rpc.Client
 	Contracts     contractMap
 	From          uint64
 	StepLength    uint64
@@ -216,40 +473,86 @@ type eventScanner struct {
 	ProgressChan  chan<- Progress
 	GracefullExit bool
 	marginBlock   uint64
+	reorgDepth    uint64
+	// nil when reorg not watched
+	reorg      *reorgTracker
+	checkpoint Checkpoint
+	types      eventTypes
+	filters    topicFilters
+	decoders   decoders
+	// checkpoint of each backfill, nil when not saved
+	backfillCheckpoint func(common.Address) Checkpoint
+	// built from Contracts and filters
+	queries []logQuery
+	// guards Contracts written by scanning goroutine against other readers
+	contractsMu *sync.RWMutex
+	changes     *contractChanges
+	backfills   []*backfillJob
+	policy      rangePolicy
+	workers     int
+	// live mode, sub is nil while polling
+	live       bool
+	sub        *liveSub
+	subRetryAt time.Time
+	interval   time.Duration
+	ctx        context.Context
+	cancel     context.CancelFunc
+	slow       SlowPolicy
+	enrich     Enrich
+	// set with enrich
+	extraCache *extraCache
+	spillPath  string
+	sink       Sink
+	// events of range waiting for sink
+	batch []Event
+	// set with SlowSpill, pumpDone closed when pump exits
+	spill    *spillQueue
+	pumpDone chan struct{}
 }
 
 func (es *eventScanner) NewestBlockNumber() (uint64, error) {
-	block, err := es.conn.HeaderByNumber(context.Background(), nil)
+	block, err := es.conn.HeaderByNumber(es.ctx, nil)
 	if err != nil {
 		return 0, err
 	}
 	return block.Number.Uint64() - es.marginBlock, nil
 }
 
-func (es *eventScanner) sendErr(err error) {
-	if es.ErrChan != nil && err != nil {
-		es.ErrChan <- err
+func (es *eventScanner) scan(ctx *redo.RedoCtx) {
+	if es.ctx.Err() != nil {
+		es.shutdown()
+		ctx.StopRedo()
+		return
 	}
-}
-
-func (es *eventScanner) sendData(evt Event) {
-	if es.DataChan != nil {
-		es.DataChan <- evt
+	if es.policy.waiting() {
+		return
 	}
-}
-
-func (es *eventScanner) scan(ctx *redo.RedoCtx) {
 	newest_bn, err := es.NewestBlockNumber()
 	if err != nil {
 		// not send this err
 		if !strings.Contains(err.Error(), "got null header for uncle") {
-			es.sendErr(fmt.Errorf("query newest block number fail:%v, will retry later", err))
+			es.sendErr(fmt.Errorf("query newest block number fail:%v, will retry in %v", err, es.policy.fail()))
 		}
 		return
 	}
 	if es.From == 0 {
 		es.From = newest_bn
 	}
+	es.applyChanges()
+	if es.reorg != nil {
+		from, reorged, err := es.checkReorg()
+		if err != nil {
+			es.sendErr(fmt.Errorf("check reorg fail:%v, will retry in %v", err, es.policy.fail()))
+			return
+		}
+		if reorged {
+			es.From = from
+			// retracted events should be scanned again after restart too
+			if from > 0 {
+				es.saveCheckpoint(from - 1)
+			}
+		}
+	}
 	var to_bn uint64
 	if es.To > 0 && es.To < newest_bn {
 		to_bn = es.To
@@ -261,60 +564,160 @@ func (es *eventScanner) scan(ctx *redo.RedoCtx) {
 		return
 	}
 	if to_bn <= es.From {
+		if es.runBackfill() {
+			ctx.StartNextRightNow()
+		} else {
+			es.idle(ctx)
+		}
 		return
 	}
-	if es.From+es.StepLength < to_bn {
-		to_bn = es.From + es.StepLength
+	ranges := es.fetchRanges(es.planRanges(es.From, to_bn))
+	for _, rg := range ranges {
+		if rg.err != nil {
+			es.failRange(ctx, rg)
+			return
+		}
+		if !es.deliverRange(rg) {
+			return
+		}
+	}
+	if last := ranges[len(ranges)-1]; es.runBackfill() || last.to < newest_bn {
+		ctx.StartNextRightNow()
+	} else {
+		es.idle(ctx)
 	}
-	var topics []common.Hash = es.Contracts.Topics()
+}
 
-	fq := ethereum.FilterQuery{
-		FromBlock: new(big.Int).SetUint64(es.From),
-		ToBlock:   new(big.Int).SetUint64(to_bn),
-		Addresses: []common.Address{},
-		Topics:    [][]common.Hash{topics},
+// failRange retries range right away with smaller step if it may help,
+// backs off otherwise
+func (es *eventScanner) failRange(ctx *redo.RedoCtx, rg scanRange) {
+	if rg.header {
+		es.sendErr(fmt.Errorf("query block %v fail:%v, will retry in %v", rg.to, rg.err, es.policy.fail()))
+		return
 	}
-	fq.Addresses = es.Contracts.Contracts()
-	logs, err := es.conn.FilterLogs(context.Background(), fq)
-	if err != nil {
-		es.sendErr(fmt.Errorf("filter log(%v,%v) err:%v, will retry later", es.From, to_bn, err))
+	if isRangeError(rg.err) && es.policy.split(rg.from, rg.to) {
+		es.sendErr(fmt.Errorf("filter log(%v,%v) err:%v, retry with step %v", rg.from, rg.to, rg.err, es.policy.step))
+		ctx.StartNextRightNow()
 		return
 	}
-	for _, lg := range logs {
-		evt := abi.NewJSONObj()
-		cm, ok := es.Contracts.GetMeta(lg.Address)
-		if !ok {
+	es.sendErr(fmt.Errorf("filter log(%v,%v) err:%v, will retry in %v", rg.from, rg.to, rg.err, es.policy.fail()))
+}
+
+// deliverRange sends events of range in order, then moves From beyond it
+func (es *eventScanner) deliverRange(rg scanRange) bool {
+	for _, lg := range rg.logs {
+		if lg.Removed {
+			es.retract(lg)
 			continue
 		}
-		name, err := cm.bc.UnpackMatchedLog(evt, lg)
-		if err != nil {
-			es.sendErr(fmt.Errorf("unpack %s log in tx(%s) fail:%v,abadon", name, lg.TxHash.Hex(), err))
+		event, ok := es.decodeLog(lg)
+		if !ok {
+			es.recordBlock(lg, nil)
 			continue
 		}
-		if !cm.HasEvent(name) {
-			continue
+		rg.extras.fill(&event)
+		es.recordBlock(lg, &event)
+		if !es.emit(event) {
+			// stopped, range not delivered
+			return false
 		}
-		es.sendData(Event{
-			BlockNumber: lg.BlockNumber,
-			TxHash:      lg.TxHash,
-			Address:     lg.Address,
-			Name:        name,
-			Data:        evt,
-		})
-	}
-	if es.ProgressChan != nil {
-		es.ProgressChan <- Progress{From: es.From, To: to_bn}
-	}
-	if to_bn < newest_bn {
-		ctx.StartNextRightNow()
 	}
-	es.From = to_bn + 1
+	if err := es.flush(); err != nil {
+		if es.reorg != nil {
+			es.reorg.rewind(rg.from)
+		}
+		es.sendErr(fmt.Errorf("sink events of (%v,%v) fail:%v, will retry in %v", rg.from, rg.to, err, es.policy.fail()))
+		return false
+	}
+	if es.reorg != nil {
+		es.reorg.record(rg.to, rg.toHash, nil)
+		es.reorg.prune(rg.to)
+		es.extraCache.prune(rg.to, es.reorg.depth)
+	}
+	splits, failures := es.policy.succeed(len(rg.logs))
+	es.From = rg.to + 1
+	es.sendProgress(Progress{From: rg.from, To: rg.to, Step: es.policy.step, Splits: splits, Failures: failures, Dropped: es.Dropped()})
+	es.saveCheckpoint(es.delivered())
+	return true
 }
 
-func bindContract(abi_str string, address common.Address, backend bind.ContractBackend) (*bind.BoundContract, error) {
-	parsed, err := abi.JSON(strings.NewReader(abi_str))
+// decodeLog false when lg is not of events scanned or can't be decoded
+func (es *eventScanner) decodeLog(lg types.Log) (Event, bool) {
+	cm, ok := es.Contracts.GetMeta(lg.Address)
+	if !ok {
+		return Event{}, false
+	}
+	name, evt, ok, err := es.matchLog(cm, lg)
 	if err != nil {
-		return nil, err
+		es.sendErr(fmt.Errorf("unpack %s log in tx(%s) fail:%v,abadon", name, lg.TxHash.Hex(), err))
+		return Event{}, false
+	}
+	if !ok {
+		return Event{}, false
+	}
+	event, err := es.newEvent(cm, name, evt, lg)
+	if err != nil {
+		es.sendErr(fmt.Errorf("decode %s log in tx(%s) fail:%v,abadon", name, lg.TxHash.Hex(), err))
+		return Event{}, false
+	}
+	return event, true
+}
+
+func (es *eventScanner) saveCheckpoint(block uint64) {
+	if es.checkpoint == nil {
+		return
+	}
+	if err := es.checkpoint.Save(block); err != nil {
+		es.sendErr(fmt.Errorf("save checkpoint %v fail:%v", block, err))
+	}
+}
+
+func (es *eventScanner) recordBlock(lg types.Log, evt *Event) {
+	if es.reorg != nil {
+		es.reorg.record(lg.BlockNumber, lg.BlockHash, evt)
+	}
+}
+
+// retract an event node says removed
+func (es *eventScanner) retract(lg types.Log) {
+	cm, ok := es.Contracts.GetMeta(lg.Address)
+	if !ok {
+		return
+	}
+	name, evt, ok, err := es.matchLog(cm, lg)
+	if err != nil || !ok {
+		return
+	}
+	if es.reorg != nil {
+		es.reorg.remove(lg.BlockNumber, lg.Index)
+	}
+	event, err := es.newEvent(cm, name, evt, lg)
+	if err != nil {
+		return
+	}
+	event.Removed = true
+	es.emit(event)
+}
+
+func (es *eventScanner) newEvent(cm contractMeta, name string, data abi.JSONObj, lg types.Log) (Event, error) {
+	event := Event{
+		BlockNumber: lg.BlockNumber,
+		BlockHash:   lg.BlockHash,
+		TxHash:      lg.TxHash,
+		TxIndex:     lg.TxIndex,
+		LogIndex:    lg.Index,
+		Address:     lg.Address,
+		Name:        name,
+		Data:        data,
+		log:         lg,
+	}
+	if typ, ok := es.types[name]; ok {
+		_, evt, _ := cm.event(name)
+		value, err := decodeEvent(typ, evt, data, lg)
+		if err != nil {
+			return event, err
+		}
+		event.Value = value
 	}
-	return bind.NewBoundContract(address, parsed, backend, backend, backend), nil
+	return event, nil
 }
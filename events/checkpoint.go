@@ -0,0 +1,48 @@
+package events
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Checkpoint keeps the last block whose events are all delivered, scan
+// resumes after it on BuildAndRun
+type Checkpoint interface {
+	// ok is false when nothing saved yet
+	Load() (block uint64, ok bool, err error)
+	Save(block uint64) error
+}
+
+// FileCheckpoint keeps block number in a text file
+type FileCheckpoint struct {
+	filePath string
+}
+
+func NewFileCheckpoint(file_path string) *FileCheckpoint {
+	return &FileCheckpoint{filePath: file_path}
+}
+
+func (fc *FileCheckpoint) Load() (uint64, bool, error) {
+	data, err := ioutil.ReadFile(fc.filePath)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	block, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return block, true, nil
+}
+
+func (fc *FileCheckpoint) Save(block uint64) error {
+	// write whole file aside then rename, never leave a half number
+	tmp := fc.filePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatUint(block, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fc.filePath)
+}
@@ -0,0 +1,21 @@
+package events
+
+import (
+	"os"
+	"testing"
+)
+
+func TestFileCheckpoint(t *testing.T) {
+	file := "./scan.checkpoint"
+	defer os.Remove(file)
+	cp := NewFileCheckpoint(file)
+	if _, ok, err := cp.Load(); ok || err != nil {
+		t.Fatal("should have nothing saved", ok, err)
+	}
+	if err := cp.Save(5547930); err != nil {
+		t.Fatal(err)
+	}
+	if block, ok, err := NewFileCheckpoint(file).Load(); !ok || err != nil || block != 5547930 {
+		t.Fatal("should load saved block", block, ok, err)
+	}
+}
@@ -0,0 +1,195 @@
+package events
+
+import (
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	abi "github.com/qjpcpu/ethereum/mabi"
+	"math/big"
+	"reflect"
+	"strings"
+)
+
+var (
+	bigT     = reflect.TypeOf(big.Int{})
+	bigPtrT  = reflect.TypeOf(&big.Int{})
+	addressT = reflect.TypeOf(common.Address{})
+	hashT    = reflect.TypeOf(common.Hash{})
+	logT     = reflect.TypeOf(types.Log{})
+)
+
+// eventTypes maps event name => struct type values decoded into
+type eventTypes map[string]reflect.Type
+
+func structTypeOf(v interface{}) (reflect.Type, error) {
+	typ := reflect.TypeOf(v)
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == nil || typ.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("event type should be struct, not %v", reflect.TypeOf(v))
+	}
+	return typ, nil
+}
+
+// fieldName maps argument to struct field the way mbind generated bindings
+// do: leading underscores trimmed and first letter upper cased
+func fieldName(arg string) string {
+	for len(arg) > 0 && arg[0] == '_' {
+		arg = arg[1:]
+	}
+	if len(arg) == 0 {
+		return ""
+	}
+	return strings.ToUpper(arg[:1]) + arg[1:]
+}
+
+// checkEventType makes sure every named argument of event has a field
+func checkEventType(typ reflect.Type, evt abi.Event) error {
+	for _, arg := range evt.Inputs {
+		name := fieldName(arg.Name)
+		if name == "" {
+			continue
+		}
+		if _, ok := typ.FieldByName(name); !ok {
+			return fmt.Errorf("%v has no field %s for %s.%s", typ, name, evt.Name, arg.Name)
+		}
+	}
+	return nil
+}
+
+// decodeEvent news a struct of typ filled with data unpacked from lg, a
+// Raw types.Log field gets lg like generated bindings
+func decodeEvent(typ reflect.Type, evt abi.Event, data abi.JSONObj, lg types.Log) (interface{}, error) {
+	val := reflect.New(typ)
+	for _, arg := range evt.Inputs {
+		name := fieldName(arg.Name)
+		if name == "" {
+			continue
+		}
+		field := val.Elem().FieldByName(name)
+		if !field.IsValid() || !field.CanSet() {
+			continue
+		}
+		if err := assign(field, data.Get(arg.Name)); err != nil {
+			return nil, fmt.Errorf("field %s: %v", name, err)
+		}
+	}
+	if raw := val.Elem().FieldByName("Raw"); raw.IsValid() && raw.CanSet() && raw.Type() == logT {
+		raw.Set(reflect.ValueOf(lg))
+	}
+	return val.Interface(), nil
+}
+
+// assign src unpacked by mabi to dst, addresses and hashes come as hex strings
+func assign(dst reflect.Value, src interface{}) error {
+	if src == nil {
+		return nil
+	}
+	sv := reflect.ValueOf(src)
+	st, dt := sv.Type(), dst.Type()
+	switch {
+	case st.AssignableTo(dt):
+		dst.Set(sv)
+	case dt.Kind() == reflect.Interface:
+		dst.Set(sv)
+	case st.Kind() == reflect.String && dt == addressT:
+		if !common.IsHexAddress(sv.String()) {
+			return fmt.Errorf("bad address %s", sv.String())
+		}
+		dst.Set(reflect.ValueOf(common.HexToAddress(sv.String())))
+	case st.Kind() == reflect.String && dt == hashT:
+		dst.Set(reflect.ValueOf(common.HexToHash(sv.String())))
+	case st == bigPtrT && dt == bigT:
+		dst.Set(sv.Elem())
+	case st == bigPtrT && isInteger(dt.Kind()):
+		num := src.(*big.Int)
+		if !num.IsInt64() && !num.IsUint64() {
+			return fmt.Errorf("%v overflows %v", num, dt)
+		}
+		return assign(dst, bigToInteger(num, dt.Kind()))
+	case isInteger(st.Kind()) && dt == bigPtrT:
+		dst.Set(reflect.ValueOf(integerToBig(sv)))
+	case isInteger(st.Kind()) && isInteger(dt.Kind()):
+		if overflows(dst, sv) {
+			return fmt.Errorf("%v overflows %v", src, dt)
+		}
+		dst.Set(sv.Convert(dt))
+	case isBytes(st) && isBytes(dt):
+		return assignBytes(dst, sv)
+	case (st.Kind() == reflect.Slice || st.Kind() == reflect.Array) &&
+		(dt.Kind() == reflect.Slice || dt.Kind() == reflect.Array):
+		if dt.Kind() == reflect.Slice {
+			dst.Set(reflect.MakeSlice(dt, sv.Len(), sv.Len()))
+		} else if dst.Len() != sv.Len() {
+			return fmt.Errorf("cannot assign %d elements to %v", sv.Len(), dt)
+		}
+		for i := 0; i < sv.Len(); i++ {
+			if err := assign(dst.Index(i), sv.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+	case dt.Kind() == reflect.Ptr:
+		if dst.IsNil() {
+			dst.Set(reflect.New(dt.Elem()))
+		}
+		return assign(dst.Elem(), src)
+	default:
+		return fmt.Errorf("cannot assign %v to %v", st, dt)
+	}
+	return nil
+}
+
+func isInteger(k reflect.Kind) bool {
+	return (k >= reflect.Int && k <= reflect.Int64) || (k >= reflect.Uint && k <= reflect.Uint64)
+}
+
+func isSigned(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Int64
+}
+
+func isBytes(t reflect.Type) bool {
+	return (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) && t.Elem().Kind() == reflect.Uint8
+}
+
+func overflows(dst, src reflect.Value) bool {
+	switch {
+	case isSigned(src.Kind()) && isSigned(dst.Kind()):
+		return dst.OverflowInt(src.Int())
+	case isSigned(src.Kind()):
+		return src.Int() < 0 || dst.OverflowUint(uint64(src.Int()))
+	case isSigned(dst.Kind()):
+		return src.Uint() > 1<<63-1 || dst.OverflowInt(int64(src.Uint()))
+	default:
+		return dst.OverflowUint(src.Uint())
+	}
+}
+
+func integerToBig(v reflect.Value) *big.Int {
+	if isSigned(v.Kind()) {
+		return big.NewInt(v.Int())
+	}
+	return new(big.Int).SetUint64(v.Uint())
+}
+
+func bigToInteger(num *big.Int, k reflect.Kind) interface{} {
+	if num.Sign() < 0 || (isSigned(k) && num.IsInt64()) {
+		return num.Int64()
+	}
+	return num.Uint64()
+}
+
+// bytes4, bytes32 and bytes come as arrays or slice, fixed size ones must fit
+func assignBytes(dst, src reflect.Value) error {
+	if dst.Kind() == reflect.Slice {
+		buf := reflect.MakeSlice(dst.Type(), src.Len(), src.Len())
+		reflect.Copy(buf, src)
+		dst.Set(buf)
+		return nil
+	}
+	if dst.Len() != src.Len() {
+		return fmt.Errorf("cannot assign %d bytes to %v", src.Len(), dst.Type())
+	}
+	reflect.Copy(dst, src)
+	return nil
+}
@@ -0,0 +1,94 @@
+package events
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	abi "github.com/qjpcpu/ethereum/mabi"
+	bind "github.com/qjpcpu/ethereum/mabi/mbind"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const transferABI = `[{"anonymous":false,"inputs":[{"indexed":true,"name":"_from","type":"address"},{"indexed":true,"name":"_to","type":"address"},{"indexed":false,"name":"_value","type":"uint256"},{"indexed":false,"name":"tag","type":"bytes4"},{"indexed":false,"name":"id","type":"uint64"}],"name":"Transfer","type":"event"}]`
+
+type transferEvent struct {
+	From  common.Address
+	To    common.Address
+	Value *big.Int
+	Tag   [4]byte
+	Id    uint64
+	Raw   types.Log
+}
+
+func TestDecodeEvent(t *testing.T) {
+	parsed, err := abi.JSON(strings.NewReader(transferABI))
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, to := common.HexToAddress("0x01"), common.HexToAddress("0x02")
+	value, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	var data []byte
+	data = append(data, common.LeftPadBytes(value.Bytes(), 32)...)
+	data = append(data, common.RightPadBytes([]byte("abcd"), 32)...)
+	data = append(data, common.LeftPadBytes([]byte{7}, 32)...)
+	lg := types.Log{
+		Topics:      []common.Hash{parsed.Events["Transfer"].Id(), from.Hash(), to.Hash()},
+		Data:        data,
+		BlockNumber: 9,
+	}
+	bc := bind.NewBoundContract(common.Address{}, parsed, nil, nil, nil)
+	obj := abi.NewJSONObj()
+	name, err := bc.UnpackMatchedLog(obj, lg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	typ, err := structTypeOf(&transferEvent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = checkEventType(typ, parsed.Events[name]); err != nil {
+		t.Fatal(err)
+	}
+	v, err := decodeEvent(typ, parsed.Events[name], obj, lg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	evt := v.(*transferEvent)
+	if evt.From != from || evt.To != to || evt.Value.Cmp(value) != 0 || string(evt.Tag[:]) != "abcd" || evt.Id != 7 {
+		t.Fatalf("bad decoded %+v", evt)
+	}
+	if evt.Raw.BlockNumber != 9 {
+		t.Fatal("raw log not set")
+	}
+}
+
+func TestCheckEventType(t *testing.T) {
+	parsed, _ := abi.JSON(strings.NewReader(transferABI))
+	type partial struct {
+		From common.Address
+	}
+	if err := checkEventType(reflect.TypeOf(partial{}), parsed.Events["Transfer"]); err == nil {
+		t.Fatal("should miss field To")
+	}
+	if _, err := structTypeOf(1); err == nil {
+		t.Fatal("should be struct")
+	}
+}
+
+func TestAssign(t *testing.T) {
+	var small uint8
+	if err := assign(reflect.ValueOf(&small).Elem(), big.NewInt(300)); err == nil {
+		t.Fatal("should overflow")
+	}
+	var num *big.Int
+	if err := assign(reflect.ValueOf(&num).Elem(), uint32(5)); err != nil || num.Int64() != 5 {
+		t.Fatal("should widen to big int", num, err)
+	}
+	var addrs []common.Address
+	src := []string{common.HexToAddress("0x03").Hex()}
+	if err := assign(reflect.ValueOf(&addrs).Elem(), src); err != nil || addrs[0] != common.HexToAddress("0x03") {
+		t.Fatal("should assign address slice", addrs, err)
+	}
+}
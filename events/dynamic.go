@@ -0,0 +1,218 @@
+package events
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"strings"
+	"sync"
+)
+
+// contractChange is queued by AddContract or RemoveContract from any
+// goroutine, applied by scanning goroutine between rounds
+type contractChange struct {
+	key    string
+	meta   contractMeta
+	remove bool
+	// backfill from, 0 for none
+	from uint64
+}
+
+type contractChanges struct {
+	list []contractChange
+	*sync.Mutex
+}
+
+func newContractChanges() *contractChanges {
+	return &contractChanges{Mutex: new(sync.Mutex)}
+}
+
+func (cc *contractChanges) push(c contractChange) {
+	cc.Lock()
+	cc.list = append(cc.list, c)
+	cc.Unlock()
+}
+
+func (cc *contractChanges) take() []contractChange {
+	cc.Lock()
+	defer cc.Unlock()
+	list := cc.list
+	cc.list = nil
+	return list
+}
+
+// backfillJob scans blocks [from,to] of a contract added on the run, to is
+// where the cursor of others was when added
+type backfillJob struct {
+	contract common.Address
+	queries  []logQuery
+	from, to uint64
+	step     uint64
+	// nil when backfill progress not saved
+	checkpoint Checkpoint
+}
+
+// AddContract scans contract addr too from next round on, safe while running.
+// With backfill_from > 0 its events since then are scanned besides, a range
+// each round, delivered apart from the ranges of others. The backfill is lost
+// on restart unless SetBackfillCheckpoint, then adding the contract again
+// resumes it after the block saved.
+func (b *Builder) AddContract(addr common.Address, abi_str string, backfill_from uint64, evt_name string, evt_names ...string) error {
+	if addr == (common.Address{}) {
+		return errors.New("can't add zero contract")
+	}
+	if b.es.conn == nil {
+		return errors.New("no eth client")
+	}
+	cm, err := b.es.bindMeta(contractMeta{
+		contract:  addr,
+		abi_str:   abi_str,
+		evt_names: append([]string{evt_name}, evt_names...),
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range cm.evt_names {
+		_, evt, _ := cm.event(name)
+		if typ, ok := b.es.types[name]; ok {
+			if err = checkEventType(typ, evt); err != nil {
+				return err
+			}
+		}
+	}
+	key := strings.ToLower(addr.Hex())
+	if _, err = b.es.queriesOf(contractMap{key: cm}); err != nil {
+		return err
+	}
+	b.es.changes.push(contractChange{key: key, meta: cm, from: backfill_from})
+	return nil
+}
+
+// RemoveContract stops scanning contract addr from next round on, its
+// backfill too, safe while running
+func (b *Builder) RemoveContract(addr common.Address) {
+	b.es.changes.push(contractChange{key: strings.ToLower(addr.Hex()), remove: true})
+}
+
+// applyChanges on scanning goroutine, cursor From set already
+func (es *eventScanner) applyChanges() {
+	changes := es.changes.take()
+	if len(changes) == 0 {
+		return
+	}
+	for _, c := range changes {
+		es.contractsMu.Lock()
+		if c.remove {
+			delete(es.Contracts, c.key)
+		} else if _, ok := es.Contracts[strings.ToLower((common.Address{}).Hex())]; ok {
+			es.contractsMu.Unlock()
+			es.sendErr(fmt.Errorf("add contract %s fail:scanning any contract already", c.meta.contract.Hex()))
+			continue
+		} else {
+			es.Contracts[c.key] = c.meta
+		}
+		es.contractsMu.Unlock()
+		es.dropBackfill(c.key)
+		if !c.remove && c.from > 0 && c.from < es.From {
+			es.addBackfill(c)
+		}
+	}
+	queries, err := es.buildQueries()
+	if err != nil {
+		es.sendErr(fmt.Errorf("apply contract changes fail:%v", err))
+		return
+	}
+	es.queries = queries
+	// subscribed queries are stale
+	if es.sub != nil {
+		es.sub.unsubscribe()
+		es.sub = nil
+	}
+}
+
+// addBackfill up to cursor, resumes after the block saved by its checkpoint
+func (es *eventScanner) addBackfill(c contractChange) {
+	job := &backfillJob{
+		contract: c.meta.contract,
+		from:     c.from,
+		to:       es.From - 1,
+		step:     es.policy.step,
+	}
+	if es.backfillCheckpoint != nil {
+		job.checkpoint = es.backfillCheckpoint(c.meta.contract)
+		block, ok, err := job.checkpoint.Load()
+		if err != nil {
+			es.sendErr(fmt.Errorf("load backfill checkpoint of %s fail:%v, backfill from %v", c.meta.contract.Hex(), err, job.from))
+		} else if ok && block >= job.from {
+			job.from = block + 1
+		}
+	}
+	if job.from > job.to {
+		return
+	}
+	job.queries, _ = es.queriesOf(contractMap{c.key: c.meta})
+	es.backfills = append(es.backfills, job)
+}
+
+func (es *eventScanner) dropBackfill(key string) {
+	jobs := es.backfills[:0]
+	for _, job := range es.backfills {
+		if strings.ToLower(job.contract.Hex()) != key {
+			jobs = append(jobs, job)
+		}
+	}
+	es.backfills = jobs
+}
+
+// runBackfill scans a range of the first backfill, true when some left
+func (es *eventScanner) runBackfill() bool {
+	if len(es.backfills) == 0 {
+		return false
+	}
+	job := es.backfills[0]
+	to := job.to
+	if job.from+job.step < to {
+		to = job.from + job.step
+	}
+	logs, err := es.filterLogs(job.queries, job.from, to)
+	var ex *extras
+	if err == nil {
+		ex, err = es.fetchExtras(logs)
+	}
+	if err != nil {
+		if isRangeError(err) && job.step > 1 {
+			job.step /= 2
+			es.sendErr(fmt.Errorf("backfill %s log(%v,%v) err:%v, retry with step %v", job.contract.Hex(), job.from, to, err, job.step))
+			return true
+		}
+		es.sendErr(fmt.Errorf("backfill %s log(%v,%v) err:%v, will retry later", job.contract.Hex(), job.from, to, err))
+		return false
+	}
+	for _, lg := range logs {
+		if lg.Removed {
+			continue
+		}
+		evt, ok := es.decodeLog(lg)
+		if !ok {
+			continue
+		}
+		ex.fill(&evt)
+		if !es.emit(evt) {
+			return false
+		}
+	}
+	if err = es.flush(); err != nil {
+		es.sendErr(fmt.Errorf("sink backfill %s events of (%v,%v) fail:%v, will retry later", job.contract.Hex(), job.from, to, err))
+		return false
+	}
+	es.sendProgress(Progress{From: job.from, To: to, Step: job.step, Dropped: es.Dropped(), Contract: job.contract})
+	if job.checkpoint != nil {
+		if err = job.checkpoint.Save(to); err != nil {
+			es.sendErr(fmt.Errorf("save backfill checkpoint of %s %v fail:%v", job.contract.Hex(), to, err))
+		}
+	}
+	if job.from = to + 1; job.from > job.to {
+		es.backfills = es.backfills[1:]
+	}
+	return len(es.backfills) > 0
+}
@@ -0,0 +1,77 @@
+package events
+
+import (
+	"context"
+	"github.com/ethereum/go-ethereum/common"
+	"strings"
+	"testing"
+)
+
+func TestApplyChanges(t *testing.T) {
+	token, other := common.HexToAddress("0x10"), common.HexToAddress("0x20")
+	es := tokenScanner(t, token)
+	es.ctx, es.changes, es.From, es.policy.step = context.Background(), newContractChanges(), 500, 100
+	cm, _ := es.Contracts.GetMeta(token)
+	cm.contract = other
+	otherKey := strings.ToLower(other.Hex())
+
+	es.changes.push(contractChange{key: otherKey, meta: cm, from: 200})
+	es.applyChanges()
+	if _, ok := es.Contracts[otherKey]; !ok || len(es.queries) != 1 || len(es.queries[0].addresses) != 2 {
+		t.Fatal("added contract should be queried", es.queries)
+	}
+	if len(es.backfills) != 1 || es.backfills[0].from != 200 || es.backfills[0].to != 499 {
+		t.Fatal("should backfill up to cursor", es.backfills)
+	}
+	if q := es.backfills[0].queries; len(q) != 1 || len(q[0].addresses) != 1 || q[0].addresses[0] != other {
+		t.Fatal("backfill should query added contract only", q)
+	}
+
+	es.changes.push(contractChange{key: otherKey, remove: true})
+	es.applyChanges()
+	if _, ok := es.Contracts[otherKey]; ok || len(es.backfills) != 0 || len(es.queries[0].addresses) != 1 {
+		t.Fatal("removed contract should not be scanned or backfilled")
+	}
+
+	es.changes.push(contractChange{key: otherKey, meta: cm, from: 600})
+	es.applyChanges()
+	if len(es.backfills) != 0 {
+		t.Fatal("nothing to backfill beyond cursor")
+	}
+}
+
+type memCheckpoint struct {
+	block uint64
+	ok    bool
+}
+
+func (cp *memCheckpoint) Load() (uint64, bool, error) { return cp.block, cp.ok, nil }
+func (cp *memCheckpoint) Save(block uint64) error {
+	cp.block, cp.ok = block, true
+	return nil
+}
+
+func TestBackfillCheckpoint(t *testing.T) {
+	token, other := common.HexToAddress("0x10"), common.HexToAddress("0x20")
+	es := tokenScanner(t, token)
+	es.ctx, es.changes, es.From, es.policy.step = context.Background(), newContractChanges(), 500, 100
+	cm, _ := es.Contracts.GetMeta(token)
+	cm.contract = other
+	otherKey := strings.ToLower(other.Hex())
+	saved := map[common.Address]*memCheckpoint{other: {block: 299, ok: true}}
+	es.backfillCheckpoint = func(contract common.Address) Checkpoint { return saved[contract] }
+
+	es.changes.push(contractChange{key: otherKey, meta: cm, from: 200})
+	es.applyChanges()
+	if len(es.backfills) != 1 || es.backfills[0].from != 300 || es.backfills[0].to != 499 {
+		t.Fatal("should resume after block saved", es.backfills)
+	}
+
+	// done before restart
+	saved[other].block = 499
+	es.changes.push(contractChange{key: otherKey, meta: cm, from: 200})
+	es.applyChanges()
+	if len(es.backfills) != 0 {
+		t.Fatal("nothing left to backfill", es.backfills)
+	}
+}
@@ -0,0 +1,421 @@
+package events
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/qjpcpu/ethereum/contracts"
+	"github.com/qjpcpu/ethereum/swg"
+	"sync"
+	"time"
+)
+
+// Enrich tells what to fetch besides logs, combine with |
+type Enrich uint
+
+const (
+	// Event.BlockTime
+	EnrichBlockTime Enrich = 1 << iota
+	// Event.From, whole blocks are fetched to recover senders
+	EnrichSender
+	// Event.TxStatus
+	EnrichReceipt
+)
+
+// at most so many blocks or receipts fetched at once
+const enrichWorkers = 8
+
+// at most so many queries in one batch request with SetRPCClient
+const enrichBatchSize = 100
+
+// at most so many blocks kept in extraCache
+const enrichCacheSize = 256
+
+type blockExtra struct {
+	time time.Time
+	// tx hash => sender
+	senders map[common.Hash]common.Address
+}
+
+// extras of logs in a range, blocks and receipts not in extraCache fetched once
+type extras struct {
+	blocks   map[common.Hash]*blockExtra
+	statuses map[common.Hash]uint64
+}
+
+// cachedBlock is what fetched of a block, kept by hash since it never changes
+type cachedBlock struct {
+	hash   common.Hash
+	number uint64
+	// nil until block fetched
+	extra *blockExtra
+	// tx hash => receipt status
+	statuses map[common.Hash]uint64
+}
+
+// extraCache is a LRU of fetched blocks shared by ranges and backfills,
+// blocks leaving the reorg window are pruned with it, nil caches nothing
+type extraCache struct {
+	size int
+	mu   sync.Mutex
+	// front is the latest used
+	lru    *list.List
+	blocks map[common.Hash]*list.Element
+}
+
+func newExtraCache(size int) *extraCache {
+	return &extraCache{
+		size:   size,
+		lru:    list.New(),
+		blocks: make(map[common.Hash]*list.Element),
+	}
+}
+
+// entry of block, added when create set
+func (c *extraCache) entry(hash common.Hash, number uint64, create bool) *cachedBlock {
+	if elem, ok := c.blocks[hash]; ok {
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*cachedBlock)
+	}
+	if !create {
+		return nil
+	}
+	cb := &cachedBlock{hash: hash, number: number, statuses: make(map[common.Hash]uint64)}
+	c.blocks[hash] = c.lru.PushFront(cb)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+	return cb
+}
+
+func (c *extraCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.blocks, elem.Value.(*cachedBlock).hash)
+}
+
+// block extra having senders of txs when withSenders set
+func (c *extraCache) block(hash common.Hash, txs []common.Hash, withSenders bool) (*blockExtra, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cb := c.entry(hash, 0, false)
+	if cb == nil || cb.extra == nil {
+		return nil, false
+	}
+	if withSenders {
+		for _, tx := range txs {
+			if _, ok := cb.extra.senders[tx]; !ok {
+				return nil, false
+			}
+		}
+	}
+	return cb.extra, true
+}
+
+// putBlock merges senders of b with those cached, the cached extra is never modified
+func (c *extraCache) putBlock(hash common.Hash, number uint64, b *blockExtra) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cb := c.entry(hash, number, true)
+	if cb.extra != nil && len(cb.extra.senders) > 0 {
+		merged := &blockExtra{time: b.time, senders: make(map[common.Hash]common.Address)}
+		for tx, from := range cb.extra.senders {
+			merged.senders[tx] = from
+		}
+		for tx, from := range b.senders {
+			merged.senders[tx] = from
+		}
+		b = merged
+	}
+	cb.extra = b
+}
+
+func (c *extraCache) status(hash, tx common.Hash) (uint64, bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cb := c.entry(hash, 0, false); cb != nil {
+		status, ok := cb.statuses[tx]
+		return status, ok
+	}
+	return 0, false
+}
+
+func (c *extraCache) putStatus(hash common.Hash, number uint64, tx common.Hash, status uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entry(hash, number, true).statuses[tx] = status
+}
+
+// prune blocks depth behind head, as reorgTracker does
+func (c *extraCache) prune(head, depth uint64) {
+	if head < depth {
+		return
+	}
+	c.drop(func(number uint64) bool { return number < head-depth })
+}
+
+// rewind drops blocks from number on, their hashes are not canonical any more
+func (c *extraCache) rewind(number uint64) {
+	c.drop(func(n uint64) bool { return n >= number })
+}
+
+func (c *extraCache) drop(match func(uint64) bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if match(elem.Value.(*cachedBlock).number) {
+			c.remove(elem)
+		}
+		elem = next
+	}
+}
+
+func (ex *extras) fill(evt *Event) {
+	if ex == nil {
+		return
+	}
+	if b, ok := ex.blocks[evt.BlockHash]; ok {
+		evt.BlockTime = b.time
+		evt.From = b.senders[evt.TxHash]
+	}
+	if status, ok := ex.statuses[evt.TxHash]; ok {
+		evt.TxStatus = status
+	}
+}
+
+// fetchExtras of logs by enrich, nil when nothing to enrich
+func (es *eventScanner) fetchExtras(logs []types.Log) (*extras, error) {
+	if es.enrich == 0 || len(logs) == 0 {
+		return nil, nil
+	}
+	ex := &extras{
+		blocks:   make(map[common.Hash]*blockExtra),
+		statuses: make(map[common.Hash]uint64),
+	}
+	// block hash => txs of logs in it, those not cached
+	blocks := make(map[common.Hash][]common.Hash)
+	numbers := make(map[common.Hash]uint64)
+	var receipts []types.Log
+	withSenders := es.enrich&EnrichSender != 0
+	for _, lg := range logs {
+		if lg.Removed {
+			continue
+		}
+		numbers[lg.BlockHash] = lg.BlockNumber
+		if es.enrich&(EnrichBlockTime|EnrichSender) != 0 {
+			blocks[lg.BlockHash] = append(blocks[lg.BlockHash], lg.TxHash)
+		}
+		if es.enrich&EnrichReceipt != 0 {
+			if _, ok := ex.statuses[lg.TxHash]; ok {
+				continue
+			}
+			if status, ok := es.extraCache.status(lg.BlockHash, lg.TxHash); ok {
+				ex.statuses[lg.TxHash] = status
+			} else {
+				ex.statuses[lg.TxHash] = 0
+				receipts = append(receipts, lg)
+			}
+		}
+	}
+	for hash, txsOfBlock := range blocks {
+		if b, ok := es.extraCache.block(hash, txsOfBlock, withSenders); ok {
+			ex.blocks[hash] = b
+			delete(blocks, hash)
+		}
+	}
+	if es.rpc != nil {
+		return ex, es.batchExtras(ex, blocks, numbers, receipts)
+	}
+
+	var mu sync.Mutex
+	var firstErr error
+	setErr := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+	}
+	wg := swg.New(enrichWorkers)
+	for hash, txsOfBlock := range blocks {
+		wg.Add()
+		go func(hash common.Hash, txsOfBlock []common.Hash) {
+			defer wg.Done()
+			b, err := es.fetchBlockExtra(hash, txsOfBlock)
+			if err != nil {
+				setErr(fmt.Errorf("query block %s fail:%v", hash.Hex(), err))
+				return
+			}
+			es.extraCache.putBlock(hash, numbers[hash], b)
+			mu.Lock()
+			ex.blocks[hash] = b
+			mu.Unlock()
+		}(hash, txsOfBlock)
+	}
+	for _, lg := range receipts {
+		wg.Add()
+		go func(lg types.Log) {
+			defer wg.Done()
+			receipt, err := es.conn.TransactionReceipt(es.ctx, lg.TxHash)
+			if err != nil {
+				setErr(fmt.Errorf("query receipt of %s fail:%v", lg.TxHash.Hex(), err))
+				return
+			}
+			es.extraCache.putStatus(lg.BlockHash, lg.BlockNumber, lg.TxHash, receipt.Status)
+			mu.Lock()
+			ex.statuses[lg.TxHash] = receipt.Status
+			mu.Unlock()
+		}(lg)
+	}
+	wg.Wait()
+	return ex, firstErr
+}
+
+// fetchBlockExtra recovers senders of txs only, that's costly
+func (es *eventScanner) fetchBlockExtra(hash common.Hash, txs []common.Hash) (*blockExtra, error) {
+	if es.enrich&EnrichSender == 0 {
+		header, err := es.conn.HeaderByHash(es.ctx, hash)
+		if err != nil {
+			return nil, err
+		}
+		return &blockExtra{time: time.Unix(header.Time.Int64(), 0)}, nil
+	}
+	block, err := es.conn.BlockByHash(es.ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	b := &blockExtra{
+		time:    time.Unix(block.Time().Int64(), 0),
+		senders: make(map[common.Hash]common.Address),
+	}
+	for _, txHash := range txs {
+		if _, ok := b.senders[txHash]; ok {
+			continue
+		}
+		tx := block.Transaction(txHash)
+		if tx == nil {
+			return nil, fmt.Errorf("tx %s not in block", txHash.Hex())
+		}
+		b.senders[txHash] = contracts.NewTxExtra(tx).From()
+	}
+	return b, nil
+}
+
+// rpcBlockSenders is block with full txs, senders told by node
+type rpcBlockSenders struct {
+	Time         *hexutil.Big `json:"timestamp"`
+	Transactions []struct {
+		Hash common.Hash    `json:"hash"`
+		From common.Address `json:"from"`
+	} `json:"transactions"`
+}
+
+// batchExtras queries blocks and receipts not cached in batches
+func (es *eventScanner) batchExtras(ex *extras, blocks map[common.Hash][]common.Hash, numbers map[common.Hash]uint64, receipts []types.Log) error {
+	withSenders := es.enrich&EnrichSender != 0
+	var elems []rpc.BatchElem
+	hashes := make([]common.Hash, 0, len(blocks))
+	headers := make([]*types.Header, len(blocks))
+	fulls := make([]*rpcBlockSenders, len(blocks))
+	for hash := range blocks {
+		i := len(hashes)
+		hashes = append(hashes, hash)
+		if withSenders {
+			elems = append(elems, rpc.BatchElem{Method: "eth_getBlockByHash", Args: []interface{}{hash, true}, Result: &fulls[i]})
+		} else {
+			elems = append(elems, rpc.BatchElem{Method: "eth_getBlockByHash", Args: []interface{}{hash, false}, Result: &headers[i]})
+		}
+	}
+	results := make([]*types.Receipt, len(receipts))
+	for i, lg := range receipts {
+		elems = append(elems, rpc.BatchElem{Method: "eth_getTransactionReceipt", Args: []interface{}{lg.TxHash}, Result: &results[i]})
+	}
+	if err := es.batchCall(elems); err != nil {
+		return fmt.Errorf("batch query extras fail:%v", err)
+	}
+	for i, hash := range hashes {
+		if err := elems[i].Error; err != nil {
+			return fmt.Errorf("query block %s fail:%v", hash.Hex(), err)
+		}
+		var b *blockExtra
+		if withSenders {
+			if fulls[i] == nil || fulls[i].Time == nil {
+				return fmt.Errorf("query block %s fail:not found", hash.Hex())
+			}
+			b = &blockExtra{
+				time:    time.Unix(fulls[i].Time.ToInt().Int64(), 0),
+				senders: make(map[common.Hash]common.Address),
+			}
+			for _, tx := range fulls[i].Transactions {
+				b.senders[tx.Hash] = tx.From
+			}
+			for _, txHash := range blocks[hash] {
+				if _, ok := b.senders[txHash]; !ok {
+					return fmt.Errorf("query block %s fail:tx %s not in block", hash.Hex(), txHash.Hex())
+				}
+			}
+		} else {
+			if headers[i] == nil {
+				return fmt.Errorf("query block %s fail:not found", hash.Hex())
+			}
+			b = &blockExtra{time: time.Unix(headers[i].Time.Int64(), 0)}
+		}
+		es.extraCache.putBlock(hash, numbers[hash], b)
+		ex.blocks[hash] = b
+	}
+	for i, lg := range receipts {
+		if err := elems[len(hashes)+i].Error; err != nil {
+			return fmt.Errorf("query receipt of %s fail:%v", lg.TxHash.Hex(), err)
+		}
+		if results[i] == nil {
+			return fmt.Errorf("query receipt of %s fail:not found", lg.TxHash.Hex())
+		}
+		es.extraCache.putStatus(lg.BlockHash, lg.BlockNumber, lg.TxHash, results[i].Status)
+		ex.statuses[lg.TxHash] = results[i].Status
+	}
+	return nil
+}
+
+// batchCall sends elems enrichBatchSize a request, enrichWorkers requests at once
+func (es *eventScanner) batchCall(elems []rpc.BatchElem) error {
+	var mu sync.Mutex
+	var firstErr error
+	wg := swg.New(enrichWorkers)
+	for i := 0; i < len(elems); i += enrichBatchSize {
+		end := i + enrichBatchSize
+		if end > len(elems) {
+			end = len(elems)
+		}
+		wg.Add()
+		go func(batch []rpc.BatchElem) {
+			defer wg.Done()
+			if err := es.rpc.BatchCallContext(es.ctx, batch); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(elems[i:end])
+	}
+	wg.Wait()
+	return firstErr
+}
@@ -0,0 +1,177 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExtrasFill(t *testing.T) {
+	block, tx := common.HexToHash("0xb1"), common.HexToHash("0x71")
+	sender := common.HexToAddress("0x01")
+	ex := &extras{
+		blocks: map[common.Hash]*blockExtra{
+			block: {time: time.Unix(1500000000, 0), senders: map[common.Hash]common.Address{tx: sender}},
+		},
+		statuses: map[common.Hash]uint64{tx: types.ReceiptStatusSuccessful},
+	}
+	evt := Event{BlockHash: block, TxHash: tx}
+	ex.fill(&evt)
+	if evt.BlockTime.Unix() != 1500000000 || evt.From != sender || evt.TxStatus != types.ReceiptStatusSuccessful {
+		t.Fatal("bad enriched event", evt)
+	}
+	var none *extras
+	none.fill(&evt)
+
+	es := &eventScanner{}
+	if ex, err := es.fetchExtras([]types.Log{{BlockHash: block}}); ex != nil || err != nil {
+		t.Fatal("should fetch nothing without enrich")
+	}
+}
+
+func TestExtraCache(t *testing.T) {
+	c := newExtraCache(2)
+	hashOf := func(n uint64) common.Hash { return common.BigToHash(new(big.Int).SetUint64(n)) }
+	tx1, tx2 := common.HexToHash("0x71"), common.HexToHash("0x72")
+	c.putBlock(hashOf(1), 1, &blockExtra{senders: map[common.Hash]common.Address{tx1: common.HexToAddress("0x01")}})
+	if _, ok := c.block(hashOf(1), []common.Hash{tx1, tx2}, true); ok {
+		t.Fatal("sender of tx2 not cached")
+	}
+	c.putBlock(hashOf(1), 1, &blockExtra{senders: map[common.Hash]common.Address{tx2: common.HexToAddress("0x02")}})
+	if b, ok := c.block(hashOf(1), []common.Hash{tx1, tx2}, true); !ok || len(b.senders) != 2 {
+		t.Fatal("senders should be merged")
+	}
+	c.putStatus(hashOf(2), 2, tx1, 1)
+	// block 1 used, 2 is evicted
+	c.block(hashOf(1), nil, false)
+	c.putStatus(hashOf(3), 3, tx1, 1)
+	if _, ok := c.status(hashOf(2), tx1); ok {
+		t.Fatal("least used should be evicted")
+	}
+	if _, ok := c.status(hashOf(3), tx1); !ok {
+		t.Fatal("status should be cached")
+	}
+	c.rewind(3)
+	if _, ok := c.status(hashOf(3), tx1); ok {
+		t.Fatal("rewound block should be dropped")
+	}
+	c.prune(10, 8)
+	if _, ok := c.block(hashOf(1), nil, false); ok {
+		t.Fatal("block behind reorg window should be pruned")
+	}
+	var none *extraCache
+	none.putStatus(hashOf(1), 1, tx1, 1)
+	if _, ok := none.status(hashOf(1), tx1); ok {
+		t.Fatal("nil cache caches nothing")
+	}
+}
+
+func TestFetchExtrasCached(t *testing.T) {
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	count := func(method string) {
+		mu.Lock()
+		calls[method]++
+		mu.Unlock()
+	}
+	node, conn := fakeNode(t, map[string]rpcHandler{
+		"eth_getBlockByHash": func(params []json.RawMessage) (interface{}, error) {
+			count("block")
+			return &types.Header{Difficulty: big.NewInt(1), Number: big.NewInt(1), Time: big.NewInt(1500000000)}, nil
+		},
+		"eth_getTransactionReceipt": func(params []json.RawMessage) (interface{}, error) {
+			count("receipt")
+			var tx common.Hash
+			if err := json.Unmarshal(params[0], &tx); err != nil {
+				return nil, err
+			}
+			return &types.Receipt{Status: types.ReceiptStatusSuccessful, TxHash: tx, Logs: []*types.Log{}}, nil
+		},
+	})
+	defer node.Close()
+	es := &eventScanner{
+		ctx:        context.Background(),
+		conn:       conn,
+		enrich:     EnrichBlockTime | EnrichReceipt,
+		extraCache: newExtraCache(enrichCacheSize),
+	}
+	block := common.HexToHash("0xb1")
+	logs := []types.Log{
+		{BlockNumber: 1, BlockHash: block, TxHash: common.HexToHash("0x71")},
+		{BlockNumber: 1, BlockHash: block, TxHash: common.HexToHash("0x72")},
+	}
+	for i := 0; i < 2; i++ {
+		ex, err := es.fetchExtras(logs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		evt := Event{BlockHash: block, TxHash: logs[1].TxHash}
+		ex.fill(&evt)
+		if evt.BlockTime.Unix() != 1500000000 || evt.TxStatus != types.ReceiptStatusSuccessful {
+			t.Fatal("bad enriched event", evt)
+		}
+	}
+	if calls["block"] != 1 || calls["receipt"] != 2 {
+		t.Fatal("block and receipts should be fetched once", calls)
+	}
+	es.extraCache.rewind(1)
+	if _, err := es.fetchExtras(logs[:1]); err != nil || calls["block"] != 2 || calls["receipt"] != 3 {
+		t.Fatal("rewound block should be fetched again", err, calls)
+	}
+}
+
+func TestFetchExtrasBatched(t *testing.T) {
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	count := func(method string) {
+		mu.Lock()
+		calls[method]++
+		mu.Unlock()
+	}
+	block := common.HexToHash("0xb1")
+	sender := common.HexToAddress("0x01")
+	var logs []types.Log
+	var txs []map[string]interface{}
+	for i := 0; i < enrichBatchSize+50; i++ {
+		tx := common.BigToHash(big.NewInt(int64(0x100 + i)))
+		logs = append(logs, types.Log{BlockNumber: 1, BlockHash: block, TxHash: tx})
+		txs = append(txs, map[string]interface{}{"hash": tx, "from": sender})
+	}
+	node, rc := fakeRPC(t, map[string]rpcHandler{
+		"eth_getBlockByHash": func(params []json.RawMessage) (interface{}, error) {
+			count("block")
+			return map[string]interface{}{"timestamp": "0x59682f00", "transactions": txs}, nil
+		},
+		"eth_getTransactionReceipt": func(params []json.RawMessage) (interface{}, error) {
+			count("receipt")
+			var tx common.Hash
+			if err := json.Unmarshal(params[0], &tx); err != nil {
+				return nil, err
+			}
+			return &types.Receipt{Status: types.ReceiptStatusSuccessful, TxHash: tx, Logs: []*types.Log{}}, nil
+		},
+	})
+	defer node.Close()
+	es := &eventScanner{
+		ctx:    context.Background(),
+		rpc:    rc,
+		enrich: EnrichBlockTime | EnrichSender | EnrichReceipt,
+	}
+	ex, err := es.fetchExtras(logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	evt := Event{BlockHash: block, TxHash: logs[len(logs)-1].TxHash}
+	ex.fill(&evt)
+	if evt.BlockTime.Unix() != 1500000000 || evt.From != sender || evt.TxStatus != types.ReceiptStatusSuccessful {
+		t.Fatal("bad enriched event", evt)
+	}
+	if calls["block"] != 1 || calls["receipt"] != len(logs) {
+		t.Fatal("block and receipts should be fetched once", calls)
+	}
+}
@@ -0,0 +1,109 @@
+package events
+
+import (
+	"fmt"
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"math/big"
+	"sort"
+)
+
+// topicFilters maps event name => values of indexed arguments by position
+type topicFilters map[string][][]interface{}
+
+// logQuery is addresses and topics of one FilterLogs call, no address for any
+type logQuery struct {
+	addresses []common.Address
+	topics    [][]common.Hash
+}
+
+func (es *eventScanner) buildQueries() ([]logQuery, error) {
+	return es.queriesOf(es.Contracts)
+}
+
+// queriesOf puts events without filter into one query as before, each
+// filtered or anonymous event of a contract gets a query of its own as
+// topics of different events can't be combined
+func (es *eventScanner) queriesOf(contracts contractMap) ([]logQuery, error) {
+	var queries []logQuery
+	var unfiltered []common.Hash
+	for _, cm := range contracts {
+		for _, name := range cm.evt_names {
+			key, evt, ok := cm.event(name)
+			if !ok {
+				return nil, fmt.Errorf("no event %s in abi of %s", name, cm.contract.Hex())
+			}
+			filter, filtered := es.filters[name]
+			if !filtered && !evt.Anonymous {
+				unfiltered = append(unfiltered, evt.Id())
+				continue
+			}
+			var indexed int
+			for _, arg := range evt.Inputs {
+				if arg.Indexed {
+					indexed++
+				}
+			}
+			if len(filter) > indexed {
+				return nil, fmt.Errorf("event %s has %d indexed arguments, filter gives %d", name, indexed, len(filter))
+			}
+			// no selector of anonymous event, all logs of contract unless filtered
+			topics, err := cm.bc.EventTopics(key, filter...)
+			if err != nil {
+				return nil, fmt.Errorf("filter of event %s:%v", name, err)
+			}
+			q := logQuery{topics: topics}
+			if cm.contract != (common.Address{}) {
+				q.addresses = []common.Address{cm.contract}
+			}
+			queries = append(queries, q)
+		}
+	}
+	if len(unfiltered) > 0 {
+		queries = append([]logQuery{{
+			addresses: contracts.Contracts(),
+			topics:    [][]common.Hash{unfiltered},
+		}}, queries...)
+	}
+	return queries, nil
+}
+
+// filterLogs runs every query on range, logs sorted by position in chain,
+// those found by more queries e.g. of anonymous events kept once
+func (es *eventScanner) filterLogs(queries []logQuery, from, to uint64) ([]types.Log, error) {
+	var logs []types.Log
+	for _, q := range queries {
+		fq := ethereum.FilterQuery{
+			FromBlock: new(big.Int).SetUint64(from),
+			ToBlock:   new(big.Int).SetUint64(to),
+			Addresses: q.addresses,
+			Topics:    q.topics,
+		}
+		if fq.Addresses == nil {
+			fq.Addresses = []common.Address{}
+		}
+		res, err := es.conn.FilterLogs(es.ctx, fq)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, res...)
+	}
+	if len(queries) > 1 {
+		sort.SliceStable(logs, func(i, j int) bool {
+			if logs[i].BlockNumber != logs[j].BlockNumber {
+				return logs[i].BlockNumber < logs[j].BlockNumber
+			}
+			return logs[i].Index < logs[j].Index
+		})
+		uniq := logs[:0]
+		for _, lg := range logs {
+			if n := len(uniq); n > 0 && lg.BlockHash == uniq[n-1].BlockHash && lg.Index == uniq[n-1].Index {
+				continue
+			}
+			uniq = append(uniq, lg)
+		}
+		logs = uniq
+	}
+	return logs, nil
+}
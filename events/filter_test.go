@@ -0,0 +1,62 @@
+package events
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	abi "github.com/qjpcpu/ethereum/mabi"
+	bind "github.com/qjpcpu/ethereum/mabi/mbind"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const tokenABI = `[{"anonymous":false,"inputs":[{"indexed":true,"name":"from","type":"address"},{"indexed":true,"name":"to","type":"address"},{"indexed":false,"name":"value","type":"uint256"}],"name":"Transfer","type":"event"},{"anonymous":false,"inputs":[{"indexed":true,"name":"owner","type":"address"},{"indexed":true,"name":"spender","type":"address"},{"indexed":false,"name":"value","type":"uint256"}],"name":"Approval","type":"event"}]`
+
+func tokenScanner(t *testing.T, addr common.Address) *eventScanner {
+	parsed, err := abi.JSON(strings.NewReader(tokenABI))
+	if err != nil {
+		t.Fatal(err)
+	}
+	es := &eventScanner{Contracts: make(contractMap), filters: make(topicFilters), contractsMu: new(sync.RWMutex)}
+	es.Contracts[strings.ToLower(addr.Hex())] = contractMeta{
+		contract:  addr,
+		evt_names: []string{"Transfer", "Approval"},
+		abi:       parsed,
+		bc:        bind.NewBoundContract(addr, parsed, nil, nil, nil),
+	}
+	return es
+}
+
+func TestBuildQueries(t *testing.T) {
+	token := common.HexToAddress("0x10")
+	es := tokenScanner(t, token)
+	queries, err := es.buildQueries()
+	if err != nil || len(queries) != 1 || len(queries[0].topics[0]) != 2 {
+		t.Fatal("events without filter should share a query", queries, err)
+	}
+
+	to1, to2 := common.HexToAddress("0x01"), common.HexToAddress("0x02")
+	es.filters["Transfer"] = [][]interface{}{nil, {to1, to2}}
+	if queries, err = es.buildQueries(); err != nil || len(queries) != 2 {
+		t.Fatal("filtered event should have its own query", queries, err)
+	}
+	approval, transfer := queries[0], queries[1]
+	cm, _ := es.Contracts.GetMeta(token)
+	if len(approval.topics) != 1 || approval.topics[0][0] != cm.bc.EventTopic("Approval") {
+		t.Fatal("bad unfiltered query", approval)
+	}
+	if len(transfer.addresses) != 1 || transfer.addresses[0] != token {
+		t.Fatal("filtered query should keep contract address", transfer.addresses)
+	}
+	if len(transfer.topics) != 3 || len(transfer.topics[1]) != 0 || len(transfer.topics[2]) != 2 || transfer.topics[2][1] != to2.Hash() {
+		t.Fatal("bad filtered topics", transfer.topics)
+	}
+
+	es.filters["Transfer"] = [][]interface{}{nil, nil, {1}}
+	if _, err = es.buildQueries(); err == nil {
+		t.Fatal("should refuse filter on non-indexed position")
+	}
+	es.filters["Transfer"] = [][]interface{}{{1.5}}
+	if _, err = es.buildQueries(); err == nil {
+		t.Fatal("should refuse unsupported topic value")
+	}
+}
@@ -0,0 +1,35 @@
+// Package ilvldb keeps events scanning checkpoint in leveldb
+package ilvldb
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"strconv"
+)
+
+// Checkpoint keeps block number under key name of db
+type Checkpoint struct {
+	db   *leveldb.DB
+	name string
+}
+
+func NewCheckpoint(db *leveldb.DB, name string) *Checkpoint {
+	return &Checkpoint{db: db, name: name}
+}
+
+func (cp *Checkpoint) Load() (uint64, bool, error) {
+	data, err := cp.db.Get([]byte(cp.name), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	block, err := strconv.ParseUint(string(data), 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return block, true, nil
+}
+
+func (cp *Checkpoint) Save(block uint64) error {
+	return cp.db.Put([]byte(cp.name), []byte(strconv.FormatUint(block, 10)), nil)
+}
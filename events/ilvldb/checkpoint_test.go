@@ -0,0 +1,29 @@
+package ilvldb
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"os"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+	db, err := leveldb.OpenFile("./ok", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("./ok")
+	defer db.Close()
+	cp := NewCheckpoint(db, "kitty")
+	if _, ok, err := cp.Load(); ok || err != nil {
+		t.Fatal("should have nothing saved", ok, err)
+	}
+	if err = cp.Save(100); err != nil {
+		t.Fatal(err)
+	}
+	if block, ok, err := cp.Load(); !ok || err != nil || block != 100 {
+		t.Fatal("should load saved block", block, ok, err)
+	}
+	if _, ok, _ := NewCheckpoint(db, "other").Load(); ok {
+		t.Fatal("names should be apart")
+	}
+}
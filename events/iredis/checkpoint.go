@@ -0,0 +1,35 @@
+// Package iredis keeps events scanning checkpoint in redis
+package iredis
+
+import (
+	"github.com/garyburd/redigo/redis"
+)
+
+// Checkpoint keeps block number as string value of key
+type Checkpoint struct {
+	pool *redis.Pool
+	key  string
+}
+
+func NewCheckpoint(pool *redis.Pool, key string) *Checkpoint {
+	return &Checkpoint{pool: pool, key: key}
+}
+
+func (cp *Checkpoint) Load() (uint64, bool, error) {
+	redis_conn := cp.pool.Get()
+	defer redis_conn.Close()
+	block, err := redis.Uint64(redis_conn.Do("GET", cp.key))
+	if err == redis.ErrNil {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return block, true, nil
+}
+
+func (cp *Checkpoint) Save(block uint64) error {
+	redis_conn := cp.pool.Get()
+	defer redis_conn.Close()
+	_, err := redis_conn.Do("SET", cp.key, block)
+	return err
+}
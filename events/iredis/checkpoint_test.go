@@ -0,0 +1,35 @@
+package iredis
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"testing"
+	"time"
+)
+
+func _testpool() *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     10,
+		IdleTimeout: 2 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialTimeout("tcp", ":6379", 2*time.Second, 2*time.Second, 2*time.Second)
+		},
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	pool := _testpool()
+	defer pool.Close()
+	cp := NewCheckpoint(pool, "events:checkpoint:kitty")
+	redis_conn := pool.Get()
+	redis_conn.Do("DEL", cp.key)
+	redis_conn.Close()
+	if _, ok, err := cp.Load(); ok || err != nil {
+		t.Fatal("should have nothing saved", ok, err)
+	}
+	if err := cp.Save(100); err != nil {
+		t.Fatal(err)
+	}
+	if block, ok, err := cp.Load(); !ok || err != nil || block != 100 {
+		t.Fatal("should load saved block", block, ok, err)
+	}
+}
@@ -0,0 +1,73 @@
+// Package isql keeps events scanning checkpoint, or the events themselves,
+// in a mysql or postgres table
+package isql
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+type dialect struct {
+	create string
+	load   string
+	save   string
+}
+
+var (
+	mysqlDialect = dialect{
+		create: "CREATE TABLE IF NOT EXISTS `%s` (name varchar(128) NOT NULL, block bigint(20) unsigned NOT NULL DEFAULT '0', updated_at datetime DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP, PRIMARY KEY (name)) ENGINE=InnoDB DEFAULT CHARSET=utf8",
+		load:   "SELECT block FROM `%s` WHERE name=?",
+		save:   "INSERT INTO `%s` (name,block) VALUES(?,?) ON DUPLICATE KEY UPDATE block=VALUES(block)",
+	}
+	postgresDialect = dialect{
+		create: `CREATE TABLE IF NOT EXISTS "%s" (name varchar(128) PRIMARY KEY, block bigint NOT NULL DEFAULT 0, updated_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP)`,
+		load:   `SELECT block FROM "%s" WHERE name=$1`,
+		save:   `INSERT INTO "%s" (name,block) VALUES($1,$2) ON CONFLICT (name) DO UPDATE SET block=EXCLUDED.block,updated_at=CURRENT_TIMESTAMP`,
+	}
+)
+
+// Checkpoint keeps block number in row name of tablename
+type Checkpoint struct {
+	db        *sql.DB
+	loadQuery string
+	saveQuery string
+	name      string
+}
+
+// NewMysqlCheckpoint creates tablename if not exist
+func NewMysqlCheckpoint(db *sql.DB, tablename, name string) (*Checkpoint, error) {
+	return newCheckpoint(db, mysqlDialect, tablename, name)
+}
+
+// NewPostgresCheckpoint creates tablename if not exist
+func NewPostgresCheckpoint(db *sql.DB, tablename, name string) (*Checkpoint, error) {
+	return newCheckpoint(db, postgresDialect, tablename, name)
+}
+
+func newCheckpoint(db *sql.DB, d dialect, tablename, name string) (*Checkpoint, error) {
+	if _, err := db.Exec(fmt.Sprintf(d.create, tablename)); err != nil {
+		return nil, fmt.Errorf("create table %s fail:%v", tablename, err)
+	}
+	return &Checkpoint{
+		db:        db,
+		loadQuery: fmt.Sprintf(d.load, tablename),
+		saveQuery: fmt.Sprintf(d.save, tablename),
+		name:      name,
+	}, nil
+}
+
+func (cp *Checkpoint) Load() (uint64, bool, error) {
+	var block uint64
+	err := cp.db.QueryRow(cp.loadQuery, cp.name).Scan(&block)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return block, true, nil
+}
+
+func (cp *Checkpoint) Save(block uint64) error {
+	_, err := cp.db.Exec(cp.saveQuery, cp.name, block)
+	return err
+}
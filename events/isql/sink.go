@@ -0,0 +1,82 @@
+package isql
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/qjpcpu/ethereum/events"
+)
+
+type sinkDialect struct {
+	create string
+	insert string
+}
+
+var (
+	mysqlSinkDialect = sinkDialect{
+		create: "CREATE TABLE IF NOT EXISTS `%s` (id bigint(20) unsigned NOT NULL AUTO_INCREMENT, block_number bigint(20) unsigned NOT NULL, block_hash char(66) NOT NULL, log_index int(11) unsigned NOT NULL, tx_hash char(66) NOT NULL, address char(42) NOT NULL, name varchar(128) NOT NULL, data text NOT NULL, removed tinyint(1) NOT NULL DEFAULT '0', created_at datetime DEFAULT CURRENT_TIMESTAMP, PRIMARY KEY (id), UNIQUE KEY block_log (block_hash,log_index)) ENGINE=InnoDB DEFAULT CHARSET=utf8",
+		insert: "INSERT INTO `%s` (block_number,block_hash,log_index,tx_hash,address,name,data,removed) VALUES(?,?,?,?,?,?,?,?) ON DUPLICATE KEY UPDATE removed=VALUES(removed)",
+	}
+	postgresSinkDialect = sinkDialect{
+		create: `CREATE TABLE IF NOT EXISTS "%s" (id bigserial PRIMARY KEY, block_number bigint NOT NULL, block_hash char(66) NOT NULL, log_index integer NOT NULL, tx_hash char(66) NOT NULL, address char(42) NOT NULL, name varchar(128) NOT NULL, data text NOT NULL, removed boolean NOT NULL DEFAULT false, created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, UNIQUE (block_hash,log_index))`,
+		insert: `INSERT INTO "%s" (block_number,block_hash,log_index,tx_hash,address,name,data,removed) VALUES($1,$2,$3,$4,$5,$6,$7,$8) ON CONFLICT (block_hash,log_index) DO UPDATE SET removed=EXCLUDED.removed`,
+	}
+)
+
+// Sink inserts events into a table in one transaction per write, a row per
+// block hash and log index, so events written again are not duplicated and
+// retracted ones get removed set
+type Sink struct {
+	db          *sql.DB
+	insertQuery string
+}
+
+// NewMysqlSink creates tablename if not exist
+func NewMysqlSink(db *sql.DB, tablename string) (*Sink, error) {
+	return newSink(db, mysqlSinkDialect, tablename)
+}
+
+// NewPostgresSink creates tablename if not exist
+func NewPostgresSink(db *sql.DB, tablename string) (*Sink, error) {
+	return newSink(db, postgresSinkDialect, tablename)
+}
+
+func newSink(db *sql.DB, d sinkDialect, tablename string) (*Sink, error) {
+	if _, err := db.Exec(fmt.Sprintf(d.create, tablename)); err != nil {
+		return nil, fmt.Errorf("create table %s fail:%v", tablename, err)
+	}
+	return &Sink{db: db, insertQuery: fmt.Sprintf(d.insert, tablename)}, nil
+}
+
+func (s *Sink) Write(evts []events.Event) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(s.insertQuery)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, evt := range evts {
+		if _, err = stmt.Exec(
+			evt.BlockNumber,
+			evt.BlockHash.Hex(),
+			evt.LogIndex,
+			evt.TxHash.Hex(),
+			evt.Address.Hex(),
+			evt.Name,
+			evt.Data.String(),
+			evt.Removed,
+		); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Close leaves db open, it's the caller's
+func (s *Sink) Close() error {
+	return nil
+}
@@ -0,0 +1,112 @@
+package events
+
+import (
+	"sync/atomic"
+)
+
+// SlowPolicy tells what to do with events when DataChan is full
+type SlowPolicy int
+
+const (
+	// wait for consumer until stopped
+	SlowBlock SlowPolicy = iota
+	// drop events and count them, errors are dropped too
+	SlowDrop
+	// append events to spill file, sent in order when consumer catches up
+	SlowSpill
+)
+
+// sendData false when stopped before evt taken
+func (es *eventScanner) sendData(evt Event) bool {
+	if es.DataChan == nil {
+		return true
+	}
+	if es.ctx.Err() != nil {
+		return false
+	}
+	switch es.slow {
+	case SlowDrop:
+		select {
+		case es.DataChan <- evt:
+		default:
+			atomic.AddUint64(&es.dropped, 1)
+		}
+		return true
+	case SlowSpill:
+		// once spilling, all go through spill file to keep order
+		if es.spill.empty() {
+			select {
+			case es.DataChan <- evt:
+				return true
+			default:
+			}
+		}
+		if err := es.spill.push(evt); err != nil {
+			es.sendErr(err)
+			return false
+		}
+		return true
+	default:
+		select {
+		case es.DataChan <- evt:
+			return true
+		case <-es.ctx.Done():
+			return false
+		}
+	}
+}
+
+func (es *eventScanner) sendErr(err error) {
+	if es.ErrChan == nil || err == nil || es.ctx.Err() != nil {
+		return
+	}
+	if es.slow == SlowDrop {
+		select {
+		case es.ErrChan <- err:
+		default:
+		}
+		return
+	}
+	select {
+	case es.ErrChan <- err:
+	case <-es.ctx.Done():
+	}
+}
+
+func (es *eventScanner) sendProgress(p Progress) {
+	if es.ProgressChan == nil {
+		return
+	}
+	select {
+	case es.ProgressChan <- p:
+	case <-es.ctx.Done():
+	}
+}
+
+func (es *eventScanner) Dropped() uint64 {
+	return atomic.LoadUint64(&es.dropped)
+}
+
+// delivered is the last block with all events sent, dropped by policy, or
+// none of them waiting in spill file
+func (es *eventScanner) delivered() uint64 {
+	last := es.From - 1
+	if es.From == 0 {
+		last = 0
+	}
+	if block, ok := es.spill.oldest(); ok && block <= last {
+		last = 0
+		if block > 0 {
+			last = block - 1
+		}
+	}
+	return last
+}
+
+// shutdown releases what scanning holds, on scanning goroutine
+func (es *eventScanner) shutdown() {
+	if es.sub != nil {
+		es.sub.unsubscribe()
+		es.sub = nil
+	}
+}
@@ -0,0 +1,93 @@
+package events
+
+import (
+	"context"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSendDataDrop(t *testing.T) {
+	dataCh := make(chan Event, 1)
+	es := &eventScanner{ctx: context.Background(), DataChan: dataCh, slow: SlowDrop}
+	for i := 0; i < 3; i++ {
+		if !es.sendData(Event{BlockNumber: uint64(i)}) {
+			t.Fatal("drop should not stop")
+		}
+	}
+	if es.Dropped() != 2 || (<-dataCh).BlockNumber != 0 {
+		t.Fatal("should drop events beyond channel", es.Dropped())
+	}
+}
+
+func TestSendDataBlockCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	es := &eventScanner{ctx: ctx, DataChan: make(chan Event)}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if es.sendData(Event{}) {
+		t.Fatal("should give up when cancelled")
+	}
+}
+
+func TestSpillInOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	token := common.HexToAddress("0x10")
+	es := tokenScanner(t, token)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dataCh := make(chan Event, 1)
+	es.ctx, es.DataChan, es.slow = ctx, dataCh, SlowSpill
+	if es.spill, err = newSpillQueue(filepath.Join(dir, "spill")); err != nil {
+		t.Fatal(err)
+	}
+	es.pumpDone = make(chan struct{})
+	cm, _ := es.Contracts.GetMeta(token)
+	for i := uint64(1); i <= 5; i++ {
+		lg := types.Log{
+			Address:     token,
+			Topics:      []common.Hash{cm.bc.EventTopic("Transfer"), common.HexToAddress("0x01").Hash(), common.HexToAddress("0x02").Hash()},
+			Data:        common.LeftPadBytes([]byte{byte(i)}, 32),
+			BlockNumber: i,
+		}
+		if !es.sendData(Event{BlockNumber: i, Name: "Transfer", log: lg}) {
+			t.Fatal("spill should not stop")
+		}
+	}
+	es.From = 6
+	if block, _ := es.spill.oldest(); block != 2 || es.delivered() != 1 {
+		t.Fatal("events beyond channel should be spilled", block, es.delivered())
+	}
+	go es.pumpSpill()
+	for i := uint64(1); i <= 5; i++ {
+		evt := <-dataCh
+		if evt.BlockNumber != i {
+			t.Fatal("should keep order", i, evt.BlockNumber)
+		}
+		if i > 1 && evt.Data.Get("value") == nil {
+			t.Fatal("spilled event should be decoded again", evt)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	if !es.spill.empty() || es.delivered() != 5 {
+		t.Fatal("spill should be drained", es.delivered())
+	}
+	if fi, err := os.Stat(es.spill.path); err != nil || fi.Size() != 0 {
+		t.Fatal("spill file should be emptied", err)
+	}
+	cancel()
+	<-es.pumpDone
+	if err = es.spill.close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,87 @@
+package events
+
+import (
+	"fmt"
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/qjpcpu/common/redo"
+	"time"
+)
+
+// liveSub wakes a caught up scanner as soon as matching logs are mined
+type liveSub struct {
+	subs []ethereum.Subscription
+	logs chan types.Log
+	errs chan error
+}
+
+func (ls *liveSub) unsubscribe() {
+	for _, sub := range ls.subs {
+		sub.Unsubscribe()
+	}
+}
+
+// subscribe every query for new logs, all or none
+func (es *eventScanner) subscribe() (*liveSub, error) {
+	ls := &liveSub{
+		logs: make(chan types.Log, 128),
+		errs: make(chan error, len(es.queries)),
+	}
+	for _, q := range es.queries {
+		sub, err := es.conn.SubscribeFilterLogs(es.ctx, ethereum.FilterQuery{Addresses: q.addresses, Topics: q.topics}, ls.logs)
+		if err != nil {
+			ls.unsubscribe()
+			return nil, err
+		}
+		ls.subs = append(ls.subs, sub)
+		go func(sub ethereum.Subscription) {
+			// closed without error on unsubscribe
+			if err, ok := <-sub.Err(); ok && err != nil {
+				ls.errs <- err
+			}
+		}(sub)
+	}
+	return ls, nil
+}
+
+// idle waits for logs subscribed when caught up in live mode, at most an
+// interval so stop is noticed. Events are always taken by FilterLogs from
+// the last delivered block, so the subscription coming or going neither
+// duplicates nor misses any.
+func (es *eventScanner) idle(ctx *redo.RedoCtx) {
+	if !es.live || es.To > 0 {
+		return
+	}
+	if es.sub == nil {
+		if time.Now().Before(es.subRetryAt) {
+			return
+		}
+		sub, err := es.subscribe()
+		if err != nil {
+			es.subRetryAt = time.Now().Add(es.policy.maxBackoff)
+			es.sendErr(fmt.Errorf("subscribe logs fail:%v, keep polling", err))
+			return
+		}
+		es.sub = sub
+	}
+	select {
+	case <-es.sub.logs:
+		// logs of the same blocks may follow, they're all filtered anyway
+		for drained := false; !drained; {
+			select {
+			case <-es.sub.logs:
+			default:
+				drained = true
+			}
+		}
+	case err := <-es.sub.errs:
+		es.sub.unsubscribe()
+		es.sub = nil
+		es.sendErr(fmt.Errorf("log subscription dropped:%v, poll from block %v", err, es.From))
+		return
+	case <-time.After(es.interval):
+	case <-es.ctx.Done():
+		return
+	}
+	ctx.StartNextRightNow()
+}
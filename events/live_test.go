@@ -0,0 +1,45 @@
+package events
+
+import (
+	"context"
+	"errors"
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/qjpcpu/common/redo"
+	"testing"
+	"time"
+)
+
+type fakeSub struct {
+	unsubscribed bool
+}
+
+func (s *fakeSub) Err() <-chan error { return nil }
+func (s *fakeSub) Unsubscribe()      { s.unsubscribed = true }
+
+func TestIdleLive(t *testing.T) {
+	sub := &fakeSub{}
+	errCh := make(chan error, 1)
+	es := &eventScanner{ctx: context.Background(), live: true, interval: time.Second, ErrChan: errCh, From: 7}
+	es.sub = &liveSub{
+		subs: []ethereum.Subscription{sub},
+		logs: make(chan types.Log, 3),
+		errs: make(chan error, 1),
+	}
+	es.sub.logs <- types.Log{BlockNumber: 8}
+	es.sub.logs <- types.Log{BlockNumber: 8}
+	start := time.Now()
+	es.idle(&redo.RedoCtx{})
+	if time.Since(start) > es.interval/2 || len(es.sub.logs) != 0 {
+		t.Fatal("should wake on logs and drain them")
+	}
+
+	es.sub.errs <- errors.New("connection reset")
+	es.idle(&redo.RedoCtx{})
+	if es.sub != nil || !sub.unsubscribed {
+		t.Fatal("should fall back to polling on drop")
+	}
+	if err := <-errCh; err == nil {
+		t.Fatal("drop should be reported")
+	}
+}
@@ -0,0 +1,111 @@
+package events
+
+import (
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	abi "github.com/qjpcpu/ethereum/mabi"
+	"strings"
+)
+
+// Decoder tells whether lg is of anonymous event evt and unpacks it into
+// data. Anonymous logs have no event selector, so which event a log is can
+// only be told by who knows the contract, e.g. by topic count or a field.
+// mbind.UnpackAnonymousLog unpacks by abi.
+type Decoder func(evt abi.Event, lg types.Log, data abi.JSONObj) (bool, error)
+
+// decoders maps event name => decoder of anonymous event
+type decoders map[string]Decoder
+
+// SetDecoder decodes anonymous event evt_name with dec, every anonymous
+// event scanned needs one. Logs not matching a scanned event by selector
+// are offered to decoders in the order events are set.
+func (b *Builder) SetDecoder(evt_name string, dec Decoder) *Builder {
+	b.es.decoders[evt_name] = dec
+	return b
+}
+
+// event resolves name scanned, an event name or a full signature like
+// Transfer(address,address,uint256) for overloaded ones, to the key in abi
+func (cm contractMeta) event(name string) (string, abi.Event, bool) {
+	if strings.Contains(name, "(") {
+		return cm.abi.EventBySig(name)
+	}
+	evt, ok := cm.abi.Events[name]
+	return name, evt, ok
+}
+
+// nameOf event scanned by key in abi
+func (cm contractMeta) nameOf(key string) (string, bool) {
+	for _, name := range cm.evt_names {
+		if k, _, ok := cm.event(name); ok && k == key {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// checkEvents makes sure events of cm are in abi, anonymous ones decodable
+// and only scanned on a contract
+func (es *eventScanner) checkEvents(cm contractMeta) error {
+	for _, name := range cm.evt_names {
+		_, evt, ok := cm.event(name)
+		if !ok {
+			return fmt.Errorf("no event %s in abi", name)
+		}
+		if !evt.Anonymous {
+			continue
+		}
+		if _, ok = es.decoders[name]; !ok {
+			return fmt.Errorf("anonymous event %s needs a decoder", name)
+		}
+		if cm.contract == (common.Address{}) {
+			return fmt.Errorf("anonymous event %s can't be scanned on any contract", name)
+		}
+	}
+	return nil
+}
+
+// matchLog unpacks lg as the event of cm it is, by selector first, then by
+// decoders of anonymous events. ok false when lg is not of events scanned.
+func (es *eventScanner) matchLog(cm contractMeta, lg types.Log) (name string, data abi.JSONObj, ok bool, err error) {
+	if len(lg.Topics) > 0 {
+		for key, evt := range cm.abi.Events {
+			if evt.Anonymous || evt.Id() != lg.Topics[0] {
+				continue
+			}
+			if name, ok = cm.nameOf(key); !ok {
+				return "", nil, false, nil
+			}
+			data = abi.NewJSONObj()
+			return name, data, true, cm.bc.UnpackLog(data, key, lg)
+		}
+	}
+	for _, name = range cm.evt_names {
+		_, evt, _ := cm.event(name)
+		if !evt.Anonymous {
+			continue
+		}
+		data = abi.NewJSONObj()
+		if ok, err = es.decoders[name](evt, lg, data); ok || err != nil {
+			return name, data, true, err
+		}
+	}
+	return "", nil, false, nil
+}
+
+// unpackAs unpacks lg known to be of event name
+func (es *eventScanner) unpackAs(cm contractMeta, name string, lg types.Log) (abi.JSONObj, error) {
+	key, evt, ok := cm.event(name)
+	if !ok {
+		return nil, fmt.Errorf("no event %s in abi", name)
+	}
+	data := abi.NewJSONObj()
+	if !evt.Anonymous {
+		return data, cm.bc.UnpackLog(data, key, lg)
+	}
+	if ok, err := es.decoders[name](evt, lg, data); err != nil || !ok {
+		return nil, fmt.Errorf("decoder of %s refused log:%v", name, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,87 @@
+package events
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	abi "github.com/qjpcpu/ethereum/mabi"
+	bind "github.com/qjpcpu/ethereum/mabi/mbind"
+	"math/big"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const overloadABI = `[{"anonymous":false,"inputs":[{"indexed":true,"name":"from","type":"address"},{"indexed":true,"name":"to","type":"address"},{"indexed":false,"name":"value","type":"uint256"}],"name":"Transfer","type":"event"},{"anonymous":false,"inputs":[{"indexed":true,"name":"from","type":"address"},{"indexed":true,"name":"to","type":"address"},{"indexed":false,"name":"value","type":"uint256"},{"indexed":false,"name":"data","type":"bytes"}],"name":"Transfer","type":"event"},{"anonymous":true,"inputs":[{"indexed":true,"name":"who","type":"address"},{"indexed":false,"name":"amount","type":"uint256"}],"name":"Deposit","type":"event"}]`
+
+const transferWithData = "Transfer(address,address,uint256,bytes)"
+
+func overloadScanner(t *testing.T, addr common.Address) (*eventScanner, contractMeta) {
+	es := &eventScanner{Contracts: make(contractMap), filters: make(topicFilters), decoders: make(decoders), contractsMu: new(sync.RWMutex)}
+	cm := contractMeta{contract: addr, abi_str: overloadABI, evt_names: []string{transferWithData, "Deposit"}}
+	if _, err := es.bindMeta(cm); err == nil {
+		t.Fatal("anonymous event without decoder should fail")
+	}
+	es.decoders["Deposit"] = func(evt abi.Event, lg types.Log, data abi.JSONObj) (bool, error) {
+		if len(lg.Topics) != 1 {
+			return false, nil
+		}
+		return true, bind.UnpackAnonymousLog(data, evt, lg)
+	}
+	cm, err := es.bindMeta(cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es.Contracts[strings.ToLower(addr.Hex())] = cm
+	return es, cm
+}
+
+func TestMatchLog(t *testing.T) {
+	addr := common.HexToAddress("0x10")
+	es, cm := overloadScanner(t, addr)
+	_, withData, _ := cm.abi.EventBySig(transferWithData)
+	from, to := common.HexToAddress("0x01").Hash(), common.HexToAddress("0x02").Hash()
+	amount := common.LeftPadBytes([]byte{7}, 32)
+
+	lg := types.Log{Address: addr, Topics: []common.Hash{withData.Id(), from, to}, Data: append(append(amount, common.LeftPadBytes([]byte{0x40}, 32)...), make([]byte, 32)...)}
+	name, data, ok, err := es.matchLog(cm, lg)
+	if err != nil || !ok || name != transferWithData || data.Get("value").(*big.Int).Int64() != 7 {
+		t.Fatal("should match overloaded event by signature", name, data, ok, err)
+	}
+	lg.Topics[0] = cm.abi.Events["Transfer"].Id()
+	if _, _, ok, err = es.matchLog(cm, lg); ok || err != nil {
+		t.Fatal("overload not scanned should not match", ok, err)
+	}
+
+	lg = types.Log{Address: addr, Topics: []common.Hash{from}, Data: amount}
+	if name, data, ok, err = es.matchLog(cm, lg); err != nil || !ok || name != "Deposit" || data.Get("amount").(*big.Int).Int64() != 7 {
+		t.Fatal("should match anonymous event by decoder", name, data, ok, err)
+	}
+	lg.Topics = append(lg.Topics, to)
+	if _, _, ok, err = es.matchLog(cm, lg); ok || err != nil {
+		t.Fatal("log refused by decoder should not match", ok, err)
+	}
+}
+
+func TestAnonymousQueries(t *testing.T) {
+	addr := common.HexToAddress("0x10")
+	es, cm := overloadScanner(t, addr)
+	queries, err := es.buildQueries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, withData, _ := cm.abi.EventBySig(transferWithData)
+	if len(queries) != 2 || len(queries[0].topics) != 1 || queries[0].topics[0][0] != withData.Id() {
+		t.Fatal("named events should share a query by selector", queries)
+	}
+	if q := queries[1]; len(q.addresses) != 1 || q.addresses[0] != addr || len(q.topics) != 0 {
+		t.Fatal("anonymous event should query all logs of contract", q)
+	}
+	who := common.HexToAddress("0x01")
+	es.filters["Deposit"] = [][]interface{}{{who}}
+	if queries, err = es.buildQueries(); err != nil {
+		t.Fatal(err)
+	}
+	if q := queries[1]; len(q.topics) != 1 || q.topics[0][0] != who.Hash() {
+		t.Fatal("anonymous filter should start from first topic", q)
+	}
+}
@@ -0,0 +1,77 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// rpcHandler answers a JSON-RPC method of fakeNode
+type rpcHandler func(params []json.RawMessage) (interface{}, error)
+
+type rpcRequest struct {
+	ID     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+// fakeNode serves the methods given over http, others fail the test
+func fakeNode(t *testing.T, handlers map[string]rpcHandler) (*httptest.Server, *ethclient.Client) {
+	srv, rc := fakeRPC(t, handlers)
+	return srv, ethclient.NewClient(rc)
+}
+
+// fakeRPC is fakeNode answering batch requests too
+func fakeRPC(t *testing.T, handlers map[string]rpcHandler) (*httptest.Server, *rpc.Client) {
+	answer := func(req rpcRequest) map[string]interface{} {
+		resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+		handler, ok := handlers[req.Method]
+		if !ok {
+			t.Error("unexpected call", req.Method)
+			resp["error"] = map[string]interface{}{"code": -32601, "message": "method not found"}
+		} else if result, err := handler(req.Params); err != nil {
+			resp["error"] = map[string]interface{}{"code": -32000, "message": err.Error()}
+		} else {
+			resp["result"] = result
+		}
+		return resp
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if body = bytes.TrimSpace(body); len(body) > 0 && body[0] == '[' {
+			var reqs []rpcRequest
+			if err := json.Unmarshal(body, &reqs); err != nil {
+				t.Error(err)
+				return
+			}
+			resps := make([]map[string]interface{}, len(reqs))
+			for i, req := range reqs {
+				resps[i] = answer(req)
+			}
+			json.NewEncoder(w).Encode(resps)
+			return
+		}
+		var req rpcRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Error(err)
+			return
+		}
+		json.NewEncoder(w).Encode(answer(req))
+	}))
+	rc, err := rpc.Dial(srv.URL)
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	return srv, rc
+}
@@ -0,0 +1,152 @@
+package events
+
+import (
+	"fmt"
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"math/big"
+)
+
+// DefaultReorgDepth is a depth to pass to SetReorgDepth, reorg not watched by default
+const DefaultReorgDepth = 64
+
+// blockRecord is a scanned block: its hash and events delivered from it
+type blockRecord struct {
+	number uint64
+	hash   common.Hash
+	events []Event
+}
+
+// reorgTracker keeps recently scanned blocks ascending, blocks without logs
+// are kept only when they end a range
+type reorgTracker struct {
+	depth  uint64
+	blocks []blockRecord
+}
+
+func newReorgTracker(depth uint64) *reorgTracker {
+	return &reorgTracker{depth: depth}
+}
+
+// record hash of block number, and the event delivered from it if any
+func (t *reorgTracker) record(number uint64, hash common.Hash, evt *Event) {
+	n := len(t.blocks)
+	if n == 0 || t.blocks[n-1].number < number {
+		t.blocks = append(t.blocks, blockRecord{number: number, hash: hash})
+		n++
+	} else if t.blocks[n-1].number != number {
+		// out of order, keep ascending
+		return
+	}
+	t.blocks[n-1].hash = hash
+	if evt != nil {
+		t.blocks[n-1].events = append(t.blocks[n-1].events, *evt)
+	}
+}
+
+// remove an event retracted by node, log index identifies it in block
+func (t *reorgTracker) remove(number uint64, logIndex uint) {
+	for i := range t.blocks {
+		if t.blocks[i].number != number {
+			continue
+		}
+		evts := t.blocks[i].events
+		for j := range evts {
+			if evts[j].LogIndex == logIndex {
+				t.blocks[i].events = append(evts[:j], evts[j+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// prune blocks depth behind head
+func (t *reorgTracker) prune(head uint64) {
+	if head < t.depth {
+		return
+	}
+	var i int
+	for i < len(t.blocks) && t.blocks[i].number < head-t.depth {
+		i++
+	}
+	t.blocks = append(t.blocks[:0], t.blocks[i:]...)
+}
+
+func (t *reorgTracker) last() (blockRecord, bool) {
+	if len(t.blocks) == 0 {
+		return blockRecord{}, false
+	}
+	return t.blocks[len(t.blocks)-1], true
+}
+
+// since returns events of blocks from number on, latest first
+func (t *reorgTracker) since(number uint64) []Event {
+	var evts []Event
+	for i := len(t.blocks) - 1; i >= 0 && t.blocks[i].number >= number; i-- {
+		for j := len(t.blocks[i].events) - 1; j >= 0; j-- {
+			evts = append(evts, t.blocks[i].events[j])
+		}
+	}
+	return evts
+}
+
+// rewind drops blocks from number on, returns their events latest first
+func (t *reorgTracker) rewind(number uint64) []Event {
+	retracted := t.since(number)
+	i := len(t.blocks)
+	for i > 0 && t.blocks[i-1].number >= number {
+		i--
+	}
+	t.blocks = t.blocks[:i]
+	return retracted
+}
+
+// checkReorg compares recorded hashes with chain from the latest, returns
+// the block to scan from when some are not canonical any more
+func (es *eventScanner) checkReorg() (uint64, bool, error) {
+	rec, ok := es.reorg.last()
+	if !ok {
+		return 0, false, nil
+	}
+	same, err := es.isCanonical(rec)
+	if err != nil || same {
+		return 0, false, err
+	}
+	// deeper than recorded, scan again from the oldest recorded
+	from := es.reorg.blocks[0].number
+	for i := len(es.reorg.blocks) - 2; i >= 0; i-- {
+		rec = es.reorg.blocks[i]
+		if same, err = es.isCanonical(rec); err != nil {
+			return 0, false, err
+		}
+		if same {
+			from = rec.number + 1
+			break
+		}
+	}
+	if from == es.reorg.blocks[0].number {
+		es.sendErr(fmt.Errorf("reorg deeper than %d blocks, rescan from %d", es.reorg.depth, from))
+	}
+	for _, evt := range es.reorg.since(from) {
+		evt.Removed = true
+		es.emit(evt)
+	}
+	// tracker kept so the reorg is found again next round
+	if err = es.flush(); err != nil {
+		return 0, false, fmt.Errorf("sink retracted events fail:%v", err)
+	}
+	es.reorg.rewind(from)
+	es.extraCache.rewind(from)
+	return from, true, nil
+}
+
+func (es *eventScanner) isCanonical(rec blockRecord) (bool, error) {
+	header, err := es.conn.HeaderByNumber(es.ctx, new(big.Int).SetUint64(rec.number))
+	if err == ethereum.NotFound {
+		// chain is shorter now
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return header.Hash() == rec.hash, nil
+}
@@ -0,0 +1,31 @@
+package events
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"testing"
+)
+
+func TestReorgTracker(t *testing.T) {
+	tr := newReorgTracker(10)
+	for i := uint64(1); i <= 5; i++ {
+		evt := Event{BlockNumber: i, LogIndex: uint(i)}
+		tr.record(i, common.BigToHash(common.Big1), &evt)
+	}
+	tr.record(5, common.BigToHash(common.Big2), &Event{BlockNumber: 5, LogIndex: 9})
+	tr.record(3, common.Hash{}, nil)
+	if rec, _ := tr.last(); rec.number != 5 || len(rec.events) != 2 || rec.hash != common.BigToHash(common.Big2) {
+		t.Fatal("bad last record", rec)
+	}
+	tr.remove(5, 5)
+	retracted := tr.rewind(4)
+	if len(retracted) != 2 || retracted[0].LogIndex != 9 || retracted[1].BlockNumber != 4 {
+		t.Fatal("should retract latest first", retracted)
+	}
+	if rec, _ := tr.last(); rec.number != 3 {
+		t.Fatal("should rewind to 3", rec)
+	}
+	tr.prune(12)
+	if len(tr.blocks) != 2 || tr.blocks[0].number != 2 {
+		t.Fatal("should keep blocks in depth", tr.blocks)
+	}
+}
@@ -0,0 +1,104 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Sink takes events instead of DataChan. Events of a range come in one Write
+// in order, they are acknowledged when it returns nil and the checkpoint
+// advances after that only, so a range failed is written again: at least
+// once. Retracted events come with Removed set.
+type Sink interface {
+	Write(events []Event) error
+	Close() error
+}
+
+// emit sends evt to DataChan, or batches it for sink until flush
+func (es *eventScanner) emit(evt Event) bool {
+	if es.sink != nil {
+		es.batch = append(es.batch, evt)
+		return true
+	}
+	return es.sendData(evt)
+}
+
+// flush writes events batched to sink, they're dropped on failure as the
+// range is scanned again
+func (es *eventScanner) flush() error {
+	if es.sink == nil || len(es.batch) == 0 {
+		return nil
+	}
+	batch := es.batch
+	es.batch = nil
+	return es.sink.Write(batch)
+}
+
+// JSONLSink appends events to a file one JSON object per line, synced
+// before Write returns
+type JSONLSink struct {
+	file *os.File
+}
+
+func NewJSONLSink(file_path string) (*JSONLSink, error) {
+	file, err := os.OpenFile(file_path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLSink{file: file}, nil
+}
+
+func (s *JSONLSink) Write(events []Event) error {
+	var data []byte
+	for _, evt := range events {
+		line, err := json.Marshal(evt)
+		if err != nil {
+			return fmt.Errorf("marshal event in tx(%s) fail:%v", evt.TxHash.Hex(), err)
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if _, err := s.file.Write(data); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *JSONLSink) Close() error {
+	return s.file.Close()
+}
+
+// Publisher is the producer side of a message queue, e.g. a kafka sync
+// producer or a nats connection wrapped, returning when the broker has msg
+type Publisher interface {
+	Publish(topic string, key, msg []byte) error
+}
+
+// PublisherSink publishes events as JSON to topic one by one, keyed by
+// block hash and log index so consumers can dedup
+type PublisherSink struct {
+	pub   Publisher
+	topic string
+}
+
+func NewPublisherSink(pub Publisher, topic string) *PublisherSink {
+	return &PublisherSink{pub: pub, topic: topic}
+}
+
+func (s *PublisherSink) Write(events []Event) error {
+	for _, evt := range events {
+		msg, err := json.Marshal(evt)
+		if err != nil {
+			return fmt.Errorf("marshal event in tx(%s) fail:%v", evt.TxHash.Hex(), err)
+		}
+		key := []byte(fmt.Sprintf("%s-%d", evt.BlockHash.Hex(), evt.LogIndex))
+		if err = s.pub.Publish(s.topic, key, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *PublisherSink) Close() error {
+	return nil
+}
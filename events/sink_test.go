@@ -0,0 +1,87 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/ethereum/go-ethereum/common"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type fakePublisher struct {
+	keys []string
+	fail bool
+}
+
+func (p *fakePublisher) Publish(topic string, key, msg []byte) error {
+	if p.fail {
+		return errors.New("broker down")
+	}
+	p.keys = append(p.keys, topic+"/"+string(key))
+	return nil
+}
+
+func TestEmitFlush(t *testing.T) {
+	pub := &fakePublisher{}
+	es := &eventScanner{ctx: context.Background(), sink: NewPublisherSink(pub, "evts")}
+	hash := common.HexToHash("0x01")
+	for i := uint(0); i < 2; i++ {
+		if !es.emit(Event{BlockHash: hash, LogIndex: i}) {
+			t.Fatal("emit to sink should not stop")
+		}
+	}
+	if len(pub.keys) != 0 {
+		t.Fatal("should not write before flush")
+	}
+	if err := es.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(pub.keys) != 2 || pub.keys[1] != "evts/"+hash.Hex()+"-1" {
+		t.Fatal("should publish batch keyed by block hash and log index", pub.keys)
+	}
+	pub.fail = true
+	es.emit(Event{BlockHash: hash})
+	if err := es.flush(); err == nil || len(es.batch) != 0 {
+		t.Fatal("should fail and drop batch", err)
+	}
+}
+
+func TestJSONLSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file_path := filepath.Join(dir, "events.jsonl")
+	for i := uint64(1); i <= 2; i++ {
+		sink, err := NewJSONLSink(file_path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = sink.Write([]Event{{BlockNumber: i, Name: "Transfer"}}); err != nil {
+			t.Fatal(err)
+		}
+		sink.Close()
+	}
+	file, err := os.Open(file_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var blocks []uint64
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var evt Event
+		if err = json.Unmarshal(scanner.Bytes(), &evt); err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, evt.BlockNumber)
+	}
+	if len(blocks) != 2 || blocks[0] != 1 || blocks[1] != 2 {
+		t.Fatal("should append events line by line", blocks)
+	}
+}
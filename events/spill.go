@@ -0,0 +1,195 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"os"
+	"sync"
+	"time"
+)
+
+// spillRecord keeps what an event is decoded from again
+type spillRecord struct {
+	Log       types.Log      `json:"log"`
+	Name      string         `json:"name"`
+	Removed   bool           `json:"removed"`
+	BlockTime time.Time      `json:"blockTime"`
+	From      common.Address `json:"from"`
+	TxStatus  uint64         `json:"txStatus"`
+}
+
+// spillQueue is a FIFO of events in a file, file is emptied whenever all
+// taken, nil queue is empty
+type spillQueue struct {
+	path string
+	w    *os.File
+	r    *os.File
+	rd   *bufio.Reader
+	// block numbers of events queued
+	blocks []uint64
+	notify chan struct{}
+	*sync.Mutex
+}
+
+func newSpillQueue(file_path string) (*spillQueue, error) {
+	w, err := os.OpenFile(file_path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	r, err := os.Open(file_path)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	return &spillQueue{
+		path:   file_path,
+		w:      w,
+		r:      r,
+		rd:     bufio.NewReader(r),
+		notify: make(chan struct{}, 1),
+		Mutex:  new(sync.Mutex),
+	}, nil
+}
+
+func (q *spillQueue) push(evt Event) error {
+	data, err := json.Marshal(spillRecord{
+		Log:       evt.log,
+		Name:      evt.Name,
+		Removed:   evt.Removed,
+		BlockTime: evt.BlockTime,
+		From:      evt.From,
+		TxStatus:  evt.TxStatus,
+	})
+	if err != nil {
+		return fmt.Errorf("spill event fail:%v", err)
+	}
+	q.Lock()
+	_, err = q.w.Write(append(data, '\n'))
+	if err == nil {
+		q.blocks = append(q.blocks, evt.BlockNumber)
+	}
+	q.Unlock()
+	if err != nil {
+		return fmt.Errorf("spill event fail:%v", err)
+	}
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// next reads the oldest record, it stays queued until done
+func (q *spillQueue) next() (spillRecord, bool, error) {
+	var rec spillRecord
+	q.Lock()
+	if len(q.blocks) == 0 {
+		q.Unlock()
+		return rec, false, nil
+	}
+	line, err := q.rd.ReadBytes('\n')
+	q.Unlock()
+	if err != nil {
+		return rec, false, fmt.Errorf("read spilled event fail:%v", err)
+	}
+	if err = json.Unmarshal(line, &rec); err != nil {
+		return rec, false, fmt.Errorf("read spilled event fail:%v", err)
+	}
+	return rec, true, nil
+}
+
+// done dequeues record read by next
+func (q *spillQueue) done() error {
+	q.Lock()
+	defer q.Unlock()
+	q.blocks = q.blocks[1:]
+	if len(q.blocks) > 0 {
+		return nil
+	}
+	if err := q.w.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := q.r.Seek(0, 0); err != nil {
+		return err
+	}
+	q.rd.Reset(q.r)
+	return nil
+}
+
+func (q *spillQueue) empty() bool {
+	_, ok := q.oldest()
+	return !ok
+}
+
+// oldest is block number of the first event queued
+func (q *spillQueue) oldest() (uint64, bool) {
+	if q == nil {
+		return 0, false
+	}
+	q.Lock()
+	defer q.Unlock()
+	if len(q.blocks) == 0 {
+		return 0, false
+	}
+	return q.blocks[0], true
+}
+
+// close drops events still queued
+func (q *spillQueue) close() error {
+	q.w.Close()
+	q.r.Close()
+	return os.Remove(q.path)
+}
+
+// pumpSpill sends spilled events in order until stopped
+func (es *eventScanner) pumpSpill() {
+	defer close(es.pumpDone)
+	for {
+		rec, ok, err := es.spill.next()
+		if err != nil {
+			es.sendErr(err)
+			return
+		}
+		if !ok {
+			select {
+			case <-es.spill.notify:
+				continue
+			case <-es.ctx.Done():
+				return
+			}
+		}
+		if evt, err := es.unspill(rec); err != nil {
+			es.sendErr(fmt.Errorf("decode spilled %s log in tx(%s) fail:%v,abadon", rec.Name, rec.Log.TxHash.Hex(), err))
+		} else {
+			select {
+			case es.DataChan <- evt:
+			case <-es.ctx.Done():
+				return
+			}
+		}
+		if err = es.spill.done(); err != nil {
+			es.sendErr(fmt.Errorf("reset spill file fail:%v", err))
+			return
+		}
+	}
+}
+
+func (es *eventScanner) unspill(rec spillRecord) (Event, error) {
+	es.contractsMu.RLock()
+	cm, ok := es.Contracts.GetMeta(rec.Log.Address)
+	es.contractsMu.RUnlock()
+	if !ok {
+		return Event{}, fmt.Errorf("contract %s not scanned", rec.Log.Address.Hex())
+	}
+	data, err := es.unpackAs(cm, rec.Name, rec.Log)
+	if err != nil {
+		return Event{}, err
+	}
+	evt, err := es.newEvent(cm, rec.Name, data, rec.Log)
+	evt.Removed = rec.Removed
+	evt.BlockTime, evt.From, evt.TxStatus = rec.BlockTime, rec.From, rec.TxStatus
+	return evt, err
+}
@@ -21,6 +21,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"strings"
 )
 
 // The ABI holds information about a contract's context and available
@@ -123,7 +124,16 @@ func (abi *ABI) UnmarshalJSON(data []byte) error {
 				Outputs: field.Outputs,
 			}
 		case "event":
-			abi.Events[field.Name] = Event{
+			// overloaded events are kept as name0, name1... while Event.Name
+			// stays the same, see EventBySig
+			key := field.Name
+			for i := 0; ; i++ {
+				if _, taken := abi.Events[key]; !taken {
+					break
+				}
+				key = fmt.Sprintf("%s%d", field.Name, i)
+			}
+			abi.Events[key] = Event{
 				Name:      field.Name,
 				Anonymous: field.Anonymous,
 				Inputs:    field.Inputs,
@@ -134,6 +144,18 @@ func (abi *ABI) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// EventBySig looks up an event by its signature, e.g. Transfer(address,uint256),
+// and returns the key of it in Events. Spaces in sig are ignored.
+func (abi ABI) EventBySig(sig string) (string, Event, bool) {
+	sig = strings.Replace(sig, " ", "", -1)
+	for key, event := range abi.Events {
+		if event.Sig() == sig {
+			return key, event, true
+		}
+	}
+	return "", Event{}, false
+}
+
 // MethodById looks up a method by the 4-byte id
 // returns nil if none found
 func (abi *ABI) MethodById(sigdata []byte) *Method {
@@ -560,6 +560,28 @@ func TestDefaultFunctionParsing(t *testing.T) {
 	}
 }
 
+func TestOverloadedEvents(t *testing.T) {
+	const definition = `[
+	{ "type" : "event", "name" : "Transfer", "inputs" : [{ "indexed":true, "name":"from", "type":"address" }, { "indexed":true, "name":"to", "type":"address" }, { "indexed":false, "name":"value", "type":"uint256" }] },
+	{ "type" : "event", "name" : "Transfer", "inputs" : [{ "indexed":true, "name":"from", "type":"address" }, { "indexed":true, "name":"to", "type":"address" }, { "indexed":false, "name":"value", "type":"uint256" }, { "indexed":false, "name":"data", "type":"bytes" }] }
+	]`
+
+	abi, err := JSON(strings.NewReader(definition))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(abi.Events) != 2 {
+		t.Fatalf("overloaded events should be kept, got %d", len(abi.Events))
+	}
+	key, event, ok := abi.EventBySig("Transfer(address, address, uint256, bytes)")
+	if !ok || key != "Transfer0" || event.Name != "Transfer" || len(event.Inputs) != 4 {
+		t.Fatalf("could not find event by signature, got %s %v %v", key, event, ok)
+	}
+	if event.Id() == abi.Events["Transfer"].Id() {
+		t.Error("overloaded events should have different ids")
+	}
+}
+
 func TestBareEvents(t *testing.T) {
 	const definition = `[
 	{ "type" : "event", "name" : "balance" },
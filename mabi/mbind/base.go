@@ -117,6 +117,16 @@ func (c *BoundContract) EventTopic(name string) common.Hash {
 	return c.abi.Events[name].Id()
 }
 
+// EventTopics converts query on indexed arguments of event name into a filter
+// topic set led by the event selector, the same as FilterLogs does. Anonymous
+// events have no selector, query starts from the first topic.
+func (c *BoundContract) EventTopics(name string, query ...[]interface{}) ([][]common.Hash, error) {
+	if !c.abi.Events[name].Anonymous {
+		query = append([][]interface{}{{c.abi.Events[name].Id()}}, query...)
+	}
+	return makeTopics(query...)
+}
+
 // Call invokes the (constant) contract method with params as input values and
 // sets the output to result. The result type might be a single field for simple
 // returns, a slice of interfaces for anonymous returns and a struct for named
@@ -344,10 +354,32 @@ func (c *BoundContract) UnpackLog(out abi.JSONObj, event string, log types.Log)
 	return parseTopics(out, indexed, log.Topics[1:])
 }
 
+// UnpackAnonymousLog unpacks a log of anonymous event evt, its indexed
+// arguments take all topics as there's no event selector.
+func UnpackAnonymousLog(out abi.JSONObj, evt abi.Event, log types.Log) error {
+	if len(log.Data) > 0 {
+		if err := evt.Inputs.Unpack(out, log.Data); err != nil {
+			return err
+		}
+	}
+	var indexed abi.Arguments
+	for _, arg := range evt.Inputs {
+		if arg.Indexed {
+			indexed = append(indexed, arg)
+		}
+	}
+	return parseTopics(out, indexed, log.Topics)
+}
+
+// UnpackMatchedLog unpacks log into the event its first topic selects, anonymous
+// events never match.
 func (c *BoundContract) UnpackMatchedLog(out abi.JSONObj, log types.Log) (string, error) {
+	if len(log.Topics) == 0 {
+		return "", errors.New("Can't find mathed event")
+	}
 	topic_hex := log.Topics[0].Hex()
 	for name, evt := range c.abi.Events {
-		if evt.Id().Hex() == topic_hex {
+		if !evt.Anonymous && evt.Id().Hex() == topic_hex {
 			return name, c.UnpackLog(out, name, log)
 		}
 	}